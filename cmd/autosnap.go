@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/zrepl/zrepl/util"
 	"github.com/zrepl/zrepl/zfs"
 	"sort"
@@ -23,20 +24,20 @@ type snapTime struct {
 	time time.Time
 }
 
-func (a *IntervalAutosnap) Run(ctx context.Context, didSnaps chan struct{}) {
+// The first time all filesystems are due for a snapshot, so that further snapshots are taken in lockstep.
+// The snapshot task should first run then and every SnapshotInterval afterwards.
+func (a *IntervalAutosnap) SyncPoint(ctx context.Context) (syncPoint time.Time, err error) {
 
 	a.log = ctx.Value(contextKeyLog).(Logger)
 
 	const LOG_TIME_FMT string = time.ANSIC
 
-	ds, err := zfs.ZFSListMapping(a.DatasetFilter)
+	ds, err := zfs.ZFSListMapping(ctx, a.DatasetFilter)
 	if err != nil {
-		a.log.Printf("error listing datasets: %s", err)
-		return
+		return time.Time{}, errors.Wrap(err, "error listing datasets")
 	}
 	if len(ds) == 0 {
-		a.log.Printf("no datasets matching dataset filter")
-		return
+		return time.Time{}, errors.New("no datasets matching dataset filter")
 	}
 
 	a.snaptimes = make([]snapTime, len(ds))
@@ -48,7 +49,7 @@ func (a *IntervalAutosnap) Run(ctx context.Context, didSnaps chan struct{}) {
 
 		l := util.NewPrefixLogger(a.log, d.ToString())
 
-		fsvs, err := zfs.ZFSListFilesystemVersions(d, &PrefixSnapshotFilter{a.Prefix})
+		fsvs, err := zfs.ZFSListFilesystemVersions(ctx, d, &PrefixSnapshotFilter{a.Prefix})
 		if err != nil {
 			l.Printf("error listing filesystem versions of %s")
 			continue
@@ -83,60 +84,39 @@ func (a *IntervalAutosnap) Run(ctx context.Context, didSnaps chan struct{}) {
 		return a.snaptimes[i].time.Before(a.snaptimes[j].time)
 	})
 
-	syncPoint := a.snaptimes[0]
-	a.log.Printf("sync point at %s (in %s)", syncPoint.time.Format(LOG_TIME_FMT), syncPoint.time.Sub(now))
-
-	select {
-	case <-ctx.Done():
-		a.log.Printf("context: %s", ctx.Err())
-		return
-
-	case <-time.After(syncPoint.time.Sub(now)):
-		a.log.Printf("snapshotting all filesystems to enable further snaps in lockstep")
-		a.doSnapshots(didSnaps)
-	}
-
-	ticker := time.NewTicker(a.SnapshotInterval)
-
-	for {
-		select {
-		case <-ctx.Done():
-			ticker.Stop()
-			a.log.Printf("context: %s", ctx.Err())
-			return
-
-		case <-ticker.C:
-			a.doSnapshots(didSnaps)
-		}
-	}
-
+	syncPoint = a.snaptimes[0].time
+	a.log.Printf("sync point at %s (in %s)", syncPoint.Format(LOG_TIME_FMT), syncPoint.Sub(now))
+	return syncPoint, nil
 }
 
-func (a *IntervalAutosnap) doSnapshots(didSnaps chan struct{}) {
+// Snapshots all filesystems, failing to snapshot one does not stop the others
+func (a *IntervalAutosnap) DoSnapshots(ctx context.Context) (err error) {
+
+	a.log = ctx.Value(contextKeyLog).(Logger)
 
 	// fetch new dataset list in case user added new dataset
-	ds, err := zfs.ZFSListMapping(a.DatasetFilter)
+	ds, err := zfs.ZFSListMapping(ctx, a.DatasetFilter)
 	if err != nil {
-		a.log.Printf("error listing datasets: %s", err)
-		return
+		return errors.Wrap(err, "error listing datasets")
 	}
 
+	failed := 0
+
 	// TODO channel programs -> allow a little jitter?
 	for _, d := range ds {
 		suffix := time.Now().In(time.UTC).Format("20060102_150405_000")
 		snapname := fmt.Sprintf("%s%s", a.Prefix, suffix)
 
 		a.log.Printf("snapshotting %s@%s", d.ToString(), snapname)
-		err := zfs.ZFSSnapshot(d, snapname, false)
+		err := zfs.ZFSSnapshot(ctx, d, snapname, false)
 		if err != nil {
 			a.log.Printf("error snapshotting %s: %s", d.ToString(), err)
+			failed++
 		}
 	}
 
-	select {
-	case didSnaps <- struct{}{}:
-	default:
-		a.log.Printf("warning: callback channel is full, discarding")
+	if failed > 0 {
+		return errors.Errorf("failed to snapshot %d of %d filesystems", failed, len(ds))
 	}
-
+	return nil
 }
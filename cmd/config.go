@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"io"
 
 	"fmt"
@@ -43,14 +44,15 @@ type JobDebugSettings struct {
 }
 
 type RWCConnecter interface {
-	Connect() (io.ReadWriteCloser, error)
+	Connect(ctx context.Context) (io.ReadWriteCloser, error)
 }
 type AuthenticatedChannelListenerFactory interface {
 	Listen() (AuthenticatedChannelListener, error)
 }
 
 type AuthenticatedChannelListener interface {
-	Accept() (ch io.ReadWriteCloser, err error)
+	// clientIdentity is the authenticated identity of the connecting client
+	Accept() (ch io.ReadWriteCloser, clientIdentity string, err error)
 	Close() (err error)
 }
 
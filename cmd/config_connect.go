@@ -1,8 +1,13 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"net"
+	"time"
 
 	"github.com/jinzhu/copier"
 	"github.com/mitchellh/mapstructure"
@@ -10,14 +15,18 @@ import (
 	"github.com/zrepl/zrepl/sshbytestream"
 )
 
+const DEFAULT_DIAL_TIMEOUT = 10 * time.Second
+
 type SSHStdinserverConnecter struct {
-	Host                 string
-	User                 string
-	Port                 uint16
-	IdentityFile         string   `mapstructure:"identity_file"`
+	Host         string
+	User         string
+	Port         uint16
+	IdentityFile string `mapstructure:"identity_file"`
+	// The remote command, e.g. if the authorized_keys entry has no forced command
 	TransportOpenCommand []string `mapstructure:"transport_open_command"`
-	SSHCommand           string   `mapstructure:"ssh_command"`
-	Options              []string
+	// Used instead of ssh from $PATH, e.g. a wrapper script
+	SSHCommand string `mapstructure:"ssh_command"`
+	Options    []string
 }
 
 func parseSSHStdinserverConnecter(i map[string]interface{}) (c *SSHStdinserverConnecter, err error) {
@@ -33,14 +42,164 @@ func parseSSHStdinserverConnecter(i map[string]interface{}) (c *SSHStdinserverCo
 
 }
 
-func (c *SSHStdinserverConnecter) Connect() (rwc io.ReadWriteCloser, err error) {
+func (c *SSHStdinserverConnecter) Connect(ctx context.Context) (rwc io.ReadWriteCloser, err error) {
 	var rpcTransport sshbytestream.SSHTransport
 	if err = copier.Copy(&rpcTransport, c); err != nil {
 		return
 	}
-	if rwc, err = sshbytestream.Outgoing(rpcTransport); err != nil {
+	if rwc, err = sshbytestream.Outgoing(ctx, rpcTransport); err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 	return
 }
+
+// Opens the connection by running Command, e.g. a wrapper script or docker exec,
+// and talks to the remote zrepl through the command's stdin and stdout.
+type CommandConnecter struct {
+	Command []string
+}
+
+func parseCommandConnecter(i map[string]interface{}) (c *CommandConnecter, err error) {
+	c = &CommandConnecter{}
+	if err = mapstructure.Decode(i, c); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return nil, errors.New("must specify 'command'")
+	}
+	return c, nil
+}
+
+func (c *CommandConnecter) Connect(ctx context.Context) (rwc io.ReadWriteCloser, err error) {
+	if rwc, err = sshbytestream.OutgoingCommand(ctx, c.Command, nil); err != nil {
+		return nil, errors.Wrapf(err, "cannot run %s", c.Command[0])
+	}
+	return rwc, nil
+}
+
+type TCPConnecter struct {
+	Address     string
+	DialTimeout time.Duration
+}
+
+func parseTCPConnecter(i map[string]interface{}) (c *TCPConnecter, err error) {
+
+	var asMap struct {
+		Address     string
+		DialTimeout string `mapstructure:"dial_timeout"`
+	}
+	if err = mapstructure.Decode(i, &asMap); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+
+	c = &TCPConnecter{Address: asMap.Address, DialTimeout: DEFAULT_DIAL_TIMEOUT}
+	if c.Address == "" {
+		return nil, errors.New("must specify 'address'")
+	}
+	if asMap.DialTimeout != "" {
+		if c.DialTimeout, err = time.ParseDuration(asMap.DialTimeout); err != nil {
+			return nil, errors.Wrap(err, "cannot parse 'dial_timeout'")
+		}
+	}
+	return c, nil
+}
+
+func (c *TCPConnecter) Connect(ctx context.Context) (rwc io.ReadWriteCloser, err error) {
+	dialer := net.Dialer{Timeout: c.DialTimeout}
+	if rwc, err = dialer.DialContext(ctx, "tcp", c.Address); err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to %s", c.Address)
+	}
+	return rwc, nil
+}
+
+type UnixConnecter struct {
+	Path string
+}
+
+func parseUnixConnecter(i map[string]interface{}) (c *UnixConnecter, err error) {
+	c = &UnixConnecter{}
+	if err = mapstructure.Decode(i, c); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+	if c.Path == "" {
+		return nil, errors.New("must specify 'path'")
+	}
+	return c, nil
+}
+
+func (c *UnixConnecter) Connect(ctx context.Context) (rwc io.ReadWriteCloser, err error) {
+	var dialer net.Dialer
+	if rwc, err = dialer.DialContext(ctx, "unix", c.Path); err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to %s", c.Path)
+	}
+	return rwc, nil
+}
+
+type TLSConnecter struct {
+	Address string
+	tlsKeyPair
+	// The CN of the server's certificate, the server's hostname is not verified
+	ServerCN    string
+	DialTimeout time.Duration
+}
+
+func parseTLSConnecter(i map[string]interface{}) (c *TLSConnecter, err error) {
+
+	var asMap struct {
+		Address     string
+		CA          string
+		Cert        string
+		Key         string
+		ServerCN    string `mapstructure:"server_cn"`
+		DialTimeout string `mapstructure:"dial_timeout"`
+	}
+	if err = mapstructure.Decode(i, &asMap); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+
+	c = &TLSConnecter{
+		Address:     asMap.Address,
+		tlsKeyPair:  tlsKeyPair{asMap.CA, asMap.Cert, asMap.Key},
+		ServerCN:    asMap.ServerCN,
+		DialTimeout: DEFAULT_DIAL_TIMEOUT,
+	}
+	if c.Address == "" {
+		return nil, errors.New("must specify 'address'")
+	}
+	if c.ServerCN == "" {
+		return nil, errors.New("must specify 'server_cn'")
+	}
+	if err = c.tlsKeyPair.validate(); err != nil {
+		return nil, err
+	}
+	if asMap.DialTimeout != "" {
+		if c.DialTimeout, err = time.ParseDuration(asMap.DialTimeout); err != nil {
+			return nil, errors.Wrap(err, "cannot parse 'dial_timeout'")
+		}
+	}
+	return c, nil
+}
+
+func (c *TLSConnecter) Connect(ctx context.Context) (rwc io.ReadWriteCloser, err error) {
+
+	ca, cert, err := c.tlsKeyPair.load()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// crypto/tls only verifies hostnames against SANs, we verify the chain and CN ourselves
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPeerCN(cs, ca, x509.ExtKeyUsageServerAuth, c.ServerCN)
+		},
+	}
+
+	dialer := tls.Dialer{NetDialer: &net.Dialer{Timeout: c.DialTimeout}, Config: config}
+	if rwc, err = dialer.DialContext(ctx, "tcp", c.Address); err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to %s", c.Address)
+	}
+	return rwc, nil
+}
@@ -31,3 +31,15 @@ func parsePrefixSnapshotFilter(i string) (f *PrefixSnapshotFilter, err error) {
 func (f *PrefixSnapshotFilter) Filter(fsv zfs.FilesystemVersion) (accept bool, err error) {
 	return fsv.Type == zfs.Snapshot && strings.HasPrefix(fsv.Name, f.Prefix), nil
 }
+
+// Accepts snapshots and bookmarks whose name has the given prefix.
+//
+// The Handler uses it to expose the bookmarks created after each replication
+// step, which carry the name of the snapshot they were created from.
+type PrefixVersionFilter struct {
+	Prefix string
+}
+
+func (f *PrefixVersionFilter) Filter(fsv zfs.FilesystemVersion) (accept bool, err error) {
+	return strings.HasPrefix(fsv.Name, f.Prefix), nil
+}
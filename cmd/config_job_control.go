@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/zrepl/zrepl/util"
@@ -33,6 +34,9 @@ func (j *ControlJob) JobName() string {
 
 const (
 	ControlJobEndpointProfile string = "/debug/pprof/profile"
+	ControlJobEndpointStatus  string = "/status"
+	// POST with query parameters job and mode, see WakeupMode
+	ControlJobEndpointWakeup string = "/wakeup"
 )
 
 func (j *ControlJob) JobStart(ctx context.Context) {
@@ -48,6 +52,35 @@ func (j *ControlJob) JobStart(ctx context.Context) {
 
 	mux := http.NewServeMux()
 	mux.Handle(ControlJobEndpointProfile, requestLogger{log, pprof.Profile})
+	if d, ok := ctx.Value(contextKeyDaemon).(*Daemon); ok {
+		mux.Handle(ControlJobEndpointStatus, requestLogger{log, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(d.Status()); err != nil {
+				log.Printf("error encoding status: %s", err)
+			}
+		}})
+		mux.Handle(ControlJobEndpointWakeup, requestLogger{log, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "wakeup requires POST", http.StatusMethodNotAllowed)
+				return
+			}
+			mode, err := parseWakeupMode(r.URL.Query().Get("mode"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// blocks until the cycle finished or the client disconnected
+			results, err := d.Wakeup(r.Context(), r.URL.Query().Get("job"), mode)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(results); err != nil {
+				log.Printf("error encoding wakeup results: %s", err)
+			}
+		}})
+	}
 	server := http.Server{Handler: mux}
 
 outer:
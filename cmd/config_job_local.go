@@ -6,6 +6,7 @@ import (
 	"context"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/jobrun"
 	"github.com/zrepl/zrepl/rpc"
 	"github.com/zrepl/zrepl/util"
 	"github.com/zrepl/zrepl/zfs"
@@ -13,26 +14,34 @@ import (
 )
 
 type LocalJob struct {
-	Name              string
-	Mapping           *DatasetMapFilter
-	SnapshotPrefix    string
-	Interval          time.Duration
-	InitialReplPolicy InitialReplPolicy
-	PruneLHS          PrunePolicy
-	PruneRHS          PrunePolicy
-	Debug             JobDebugSettings
+	Name               string
+	Mapping            *DatasetMapFilter
+	SnapshotPrefix     string
+	Interval           time.Duration
+	InitialReplPolicy  InitialReplPolicy
+	Send               zfs.SendFlags
+	RecvProperties     zfs.RecvProperties
+	ConflictResolution ConflictResolution
+	PruneLHS           PrunePolicy
+	PruneRHS           PrunePolicy
+	Debug              JobDebugSettings
+
+	tasks jobTasks
 }
 
 func parseLocalJob(c JobParsingContext, name string, i map[string]interface{}) (j *LocalJob, err error) {
 
 	var asMap struct {
-		Mapping           map[string]string
-		SnapshotPrefix    string `mapstructure:"snapshot_prefix"`
-		Interval          string
-		InitialReplPolicy string                 `mapstructure:"initial_repl_policy"`
-		PruneLHS          map[string]interface{} `mapstructure:"prune_lhs"`
-		PruneRHS          map[string]interface{} `mapstructure:"prune_rhs"`
-		Debug             map[string]interface{}
+		Mapping            map[string]string
+		SnapshotPrefix     string `mapstructure:"snapshot_prefix"`
+		Interval           string
+		InitialReplPolicy  string `mapstructure:"initial_repl_policy"`
+		Send               map[string]interface{}
+		RecvProperties     map[string]interface{} `mapstructure:"recv_properties"`
+		ConflictResolution string                 `mapstructure:"conflict_resolution"`
+		PruneLHS           map[string]interface{} `mapstructure:"prune_lhs"`
+		PruneRHS           map[string]interface{} `mapstructure:"prune_rhs"`
+		Debug              map[string]interface{}
 	}
 
 	if err = mapstructure.Decode(i, &asMap); err != nil {
@@ -59,6 +68,21 @@ func parseLocalJob(c JobParsingContext, name string, i map[string]interface{}) (
 		return
 	}
 
+	if j.Send, err = parseSendFlags(asMap.Send); err != nil {
+		err = errors.Wrap(err, "cannot parse 'send'")
+		return
+	}
+
+	if j.RecvProperties, err = parseRecvProperties(asMap.RecvProperties); err != nil {
+		err = errors.Wrap(err, "cannot parse 'recv_properties'")
+		return
+	}
+
+	if j.ConflictResolution, err = parseConflictResolution(asMap.ConflictResolution, DEFAULT_CONFLICT_RESOLUTION); err != nil {
+		err = errors.Wrap(err, "cannot parse 'conflict_resolution'")
+		return
+	}
+
 	if j.PruneLHS, err = parsePrunePolicy(asMap.PruneLHS); err != nil {
 		err = errors.Wrap(err, "cannot parse 'prune_lhs'")
 		return
@@ -91,87 +115,84 @@ func (j *LocalJob) JobStart(ctx context.Context) {
 	// All local datasets will be passed to its Map() function,
 	// but only those for which a mapping exists will actually be pulled.
 	// We can pay this small performance penalty for now.
-	handler := NewHandler(log, localPullACL{}, &PrefixSnapshotFilter{j.SnapshotPrefix})
+	// The job is the only client of its handler, its name identifies it in the holds.
+	handler := NewHandler(ctx, log, localPullACL{}, &PrefixVersionFilter{j.SnapshotPrefix}, j.Name, j.Send, util.BandwidthLimit{})
 
 	registerEndpoints(local, handler)
 
-	snapper := IntervalAutosnap{
+	snapper := &IntervalAutosnap{
 		DatasetFilter:    j.Mapping.AsFilter(),
 		Prefix:           j.SnapshotPrefix,
 		SnapshotInterval: j.Interval,
 	}
 
-	plhs, err := j.Pruner(PrunePolicySideLeft, false)
-	if err != nil {
-		log.Printf("error creating lhs pruner: %s", err)
-		return
-	}
-	prhs, err := j.Pruner(PrunePolicySideRight, false)
+	prune := &jobTask{name: "prune", phase: JobPhasePruning, do: j.doPrune, repeat: jobrun.NoRepeatStrategy{}}
+	replicate := &jobTask{name: "repl", phase: JobPhaseReplicating, next: prune, repeat: jobrun.NoRepeatStrategy{},
+		do: func(ctx context.Context) error {
+			log := ctx.Value(contextKeyLog).(Logger)
+			log.Printf("replicating from lhs to rhs")
+			err := doPull(ctx, PullContext{local, log, j.Mapping, j.InitialReplPolicy, j.Send, j.RecvProperties, j.ConflictResolution, util.BandwidthLimit{}, &j.tasks.replication})
+			return errors.Wrap(err, "error replicating lhs to rhs")
+		}}
+	snap := &jobTask{name: "autosnap", phase: JobPhaseSnapshotting, do: snapper.DoSnapshots, next: replicate,
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: j.Interval}}
+
+	syncPoint, err := snapper.SyncPoint(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "autosnap")))
 	if err != nil {
-		log.Printf("error creating rhs pruner: %s", err)
-		return
+		log.Printf("cannot determine sync point, snapshotting now: %s", err)
+		syncPoint = time.Now()
 	}
+	j.tasks.run(ctx, snap, syncPoint)
 
-	makeCtx := func(parent context.Context, logPrefix string) (ctx context.Context) {
-		return context.WithValue(parent, contextKeyLog, util.NewPrefixLogger(log, logPrefix))
-	}
-	var snapCtx, plCtx, prCtx, pullCtx context.Context
-	snapCtx = makeCtx(ctx, "autosnap")
-	plCtx = makeCtx(ctx, "prune_lhs")
-	prCtx = makeCtx(ctx, "prune_rhs")
-	pullCtx = makeCtx(ctx, "repl")
+	log.Printf("context: %s", ctx.Err())
 
-	didSnaps := make(chan struct{})
-	go snapper.Run(snapCtx, didSnaps)
+}
 
-outer:
-	for {
+func (j *LocalJob) JobStatus() JobStatus {
+	return j.tasks.status()
+}
 
-		select {
-		case <-ctx.Done():
-			break outer
-		case <-didSnaps:
-			log.Printf("finished taking snapshots")
-			log.Printf("starting replication procedure")
-		}
+func (j *LocalJob) Wakeup(ctx context.Context, mode WakeupMode) ([]TaskRunResult, error) {
+	return j.tasks.wakeup(ctx, mode)
+}
 
-		{
-			log := pullCtx.Value(contextKeyLog).(Logger)
-			log.Printf("replicating from lhs to rhs")
-			err := doPull(PullContext{local, log, j.Mapping, j.InitialReplPolicy})
-			if err != nil {
-				log.Printf("error replicating lhs to rhs: %s", err)
-			}
-			// use a ctx as soon as doPull gains ctx support
-			select {
-			case <-ctx.Done():
-				break outer
-			default:
-			}
-		}
+// Prunes both sides concurrently
+func (j *LocalJob) doPrune(ctx context.Context) (err error) {
 
-		var wg sync.WaitGroup
+	log := ctx.Value(contextKeyLog).(Logger)
 
-		log.Printf("pruning lhs")
-		wg.Add(1)
-		go func() {
-			plhs.Run(plCtx)
-			wg.Done()
-		}()
+	plhs, err := j.Pruner(PrunePolicySideLeft, false)
+	if err != nil {
+		return errors.Wrap(err, "error creating lhs pruner")
+	}
+	prhs, err := j.Pruner(PrunePolicySideRight, false)
+	if err != nil {
+		return errors.Wrap(err, "error creating rhs pruner")
+	}
 
-		log.Printf("pruning rhs")
-		wg.Add(1)
-		go func() {
-			prhs.Run(prCtx)
-			wg.Done()
-		}()
+	var wg sync.WaitGroup
+	var lerr, rerr error
 
-		wg.Wait()
+	log.Printf("pruning lhs")
+	wg.Add(1)
+	go func() {
+		_, lerr = plhs.Run(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "lhs")))
+		wg.Done()
+	}()
 
-	}
+	log.Printf("pruning rhs")
+	wg.Add(1)
+	go func() {
+		_, rerr = prhs.Run(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "rhs")))
+		wg.Done()
+	}()
 
-	log.Printf("context: %s", ctx.Err())
+	wg.Wait()
 
+	if lerr != nil {
+		return errors.Wrap(lerr, "error pruning lhs")
+	}
+	return errors.Wrap(rerr, "error pruning rhs")
 }
 
 func (j *LocalJob) Pruner(side PrunePolicySide, dryRun bool) (p Pruner, err error) {
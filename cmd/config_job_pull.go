@@ -6,8 +6,10 @@ import (
 	"context"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/jobrun"
 	"github.com/zrepl/zrepl/rpc"
 	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
 )
 
 type PullJob struct {
@@ -16,23 +18,39 @@ type PullJob struct {
 	Interval time.Duration
 	Mapping  *DatasetMapFilter
 	// constructed from mapping during parsing
-	pruneFilter       *DatasetMapFilter
-	SnapshotPrefix    string
-	InitialReplPolicy InitialReplPolicy
-	Prune             PrunePolicy
-	Debug             JobDebugSettings
+	pruneFilter        *DatasetMapFilter
+	SnapshotPrefix     string
+	InitialReplPolicy  InitialReplPolicy
+	Send               zfs.SendFlags
+	RecvProperties     zfs.RecvProperties
+	ConflictResolution ConflictResolution
+	// Of the zfs send streams on the connection, if the source supports it
+	Compression rpc.Compression
+	// Of the receiving side, applies to every stream
+	BandwidthLimit util.BandwidthLimit
+	Keepalive      rpc.Keepalive
+	Prune          PrunePolicy
+	Debug          JobDebugSettings
+
+	tasks jobTasks
 }
 
 func parsePullJob(c JobParsingContext, name string, i map[string]interface{}) (j *PullJob, err error) {
 
 	var asMap struct {
-		Connect           map[string]interface{}
-		Interval          string
-		Mapping           map[string]string
-		InitialReplPolicy string `mapstructure:"initial_repl_policy"`
-		Prune             map[string]interface{}
-		SnapshotPrefix    string `mapstructure:"snapshot_prefix"`
-		Debug             map[string]interface{}
+		Connect            map[string]interface{}
+		Interval           string
+		Mapping            map[string]string
+		InitialReplPolicy  string `mapstructure:"initial_repl_policy"`
+		Send               map[string]interface{}
+		RecvProperties     map[string]interface{} `mapstructure:"recv_properties"`
+		ConflictResolution string                 `mapstructure:"conflict_resolution"`
+		Compression        string
+		BandwidthLimit     map[string]interface{} `mapstructure:"bandwidth_limit"`
+		Keepalive          map[string]interface{}
+		Prune              map[string]interface{}
+		SnapshotPrefix     string `mapstructure:"snapshot_prefix"`
+		Debug              map[string]interface{}
 	}
 
 	if err = mapstructure.Decode(i, &asMap); err != nil {
@@ -42,7 +60,7 @@ func parsePullJob(c JobParsingContext, name string, i map[string]interface{}) (j
 
 	j = &PullJob{Name: name}
 
-	j.Connect, err = parseSSHStdinserverConnecter(asMap.Connect)
+	j.Connect, err = parseConnect(asMap.Connect)
 	if err != nil {
 		err = errors.Wrap(err, "cannot parse 'connect'")
 		return nil, err
@@ -70,6 +88,36 @@ func parsePullJob(c JobParsingContext, name string, i map[string]interface{}) (j
 		return
 	}
 
+	if j.Send, err = parseSendFlags(asMap.Send); err != nil {
+		err = errors.Wrap(err, "cannot parse 'send'")
+		return
+	}
+
+	if j.RecvProperties, err = parseRecvProperties(asMap.RecvProperties); err != nil {
+		err = errors.Wrap(err, "cannot parse 'recv_properties'")
+		return
+	}
+
+	if j.ConflictResolution, err = parseConflictResolution(asMap.ConflictResolution, DEFAULT_CONFLICT_RESOLUTION); err != nil {
+		err = errors.Wrap(err, "cannot parse 'conflict_resolution'")
+		return
+	}
+
+	if j.Compression, err = parseCompression(asMap.Compression); err != nil {
+		err = errors.Wrap(err, "cannot parse 'compression'")
+		return
+	}
+
+	if j.BandwidthLimit, err = parseBandwidthLimit(asMap.BandwidthLimit); err != nil {
+		err = errors.Wrap(err, "cannot parse 'bandwidth_limit'")
+		return
+	}
+
+	if j.Keepalive, err = parseKeepalive(asMap.Keepalive); err != nil {
+		err = errors.Wrap(err, "cannot parse 'keepalive'")
+		return
+	}
+
 	if j.SnapshotPrefix, err = parseSnapshotPrefix(asMap.SnapshotPrefix); err != nil {
 		return
 	}
@@ -96,57 +144,71 @@ func (j *PullJob) JobStart(ctx context.Context) {
 	log := ctx.Value(contextKeyLog).(Logger)
 	defer log.Printf("exiting")
 
-	ticker := time.NewTicker(j.Interval)
+	prune := &jobTask{name: "prune", phase: JobPhasePruning, do: j.doPrune, repeat: jobrun.NoRepeatStrategy{}}
+	pull := &jobTask{name: "pull", phase: JobPhaseReplicating, do: j.doPull, next: prune,
+		repeat: jobrun.NewBackoffRepeatStrategy(j.Interval, DEFAULT_RETRY_BACKOFF)}
+	j.tasks.run(ctx, pull, time.Now())
 
-start:
+	log.Printf("context: %s", ctx.Err())
+}
+
+// Connects and pulls once, the prune task runs afterwards regardless of the result
+func (j *PullJob) doPull(ctx context.Context) (err error) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
 
 	log.Printf("connecting")
-	rwc, err := j.Connect.Connect()
+	rwc, err := connectWithBackoff(ctx, log, j.Connect, newConnectBackoff(), time.Now().Add(j.Interval))
 	if err != nil {
-		log.Printf("error connecting: %s", err)
-		return
+		return errors.Wrap(err, "error connecting")
 	}
 
-	rwc, err = util.NewReadWriteCloserLogger(rwc, j.Debug.Conn.ReadDump, j.Debug.Conn.WriteDump)
+	loggedRWC, err := util.NewReadWriteCloserLogger(rwc, j.Debug.Conn.ReadDump, j.Debug.Conn.WriteDump)
 	if err != nil {
-		return
+		rwc.Close()
+		return errors.Wrap(err, "error opening connection dump files")
 	}
+	rwc = loggedRWC
 
 	client := rpc.NewClient(rwc)
 	if j.Debug.RPC.Log {
 		client.SetLogger(log, true)
 	}
+	client.SetCompression(j.Compression)
+	client.SetKeepalive(j.Keepalive)
 
 	log.Printf("starting pull")
 
-	pullLog := util.NewPrefixLogger(log, "pull")
-	err = doPull(PullContext{client, pullLog, j.Mapping, j.InitialReplPolicy})
+	err = doPull(ctx, PullContext{client, log, j.Mapping, j.InitialReplPolicy, j.Send, j.RecvProperties, j.ConflictResolution, j.BandwidthLimit, &j.tasks.replication})
 	if err != nil {
-		log.Printf("error doing pull: %s", err)
+		err = errors.Wrap(err, "error doing pull")
 	}
 
 	closeRPCWithTimeout(log, client, time.Second*10, "")
+	// the rpc layer does not close the connection it was created with
+	if err := rwc.Close(); err != nil {
+		log.Printf("error closing connection: %s", err)
+	}
+	return err
+}
 
-	log.Printf("starting prune")
-	prunectx := context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "prune"))
+func (j *PullJob) doPrune(ctx context.Context) (err error) {
 	pruner, err := j.Pruner(PrunePolicySideDefault, false)
 	if err != nil {
-		log.Printf("error creating pruner: %s", err)
-		return
+		return errors.Wrap(err, "error creating pruner")
 	}
-
-	pruner.Run(prunectx)
-	log.Printf("finish prune")
-
-	log.Printf("wait for next interval")
-	select {
-	case <-ctx.Done():
-		log.Printf("context: %s", ctx.Err())
-		return
-	case <-ticker.C:
-		goto start
+	if _, err = pruner.Run(ctx); err != nil {
+		return errors.Wrap(err, "error doing prune")
 	}
+	return nil
+}
 
+func (j *PullJob) JobStatus() JobStatus {
+	return j.tasks.status()
+}
+
+func (j *PullJob) Wakeup(ctx context.Context, mode WakeupMode) ([]TaskRunResult, error) {
+	return j.tasks.wakeup(ctx, mode)
 }
 
 func (j *PullJob) Pruner(side PrunePolicySide, dryRun bool) (p Pruner, err error) {
@@ -159,7 +221,3 @@ func (j *PullJob) Pruner(side PrunePolicySide, dryRun bool) (p Pruner, err error
 	}
 	return
 }
-
-func (j *PullJob) doRun(ctx context.Context) {
-
-}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/jobrun"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+)
+
+type PushJob struct {
+	Name              string
+	Connect           RWCConnecter
+	Datasets          *DatasetMapFilter
+	SnapshotPrefix    string
+	Interval          time.Duration
+	InitialReplPolicy InitialReplPolicy
+	Send              zfs.SendFlags
+	// Of the zfs send streams on the connection, if the sink supports it
+	Compression    rpc.Compression
+	BandwidthLimit util.BandwidthLimit
+	Keepalive      rpc.Keepalive
+	Prune          PrunePolicy
+	Debug          JobDebugSettings
+
+	tasks jobTasks
+}
+
+func parsePushJob(c JobParsingContext, name string, i map[string]interface{}) (j *PushJob, err error) {
+
+	var asMap struct {
+		Connect           map[string]interface{}
+		Datasets          map[string]string
+		SnapshotPrefix    string `mapstructure:"snapshot_prefix"`
+		Interval          string
+		InitialReplPolicy string `mapstructure:"initial_repl_policy"`
+		Send              map[string]interface{}
+		Compression       string
+		BandwidthLimit    map[string]interface{} `mapstructure:"bandwidth_limit"`
+		Keepalive         map[string]interface{}
+		Prune             map[string]interface{}
+		Debug             map[string]interface{}
+	}
+
+	if err = mapstructure.Decode(i, &asMap); err != nil {
+		err = errors.Wrap(err, "mapstructure error")
+		return nil, err
+	}
+
+	j = &PushJob{Name: name}
+
+	if j.Connect, err = parseConnect(asMap.Connect); err != nil {
+		err = errors.Wrap(err, "cannot parse 'connect'")
+		return
+	}
+
+	if j.Datasets, err = parseDatasetMapFilter(asMap.Datasets, true); err != nil {
+		err = errors.Wrap(err, "cannot parse 'datasets'")
+		return
+	}
+
+	if j.SnapshotPrefix, err = parseSnapshotPrefix(asMap.SnapshotPrefix); err != nil {
+		return
+	}
+
+	if j.Interval, err = time.ParseDuration(asMap.Interval); err != nil {
+		err = errors.Wrap(err, "cannot parse 'interval'")
+		return
+	}
+
+	j.InitialReplPolicy, err = parseInitialReplPolicy(asMap.InitialReplPolicy, DEFAULT_INITIAL_REPL_POLICY)
+	if err != nil {
+		err = errors.Wrap(err, "cannot parse 'initial_repl_policy'")
+		return
+	}
+
+	if j.Send, err = parseSendFlags(asMap.Send); err != nil {
+		err = errors.Wrap(err, "cannot parse 'send'")
+		return
+	}
+
+	if j.Compression, err = parseCompression(asMap.Compression); err != nil {
+		err = errors.Wrap(err, "cannot parse 'compression'")
+		return
+	}
+
+	if j.BandwidthLimit, err = parseBandwidthLimit(asMap.BandwidthLimit); err != nil {
+		err = errors.Wrap(err, "cannot parse 'bandwidth_limit'")
+		return
+	}
+
+	if j.Keepalive, err = parseKeepalive(asMap.Keepalive); err != nil {
+		err = errors.Wrap(err, "cannot parse 'keepalive'")
+		return
+	}
+
+	if j.Prune, err = parsePrunePolicy(asMap.Prune); err != nil {
+		err = errors.Wrap(err, "cannot parse 'prune'")
+		return
+	}
+
+	if err = mapstructure.Decode(asMap.Debug, &j.Debug); err != nil {
+		err = errors.Wrap(err, "cannot parse 'debug'")
+		return
+	}
+
+	return
+}
+
+func (j *PushJob) JobName() string {
+	return j.Name
+}
+
+func (j *PushJob) JobStart(ctx context.Context) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
+	defer log.Printf("exiting")
+
+	snapper := &IntervalAutosnap{DatasetFilter: j.Datasets, Prefix: j.SnapshotPrefix, SnapshotInterval: j.Interval}
+	prune := &jobTask{name: "prune", phase: JobPhasePruning, do: j.doPrune, repeat: jobrun.NoRepeatStrategy{}}
+	push := &jobTask{name: "push", phase: JobPhaseReplicating, do: j.push, next: prune, repeat: jobrun.NoRepeatStrategy{}}
+	snap := &jobTask{name: "autosnap", phase: JobPhaseSnapshotting, do: snapper.DoSnapshots, next: push,
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: j.Interval}}
+
+	syncPoint, err := snapper.SyncPoint(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "autosnap")))
+	if err != nil {
+		log.Printf("cannot determine sync point, snapshotting now: %s", err)
+		syncPoint = time.Now()
+	}
+	j.tasks.run(ctx, snap, syncPoint)
+
+	log.Printf("context: %s", ctx.Err())
+
+}
+
+// Connects and pushes once, a failed push is retried after the next snapshots
+func (j *PushJob) push(ctx context.Context) (err error) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
+
+	log.Printf("connecting")
+	rwc, err := connectWithBackoff(ctx, log, j.Connect, newConnectBackoff(), time.Now().Add(j.Interval))
+	if err != nil {
+		return errors.Wrap(err, "error connecting")
+	}
+
+	loggedRWC, err := util.NewReadWriteCloserLogger(rwc, j.Debug.Conn.ReadDump, j.Debug.Conn.WriteDump)
+	if err != nil {
+		rwc.Close()
+		return errors.Wrap(err, "error opening connection dump files")
+	}
+	rwc = loggedRWC
+
+	client := rpc.NewClient(rwc)
+	if j.Debug.RPC.Log {
+		client.SetLogger(log, true)
+	}
+	client.SetCompression(j.Compression)
+	client.SetKeepalive(j.Keepalive)
+
+	local := rpc.NewLocalRPC()
+	// The sink is the only client of the handler, the job name identifies it in the holds
+	handler := NewHandler(ctx, log, j.Datasets, &PrefixVersionFilter{j.SnapshotPrefix}, j.Name, j.Send, j.BandwidthLimit)
+	registerEndpoints(local, handler)
+
+	err = doPush(ctx, PushContext{local, client, log, j.InitialReplPolicy, j.Send, &j.tasks.replication})
+	if err != nil {
+		err = errors.Wrap(err, "error doing push")
+	}
+
+	closeRPCWithTimeout(log, client, time.Second*10, "")
+	// the rpc layer does not close the connection it was created with
+	if err := rwc.Close(); err != nil {
+		log.Printf("error closing connection: %s", err)
+	}
+	return err
+}
+
+func (j *PushJob) JobStatus() JobStatus {
+	return j.tasks.status()
+}
+
+func (j *PushJob) Wakeup(ctx context.Context, mode WakeupMode) ([]TaskRunResult, error) {
+	return j.tasks.wakeup(ctx, mode)
+}
+
+func (j *PushJob) doPrune(ctx context.Context) (err error) {
+	pruner, err := j.Pruner(PrunePolicySideDefault, false)
+	if err != nil {
+		return errors.Wrap(err, "error creating pruner")
+	}
+	if _, err = pruner.Run(ctx); err != nil {
+		return errors.Wrap(err, "error doing prune")
+	}
+	return nil
+}
+
+func (j *PushJob) Pruner(side PrunePolicySide, dryRun bool) (p Pruner, err error) {
+	p = Pruner{
+		time.Now(),
+		dryRun,
+		j.Datasets,
+		j.SnapshotPrefix,
+		j.Prune,
+	}
+	return
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+)
+
+type SinkJob struct {
+	Name  string
+	Serve AuthenticatedChannelListenerFactory
+	// The filesystems of a client are received below Root/CLIENT_IDENTITY
+	Root           *zfs.DatasetPath
+	RecvProperties zfs.RecvProperties
+	Keepalive      rpc.Keepalive
+	// Of concurrently served connections, 0 means unlimited
+	MaxSessions          int
+	MaxSessionsPerClient int
+	// Only snapshots with this prefix are pruned
+	SnapshotPrefix string
+	Prune          PrunePolicy
+	Debug          JobDebugSettings
+	// constructed from Root during parsing
+	pruneFilter *DatasetMapFilter
+}
+
+func parseSinkJob(c JobParsingContext, name string, i map[string]interface{}) (j *SinkJob, err error) {
+
+	var asMap struct {
+		Serve                map[string]interface{}
+		Root                 string
+		RecvProperties       map[string]interface{} `mapstructure:"recv_properties"`
+		Keepalive            map[string]interface{}
+		MaxSessions          int    `mapstructure:"max_sessions"`
+		MaxSessionsPerClient int    `mapstructure:"max_sessions_per_client"`
+		SnapshotPrefix       string `mapstructure:"snapshot_prefix"`
+		Prune                map[string]interface{}
+		Debug                map[string]interface{}
+	}
+
+	if err = mapstructure.Decode(i, &asMap); err != nil {
+		err = errors.Wrap(err, "mapstructure error")
+		return nil, err
+	}
+
+	j = &SinkJob{Name: name}
+
+	if j.Serve, err = parseAuthenticatedChannelListenerFactory(c, asMap.Serve); err != nil {
+		return
+	}
+
+	if j.Root, err = zfs.NewDatasetPath(asMap.Root); err != nil {
+		err = errors.Wrap(err, "cannot parse 'root'")
+		return
+	}
+	if j.Root.Empty() {
+		err = errors.New("must specify 'root'")
+		return
+	}
+
+	if j.pruneFilter, err = parseDatasetMapFilter(map[string]string{asMap.Root + "<": "ok"}, true); err != nil {
+		err = errors.Wrap(err, "cannot build prune filter from 'root'")
+		return
+	}
+
+	if j.RecvProperties, err = parseRecvProperties(asMap.RecvProperties); err != nil {
+		err = errors.Wrap(err, "cannot parse 'recv_properties'")
+		return
+	}
+
+	if j.Keepalive, err = parseKeepalive(asMap.Keepalive); err != nil {
+		err = errors.Wrap(err, "cannot parse 'keepalive'")
+		return
+	}
+
+	if asMap.MaxSessions < 0 || asMap.MaxSessionsPerClient < 0 {
+		err = errors.New("'max_sessions' and 'max_sessions_per_client' must not be negative")
+		return
+	}
+	j.MaxSessions, j.MaxSessionsPerClient = asMap.MaxSessions, asMap.MaxSessionsPerClient
+
+	if j.SnapshotPrefix, err = parseSnapshotPrefix(asMap.SnapshotPrefix); err != nil {
+		return
+	}
+
+	if j.Prune, err = parsePrunePolicy(asMap.Prune); err != nil {
+		err = errors.Wrap(err, "cannot parse 'prune'")
+		return
+	}
+
+	if err = mapstructure.Decode(asMap.Debug, &j.Debug); err != nil {
+		err = errors.Wrap(err, "cannot parse 'debug'")
+		return
+	}
+
+	return
+}
+
+func (j *SinkJob) JobName() string {
+	return j.Name
+}
+
+// The dataset below which the filesystems of the client are received
+func (j *SinkJob) clientRoot(clientIdentity string) (root *zfs.DatasetPath, err error) {
+	if clientIdentity == "" || strings.Contains(clientIdentity, "/") {
+		return nil, errors.Errorf("client identity '%s' is not a valid dataset name component", clientIdentity)
+	}
+	client, err := zfs.NewDatasetPath(clientIdentity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "client identity '%s' is not a valid dataset name component", clientIdentity)
+	}
+	root = j.Root.Copy()
+	root.Extend(client)
+	return root, nil
+}
+
+func (j *SinkJob) JobStart(ctx context.Context) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
+	defer log.Printf("exiting")
+
+	serveContext, cancelServe := context.WithCancel(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "serve")))
+	prunerContext := context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "prune"))
+	// Signaled after a session received a stream
+	received := make(chan struct{}, 1)
+
+	served := make(chan struct{})
+	go func() {
+		j.serve(serveContext, received)
+		close(served)
+	}()
+	// Also if JobStart panics, the listener must be closed before the job is restarted
+	defer func() {
+		cancelServe()
+		<-served
+	}()
+
+outer:
+	for {
+		select {
+		case <-ctx.Done():
+			break outer
+		case <-received:
+			p, err := j.Pruner(PrunePolicySideDefault, false)
+			if err != nil {
+				log.Printf("error creating pruner: %s", err)
+				continue
+			}
+			log.Printf("starting pruner")
+			p.Run(prunerContext)
+			log.Printf("pruner done")
+		}
+	}
+	log.Printf("context: %s", ctx.Err())
+
+}
+
+func (j *SinkJob) serve(ctx context.Context, received chan<- struct{}) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
+
+	listener, err := j.Serve.Listen()
+	if err != nil {
+		log.Printf("error listening: %s", err)
+		return
+	}
+
+	limiter := newSessionLimiter(j.MaxSessions, j.MaxSessionsPerClient)
+	serveSessions(ctx, log, listener, limiter, func(ctx context.Context, log Logger, rwc io.ReadWriteCloser, clientIdentity string) {
+		root, err := j.clientRoot(clientIdentity)
+		if err != nil {
+			log.Printf("rejecting connection: %s", err)
+			rwc.Close()
+			return
+		}
+		handler := NewSinkHandler(ctx, log, root, j.RecvProperties)
+		serveRPC(ctx, log, rwc, j.Debug, j.Keepalive, func(server rpc.RPCServer) {
+			registerSinkEndpoints(server, handler)
+		})
+		if handler.received {
+			select {
+			case received <- struct{}{}:
+			default: // pruner already pending
+			}
+		}
+	})
+}
+
+func (j *SinkJob) Pruner(side PrunePolicySide, dryRun bool) (p Pruner, err error) {
+	p = Pruner{
+		time.Now(),
+		dryRun,
+		j.pruneFilter,
+		j.SnapshotPrefix,
+		j.Prune,
+	}
+	return
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	mapstructure "github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/jobrun"
 	"github.com/zrepl/zrepl/rpc"
 	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
 	"io"
 	"time"
 )
@@ -16,19 +18,33 @@ type SourceJob struct {
 	Datasets       *DatasetMapFilter
 	SnapshotPrefix string
 	Interval       time.Duration
-	Prune          PrunePolicy
-	Debug          JobDebugSettings
+	Send           zfs.SendFlags
+	// Of the sending side, applies to every stream sent to the client
+	BandwidthLimit util.BandwidthLimit
+	Keepalive      rpc.Keepalive
+	// Of concurrently served connections, 0 means unlimited
+	MaxSessions          int
+	MaxSessionsPerClient int
+	Prune                PrunePolicy
+	Debug                JobDebugSettings
+
+	tasks jobTasks
 }
 
 func parseSourceJob(c JobParsingContext, name string, i map[string]interface{}) (j *SourceJob, err error) {
 
 	var asMap struct {
-		Serve          map[string]interface{}
-		Datasets       map[string]string
-		SnapshotPrefix string `mapstructure:"snapshot_prefix"`
-		Interval       string
-		Prune          map[string]interface{}
-		Debug          map[string]interface{}
+		Serve                map[string]interface{}
+		Datasets             map[string]string
+		SnapshotPrefix       string `mapstructure:"snapshot_prefix"`
+		Interval             string
+		Send                 map[string]interface{}
+		BandwidthLimit       map[string]interface{} `mapstructure:"bandwidth_limit"`
+		Keepalive            map[string]interface{}
+		MaxSessions          int `mapstructure:"max_sessions"`
+		MaxSessionsPerClient int `mapstructure:"max_sessions_per_client"`
+		Prune                map[string]interface{}
+		Debug                map[string]interface{}
 	}
 
 	if err = mapstructure.Decode(i, &asMap); err != nil {
@@ -55,6 +71,27 @@ func parseSourceJob(c JobParsingContext, name string, i map[string]interface{})
 		return
 	}
 
+	if j.Send, err = parseSendFlags(asMap.Send); err != nil {
+		err = errors.Wrap(err, "cannot parse 'send'")
+		return
+	}
+
+	if j.BandwidthLimit, err = parseBandwidthLimit(asMap.BandwidthLimit); err != nil {
+		err = errors.Wrap(err, "cannot parse 'bandwidth_limit'")
+		return
+	}
+
+	if j.Keepalive, err = parseKeepalive(asMap.Keepalive); err != nil {
+		err = errors.Wrap(err, "cannot parse 'keepalive'")
+		return
+	}
+
+	if asMap.MaxSessions < 0 || asMap.MaxSessionsPerClient < 0 {
+		err = errors.New("'max_sessions' and 'max_sessions_per_client' must not be negative")
+		return
+	}
+	j.MaxSessions, j.MaxSessionsPerClient = asMap.MaxSessions, asMap.MaxSessionsPerClient
+
 	if j.Prune, err = parsePrunePolicy(asMap.Prune); err != nil {
 		err = errors.Wrap(err, "cannot parse 'prune'")
 		return
@@ -77,34 +114,51 @@ func (j *SourceJob) JobStart(ctx context.Context) {
 	log := ctx.Value(contextKeyLog).(Logger)
 	defer log.Printf("exiting")
 
-	a := IntervalAutosnap{DatasetFilter: j.Datasets, Prefix: j.SnapshotPrefix, SnapshotInterval: j.Interval}
-	p, err := j.Pruner(PrunePolicySideDefault, false)
+	snapper := &IntervalAutosnap{DatasetFilter: j.Datasets, Prefix: j.SnapshotPrefix, SnapshotInterval: j.Interval}
+	prune := &jobTask{name: "prune", phase: JobPhasePruning, do: j.doPrune, repeat: jobrun.NoRepeatStrategy{}}
+	snap := &jobTask{name: "autosnap", phase: JobPhaseSnapshotting, do: snapper.DoSnapshots, next: prune,
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: j.Interval}}
+
+	serveContext, cancelServe := context.WithCancel(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "serve")))
+	served := make(chan struct{})
+	go func() {
+		j.serve(serveContext)
+		close(served)
+	}()
+	// Also if JobStart panics, the listener must be closed before the job is restarted
+	defer func() {
+		cancelServe()
+		<-served
+	}()
+
+	syncPoint, err := snapper.SyncPoint(context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "autosnap")))
 	if err != nil {
-		log.Printf("error creating pruner: %s", err)
-		return
+		log.Printf("cannot determine sync point, snapshotting now: %s", err)
+		syncPoint = time.Now()
 	}
+	j.tasks.run(ctx, snap, syncPoint)
 
-	snapContext := context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "autosnap"))
-	prunerContext := context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "prune"))
-	serveContext := context.WithValue(ctx, contextKeyLog, util.NewPrefixLogger(log, "serve"))
-	didSnaps := make(chan struct{})
+	log.Printf("context: %s", ctx.Err())
 
-	go j.serve(serveContext)
-	go a.Run(snapContext, didSnaps)
+}
 
-outer:
-	for {
-		select {
-		case <-ctx.Done():
-			break outer
-		case <-didSnaps:
-			log.Printf("starting pruner")
-			p.Run(prunerContext)
-			log.Printf("pruner done")
-		}
-	}
-	log.Printf("context: %s", prunerContext.Err())
+func (j *SourceJob) JobStatus() JobStatus {
+	return j.tasks.status()
+}
 
+func (j *SourceJob) Wakeup(ctx context.Context, mode WakeupMode) ([]TaskRunResult, error) {
+	return j.tasks.wakeup(ctx, mode)
+}
+
+func (j *SourceJob) doPrune(ctx context.Context) (err error) {
+	pruner, err := j.Pruner(PrunePolicySideDefault, false)
+	if err != nil {
+		return errors.Wrap(err, "error creating pruner")
+	}
+	if _, err = pruner.Run(ctx); err != nil {
+		return errors.Wrap(err, "error doing prune")
+	}
+	return nil
 }
 
 func (j *SourceJob) Pruner(side PrunePolicySide, dryRun bool) (p Pruner, err error) {
@@ -128,64 +182,16 @@ func (j *SourceJob) serve(ctx context.Context) {
 		return
 	}
 
-	rwcChan := make(chan io.ReadWriteCloser)
-
-	// Serve connections until interrupted or error
-outer:
-	for {
-
-		go func() {
-			rwc, err := listener.Accept()
-			if err != nil {
-				log.Printf("error accepting connection: %s", err)
-				close(rwcChan)
-				return
-			}
-			rwcChan <- rwc
-		}()
-
-		select {
-
-		case rwc, notClosed := <-rwcChan:
-
-			if !notClosed {
-				break outer // closed because of accept error
-			}
-
-			rwc, err := util.NewReadWriteCloserLogger(rwc, j.Debug.Conn.ReadDump, j.Debug.Conn.WriteDump)
-			if err != nil {
-				panic(err)
-			}
-
-			// construct connection handler
-			handler := NewHandler(log, j.Datasets, &PrefixSnapshotFilter{j.SnapshotPrefix})
-
-			// handle connection
-			rpcServer := rpc.NewServer(rwc)
-			if j.Debug.RPC.Log {
-				rpclog := util.NewPrefixLogger(log, "rpc")
-				rpcServer.SetLogger(rpclog, true)
-			}
-			registerEndpoints(rpcServer, handler)
-			if err = rpcServer.Serve(); err != nil {
-				log.Printf("error serving connection: %s", err)
-			}
-			rwc.Close()
-
-		case <-ctx.Done():
-			log.Printf("context: %s", ctx.Err())
-			break outer
-
-		}
-
-	}
-
-	log.Printf("closing listener")
-	err = listener.Close()
-	if err != nil {
-		log.Printf("error closing listener: %s", err)
-	}
-
-	return
+	limiter := newSessionLimiter(j.MaxSessions, j.MaxSessionsPerClient)
+	serveSessions(ctx, log, listener, limiter, func(ctx context.Context, log Logger, rwc io.ReadWriteCloser, clientIdentity string) {
+		serveRPC(ctx, log, rwc, j.Debug, j.Keepalive, func(server rpc.RPCServer) {
+			registerEndpoints(server, j.handler(ctx, log, clientIdentity))
+		})
+	})
+}
 
+// The holds placed by the handler are tagged with clientIdentity,
+// so that clients do not release each other's holds
+func (j *SourceJob) handler(ctx context.Context, log Logger, clientIdentity string) Handler {
+	return NewHandler(ctx, log, j.Datasets, &PrefixVersionFilter{j.SnapshotPrefix}, clientIdentity, j.Send, j.BandwidthLimit)
 }
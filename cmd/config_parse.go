@@ -7,7 +7,15 @@ import (
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	yaml "github.com/go-yaml/yaml"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+	"math"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var ConfigFileDefaultLocations []string = []string{
@@ -167,6 +175,10 @@ func parseJob(c JobParsingContext, i map[string]interface{}) (j Job, err error)
 		return parseSourceJob(c, name, i)
 	case "local":
 		return parseLocalJob(c, name, i)
+	case "push":
+		return parsePushJob(c, name, i)
+	case "sink":
+		return parseSinkJob(c, name, i)
 	default:
 		return nil, errors.Errorf("unknown job type '%s'", jobtype)
 	}
@@ -186,6 +198,14 @@ func parseConnect(i map[string]interface{}) (c RWCConnecter, err error) {
 	switch t {
 	case "ssh+stdinserver":
 		return parseSSHStdinserverConnecter(i)
+	case "command":
+		return parseCommandConnecter(i)
+	case "tls":
+		return parseTLSConnecter(i)
+	case "tcp":
+		return parseTCPConnecter(i)
+	case "unix":
+		return parseUnixConnecter(i)
 	default:
 		return nil, errors.Errorf("unknown connection type '%s'", t)
 	}
@@ -218,6 +238,221 @@ err:
 	return
 }
 
+func parseConflictResolution(v string, defaultResolution ConflictResolution) (r ConflictResolution, err error) {
+	switch v {
+	case "":
+		return defaultResolution, nil
+	case string(ConflictResolutionManual):
+		return ConflictResolutionManual, nil
+	case string(ConflictResolutionRollback):
+		return ConflictResolutionRollback, nil
+	case string(ConflictResolutionRename):
+		return ConflictResolutionRename, nil
+	default:
+		return "", errors.Errorf("expected one of '%s', '%s' or '%s', got '%s'",
+			ConflictResolutionManual, ConflictResolutionRollback, ConflictResolutionRename, v)
+	}
+}
+
+func parseCompression(v string) (c rpc.Compression, err error) {
+	switch v {
+	case "", "none":
+		return rpc.CompressionNone, nil
+	case "gzip":
+		return rpc.CompressionGzip, nil
+	default:
+		return rpc.CompressionNone, errors.Errorf("expected one of 'none' or 'gzip', got '%s'", v)
+	}
+}
+
+var byteSizeRegexp = regexp.MustCompile(`^\s*(\d+)\s*([KMGT]?)(i?B)?\s*$`)
+
+// Accepts integers and strings like 512, "10M", "10 MiB" or "1G".
+// Suffixes are binary multiples, i.e. 1K = 1024.
+func parseByteSize(v interface{}) (n uint64, err error) {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return 0, errors.Errorf("byte size must not be negative, got %d", v)
+		}
+		return uint64(v), nil
+	case string:
+		m := byteSizeRegexp.FindStringSubmatch(v)
+		if m == nil {
+			return 0, errors.Errorf("byte size must be an integer with optional suffix K, M, G or T, got '%s'", v)
+		}
+		if n, err = strconv.ParseUint(m[1], 10, 64); err != nil {
+			return 0, errors.Wrapf(err, "invalid byte size '%s'", v)
+		}
+		if m[2] != "" {
+			shift := 10 * uint(strings.Index("KMGT", m[2])+1)
+			if n > math.MaxUint64>>shift {
+				return 0, errors.Errorf("byte size '%s' is too large", v)
+			}
+			n <<= shift
+		}
+		return n, nil
+	default:
+		return 0, errors.Errorf("byte size must be an integer or string, got %T", v)
+	}
+}
+
+// Parses "HH:MM" to the offset from midnight
+func parseTimeOfDay(v string) (d time.Duration, err error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, errors.Errorf("time of day must be in format HH:MM, got '%s'", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseBandwidthLimit(v map[string]interface{}) (l util.BandwidthLimit, err error) {
+
+	var asMap struct {
+		Default  interface{}
+		Schedule []struct {
+			From  string
+			To    string
+			Limit interface{}
+		}
+	}
+	if err = mapstructure.Decode(v, &asMap); err != nil {
+		err = errors.Wrap(err, "mapstructure error")
+		return
+	}
+
+	if asMap.Default != nil {
+		if l.Default, err = parseByteSize(asMap.Default); err != nil {
+			err = errors.Wrap(err, "cannot parse 'default'")
+			return
+		}
+	}
+
+	l.Schedule = make([]util.BandwidthScheduleEntry, len(asMap.Schedule))
+	for i, e := range asMap.Schedule {
+		entry := &l.Schedule[i]
+		if entry.From, err = parseTimeOfDay(e.From); err != nil {
+			err = errors.Wrapf(err, "cannot parse 'from' of schedule entry #%d", i)
+			return
+		}
+		if entry.To, err = parseTimeOfDay(e.To); err != nil {
+			err = errors.Wrapf(err, "cannot parse 'to' of schedule entry #%d", i)
+			return
+		}
+		if e.Limit == nil {
+			err = errors.Errorf("schedule entry #%d has no 'limit'", i)
+			return
+		}
+		if entry.Limit, err = parseByteSize(e.Limit); err != nil {
+			err = errors.Wrapf(err, "cannot parse 'limit' of schedule entry #%d", i)
+			return
+		}
+	}
+
+	return
+}
+
+// Missing keys default to rpc.DefaultKeepalive, "0" disables heartbeats or the timeout
+func parseKeepalive(v map[string]interface{}) (k rpc.Keepalive, err error) {
+
+	var asMap struct {
+		HeartbeatInterval string `mapstructure:"heartbeat_interval"`
+		IdleTimeout       string `mapstructure:"idle_timeout"`
+	}
+	if err = mapstructure.Decode(v, &asMap); err != nil {
+		err = errors.Wrap(err, "mapstructure error")
+		return
+	}
+
+	k = rpc.DefaultKeepalive
+	if asMap.HeartbeatInterval != "" {
+		if k.HeartbeatInterval, err = time.ParseDuration(asMap.HeartbeatInterval); err != nil {
+			err = errors.Wrap(err, "cannot parse 'heartbeat_interval'")
+			return
+		}
+	}
+	if asMap.IdleTimeout != "" {
+		if k.IdleTimeout, err = time.ParseDuration(asMap.IdleTimeout); err != nil {
+			err = errors.Wrap(err, "cannot parse 'idle_timeout'")
+			return
+		}
+	}
+	if k.HeartbeatInterval < 0 || k.IdleTimeout < 0 {
+		err = errors.New("durations must not be negative")
+		return
+	}
+	if k.IdleTimeout > 0 && k.IdleTimeout < 2*k.HeartbeatInterval {
+		err = errors.Errorf("idle_timeout (%s) must be at least twice the heartbeat_interval (%s)", k.IdleTimeout, k.HeartbeatInterval)
+		return
+	}
+	return
+}
+
+func parseSendFlags(v map[string]interface{}) (f zfs.SendFlags, err error) {
+
+	var asMap struct {
+		Compressed   bool
+		LargeBlocks  bool `mapstructure:"large_blocks"`
+		EmbeddedData bool `mapstructure:"embedded_data"`
+		Raw          bool
+		Properties   bool
+	}
+	if err = mapstructure.Decode(v, &asMap); err != nil {
+		err = errors.Wrap(err, "mapstructure error")
+		return
+	}
+
+	f = zfs.SendFlags{
+		Compressed:  asMap.Compressed,
+		LargeBlocks: asMap.LargeBlocks,
+		Embedded:    asMap.EmbeddedData,
+		Raw:         asMap.Raw,
+		Properties:  asMap.Properties,
+	}
+	return
+}
+
+func parseRecvProperties(v map[string]interface{}) (p zfs.RecvProperties, err error) {
+
+	var asMap struct {
+		Override map[string]interface{}
+		Exclude  []string
+	}
+	if err = mapstructure.Decode(v, &asMap); err != nil {
+		err = errors.Wrap(err, "mapstructure error")
+		return
+	}
+
+	p.Override = make(map[string]string, len(asMap.Override))
+	for prop, val := range asMap.Override {
+		switch val := val.(type) {
+		case string:
+			p.Override[prop] = val
+		case bool: // YAML parses unquoted on / off as booleans
+			if val {
+				p.Override[prop] = "on"
+			} else {
+				p.Override[prop] = "off"
+			}
+		case int, float64:
+			p.Override[prop] = fmt.Sprintf("%v", val)
+		default:
+			err = errors.Errorf("value of property '%s' must be a string, got %#v", prop, val)
+			return
+		}
+	}
+	p.Exclude = asMap.Exclude
+
+	for _, prop := range p.Exclude {
+		if _, ok := p.Override[prop]; ok {
+			err = errors.Errorf("property '%s' must not be both overridden and excluded", prop)
+			return
+		}
+	}
+
+	return
+}
+
 func parsePrunePolicy(v map[string]interface{}) (p PrunePolicy, err error) {
 
 	policyName, err := extractStringField(v, "policy", true)
@@ -250,6 +485,12 @@ func parseAuthenticatedChannelListenerFactory(c JobParsingContext, v map[string]
 	switch t {
 	case "stdinserver":
 		return parseStdinserverListenerFactory(c, v)
+	case "tls":
+		return parseTLSListenerFactory(c, v)
+	case "tcp":
+		return parseTCPListenerFactory(c, v)
+	case "unix":
+		return parseUnixListenerFactory(c, v)
 	default:
 		err = errors.Errorf("unknown type '%s'", t)
 		return
@@ -51,13 +51,15 @@ func (f *StdinserverListenerFactory) Listen() (al AuthenticatedChannelListener,
 		return nil, errors.Wrapf(err, "cannot listen on unix socket %s", f.sockaddr)
 	}
 
-	l := &StdinserverListener{ul}
+	l := &StdinserverListener{ul, f.ClientIdentity}
 
 	return l, nil
 }
 
 type StdinserverListener struct {
 	l *net.UnixListener
+	// Only clients with this identity can connect to the socket
+	clientIdentity string
 }
 
 type fdRWC struct {
@@ -79,7 +81,7 @@ func (f fdRWC) Close() (err error) {
 	return f.control.Close()
 }
 
-func (l *StdinserverListener) Accept() (ch io.ReadWriteCloser, err error) {
+func (l *StdinserverListener) Accept() (ch io.ReadWriteCloser, clientIdentity string, err error) {
 	c, err := l.l.Accept()
 	if err != nil {
 		err = errors.Wrap(err, "error accepting on unix listener")
@@ -91,11 +93,12 @@ func (l *StdinserverListener) Accept() (ch io.ReadWriteCloser, err error) {
 	if err != nil {
 		err = errors.Wrap(err, "error receiving fds from stdinserver command")
 		c.Close()
+		return
 	}
 
 	rwc := fdRWC{files[0], files[1], c.(*net.UnixConn)}
 
-	return rwc, nil
+	return rwc, l.clientIdentity, nil
 
 }
 
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// Maps the address of a client to its identity, no authentication is performed.
+// Only use on trusted networks.
+type TCPListenerFactory struct {
+	Address string
+	Clients *clientAddressMap
+}
+
+func parseTCPListenerFactory(c JobParsingContext, i map[string]interface{}) (f *TCPListenerFactory, err error) {
+
+	var asMap struct {
+		Listen  string
+		Clients map[string]string
+	}
+	if err = mapstructure.Decode(i, &asMap); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+
+	f = &TCPListenerFactory{Address: asMap.Listen}
+	if f.Address == "" {
+		return nil, errors.New("must specify 'listen'")
+	}
+	if f.Clients, err = parseClientAddressMap(asMap.Clients); err != nil {
+		return nil, errors.Wrap(err, "cannot parse 'clients'")
+	}
+	return f, nil
+}
+
+func (f *TCPListenerFactory) Listen() (al AuthenticatedChannelListener, err error) {
+	l, err := net.Listen("tcp", f.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen on %s", f.Address)
+	}
+	return &TCPListener{l, f.Clients}, nil
+}
+
+type TCPListener struct {
+	l       net.Listener
+	clients *clientAddressMap
+}
+
+// A client whose address is not in the allow-list, the listener is still usable
+type ClientAddressNotAllowedError struct {
+	RemoteAddr net.Addr
+}
+
+func (e *ClientAddressNotAllowedError) Error() string {
+	return fmt.Sprintf("client address %s is not in the 'clients' allow-list", e.RemoteAddr)
+}
+
+func (e *ClientAddressNotAllowedError) Temporary() bool { return true }
+
+func (l *TCPListener) Accept() (ch io.ReadWriteCloser, clientIdentity string, err error) {
+	c, err := l.l.Accept()
+	if err != nil {
+		err = errors.Wrap(err, "error accepting on tcp listener")
+		return
+	}
+	clientIdentity, ok := l.clients.lookup(c.RemoteAddr().(*net.TCPAddr).IP)
+	if !ok {
+		c.Close()
+		return nil, "", &ClientAddressNotAllowedError{c.RemoteAddr()}
+	}
+	return c, clientIdentity, nil
+}
+
+func (l *TCPListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+func (l *TCPListener) Close() (err error) {
+	return l.l.Close()
+}
+
+type clientAddressMapEntry struct {
+	network        *net.IPNet
+	clientIdentity string
+}
+
+// Client identities by IP address or CIDR network, the most specific network wins
+type clientAddressMap struct {
+	entries []clientAddressMapEntry
+}
+
+func parseClientAddressMap(m map[string]string) (c *clientAddressMap, err error) {
+
+	if len(m) == 0 {
+		return nil, errors.New("must specify at least one client")
+	}
+
+	c = &clientAddressMap{make([]clientAddressMapEntry, 0, len(m))}
+	for addr, clientIdentity := range m {
+		if clientIdentity == "" {
+			return nil, errors.Errorf("client identity of '%s' must not be empty", addr)
+		}
+		var network *net.IPNet
+		if strings.Contains(addr, "/") {
+			if _, network, err = net.ParseCIDR(addr); err != nil {
+				return nil, errors.Wrapf(err, "cannot parse '%s'", addr)
+			}
+		} else {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.Errorf("'%s' is neither an IP address nor a CIDR network", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		c.entries = append(c.entries, clientAddressMapEntry{network, clientIdentity})
+	}
+
+	sort.Slice(c.entries, func(i, j int) bool {
+		oi, _ := c.entries[i].network.Mask.Size()
+		oj, _ := c.entries[j].network.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return c.entries[i].network.String() < c.entries[j].network.String()
+	})
+
+	return c, nil
+}
+
+func (c *clientAddressMap) lookup(ip net.IP) (clientIdentity string, ok bool) {
+	for _, e := range c.entries {
+		if e.network.Contains(ip) {
+			return e.clientIdentity, true
+		}
+	}
+	return "", false
+}
+
+// Like StdinserverListenerFactory, all connections are from ClientIdentity.
+// Access is restricted by the permissions of the socket's directory.
+type UnixListenerFactory struct {
+	ClientIdentity string `mapstructure:"client_identity"`
+	Path           string
+	sockaddr       *net.UnixAddr
+}
+
+func parseUnixListenerFactory(c JobParsingContext, i map[string]interface{}) (f *UnixListenerFactory, err error) {
+
+	f = &UnixListenerFactory{}
+	if err = mapstructure.Decode(i, f); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+	if f.ClientIdentity == "" {
+		return nil, errors.New("must specify 'client_identity'")
+	}
+	if f.Path == "" {
+		return nil, errors.New("must specify 'path'")
+	}
+	if f.sockaddr, err = net.ResolveUnixAddr("unix", f.Path); err != nil {
+		return nil, errors.Wrap(err, "cannot resolve unix address")
+	}
+	return f, nil
+}
+
+func (f *UnixListenerFactory) Listen() (al AuthenticatedChannelListener, err error) {
+	ul, err := ListenUnixPrivate(f.sockaddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen on unix socket %s", f.sockaddr)
+	}
+	return &UnixListener{ul, f.ClientIdentity}, nil
+}
+
+type UnixListener struct {
+	l              *net.UnixListener
+	clientIdentity string
+}
+
+func (l *UnixListener) Accept() (ch io.ReadWriteCloser, clientIdentity string, err error) {
+	c, err := l.l.Accept()
+	if err != nil {
+		err = errors.Wrap(err, "error accepting on unix listener")
+		return
+	}
+	return c, l.clientIdentity, nil
+}
+
+func (l *UnixListener) Close() (err error) {
+	return l.l.Close() // removes socket file automatically
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// PEM files of the CA that signed the peer's certificate and of our own certificate and key.
+// The files are read when connecting or listening, not when parsing the config.
+type tlsKeyPair struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+func (p tlsKeyPair) validate() error {
+	if p.CA == "" || p.Cert == "" || p.Key == "" {
+		return errors.New("must specify 'ca', 'cert' and 'key'")
+	}
+	return nil
+}
+
+func (p tlsKeyPair) load() (ca *x509.CertPool, cert tls.Certificate, err error) {
+	pem, err := ioutil.ReadFile(p.CA)
+	if err != nil {
+		return nil, cert, errors.Wrap(err, "cannot read ca")
+	}
+	ca = x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return nil, cert, errors.Errorf("no PEM encoded certificates in ca file %s", p.CA)
+	}
+	if cert, err = tls.LoadX509KeyPair(p.Cert, p.Key); err != nil {
+		return nil, cert, errors.Wrap(err, "cannot load cert and key")
+	}
+	return ca, cert, nil
+}
+
+// Verifies the peer's certificate chain against ca and, if cn is not empty, the CN of the peer's certificate
+func verifyPeerCN(cs tls.ConnectionState, ca *x509.CertPool, usage x509.ExtKeyUsage, cn string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         ca,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	peer := cs.PeerCertificates[0]
+	if _, err := peer.Verify(opts); err != nil {
+		return err
+	}
+	if cn != "" && peer.Subject.CommonName != cn {
+		return errors.Errorf("peer certificate CN is '%s', expected '%s'", peer.Subject.CommonName, cn)
+	}
+	return nil
+}
+
+type TLSListenerFactory struct {
+	Address string
+	tlsKeyPair
+	HandshakeTimeout time.Duration
+}
+
+func parseTLSListenerFactory(c JobParsingContext, i map[string]interface{}) (f *TLSListenerFactory, err error) {
+
+	var asMap struct {
+		Listen           string
+		CA               string
+		Cert             string
+		Key              string
+		HandshakeTimeout string `mapstructure:"handshake_timeout"`
+	}
+	if err = mapstructure.Decode(i, &asMap); err != nil {
+		return nil, errors.Wrap(err, "mapstructure error")
+	}
+
+	f = &TLSListenerFactory{
+		Address:          asMap.Listen,
+		tlsKeyPair:       tlsKeyPair{asMap.CA, asMap.Cert, asMap.Key},
+		HandshakeTimeout: DEFAULT_TLS_HANDSHAKE_TIMEOUT,
+	}
+	if f.Address == "" {
+		return nil, errors.New("must specify 'listen'")
+	}
+	if err = f.tlsKeyPair.validate(); err != nil {
+		return nil, err
+	}
+	if asMap.HandshakeTimeout != "" {
+		if f.HandshakeTimeout, err = time.ParseDuration(asMap.HandshakeTimeout); err != nil {
+			return nil, errors.Wrap(err, "cannot parse 'handshake_timeout'")
+		}
+	}
+	return f, nil
+}
+
+func (f *TLSListenerFactory) Listen() (al AuthenticatedChannelListener, err error) {
+
+	ca, cert, err := f.tlsKeyPair.load()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	l, err := net.Listen("tcp", f.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen on %s", f.Address)
+	}
+
+	return &TLSListener{l, config, f.HandshakeTimeout}, nil
+}
+
+// Authenticates clients by their certificate, the CN of the certificate is the client identity.
+type TLSListener struct {
+	l                net.Listener
+	config           *tls.Config
+	handshakeTimeout time.Duration
+}
+
+// A client that failed to authenticate, the listener is still usable
+type TLSHandshakeError struct {
+	RemoteAddr net.Addr
+	Err        error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "tls handshake with " + e.RemoteAddr.String() + " failed: " + e.Err.Error()
+}
+
+func (e *TLSHandshakeError) Temporary() bool { return true }
+
+func (l *TLSListener) Accept() (ch io.ReadWriteCloser, clientIdentity string, err error) {
+
+	c, err := l.l.Accept()
+	if err != nil {
+		err = errors.Wrap(err, "error accepting on tcp listener")
+		return
+	}
+
+	conn := tls.Server(c, l.config)
+	handshakeErr := func(err error) (io.ReadWriteCloser, string, error) {
+		conn.Close()
+		return nil, "", &TLSHandshakeError{c.RemoteAddr(), err}
+	}
+
+	// The handshake blocks accepting further clients
+	if l.handshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(l.handshakeTimeout))
+	}
+	if err = conn.Handshake(); err != nil {
+		return handshakeErr(err)
+	}
+	if err = c.SetDeadline(time.Time{}); err != nil {
+		return handshakeErr(err)
+	}
+
+	// RequireAndVerifyClientCert guarantees a verified certificate
+	clientIdentity = conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	if clientIdentity == "" {
+		return handshakeErr(errors.New("client certificate has no CN"))
+	}
+
+	return conn, clientIdentity, nil
+}
+
+func (l *TLSListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+func (l *TLSListener) Close() (err error) {
+	return l.l.Close()
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/rpc"
 	"github.com/zrepl/zrepl/util"
 	"github.com/zrepl/zrepl/zfs"
 )
@@ -16,7 +17,12 @@ func TestSampleConfigsAreParsedWithoutErrors(t *testing.T) {
 		"./sampleconf/localbackup/host1.yml",
 		"./sampleconf/pullbackup/backuphost.yml",
 		"./sampleconf/pullbackup/productionhost.yml",
+		"./sampleconf/pushbackup/backuphost.yml",
+		"./sampleconf/pushbackup/productionhost.yml",
+		"./sampleconf/random/command.yml",
 		"./sampleconf/random/debugging.yml",
+		"./sampleconf/random/tcp.yml",
+		"./sampleconf/random/tls.yml",
 	}
 
 	for _, p := range paths {
@@ -29,6 +35,44 @@ func TestSampleConfigsAreParsedWithoutErrors(t *testing.T) {
 
 }
 
+func TestParseSendFlags(t *testing.T) {
+
+	f, err := parseSendFlags(map[string]interface{}{
+		"compressed":    true,
+		"embedded_data": true,
+		"raw":           true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, zfs.SendFlags{Compressed: true, Embedded: true, Raw: true}, f)
+
+	f, err = parseSendFlags(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, zfs.SendFlags{}, f)
+
+}
+
+func TestParseRecvProperties(t *testing.T) {
+
+	p, err := parseRecvProperties(map[string]interface{}{
+		"override": map[string]interface{}{
+			"mountpoint": "none",
+			"readonly":   true,
+			"canmount":   false,
+		},
+		"exclude": []string{"sharenfs"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"mountpoint": "none", "readonly": "on", "canmount": "off"}, p.Override)
+	assert.Equal(t, []string{"sharenfs"}, p.Exclude)
+
+	_, err = parseRecvProperties(map[string]interface{}{
+		"override": map[string]interface{}{"sharenfs": "on"},
+		"exclude":  []string{"sharenfs"},
+	})
+	assert.Error(t, err)
+
+}
+
 func TestParseRetentionGridStringParsing(t *testing.T) {
 
 	intervals, err := parseRetentionGridIntervalsString("2x10m(keep=2) | 1x1h | 3x1w")
@@ -215,3 +259,80 @@ func TestDatasetMapFilter_InvertedFilter(t *testing.T) {
 	expectMapping(inv, "1/2/a/b", true)
 
 }
+
+func TestParseCompression(t *testing.T) {
+	c, err := parseCompression("")
+	assert.NoError(t, err)
+	assert.Equal(t, rpc.CompressionNone, c)
+	c, err = parseCompression("gzip")
+	assert.NoError(t, err)
+	assert.Equal(t, rpc.CompressionGzip, c)
+	_, err = parseCompression("zstd")
+	assert.Error(t, err)
+}
+
+func TestParseBandwidthLimit(t *testing.T) {
+	l, err := parseBandwidthLimit(map[string]interface{}{
+		"default": "10M",
+		"schedule": []interface{}{
+			map[string]interface{}{"from": "08:00", "to": "18:30", "limit": 1024},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, util.BandwidthLimit{
+		Default:  10 * 1024 * 1024,
+		Schedule: []util.BandwidthScheduleEntry{{From: 8 * time.Hour, To: 18*time.Hour + 30*time.Minute, Limit: 1024}},
+	}, l)
+
+	l, err = parseBandwidthLimit(nil)
+	assert.NoError(t, err)
+	assert.True(t, l.Unlimited())
+
+	_, err = parseBandwidthLimit(map[string]interface{}{"default": "10X"})
+	assert.Error(t, err)
+	_, err = parseBandwidthLimit(map[string]interface{}{
+		"schedule": []interface{}{map[string]interface{}{"from": "8am", "to": "18:00", "limit": 1}},
+	})
+	assert.Error(t, err)
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, expected := range map[interface{}]uint64{
+		512: 512, "512": 512, "1K": 1024, "10 MiB": 10 << 20, "2G": 2 << 30,
+	} {
+		n, err := parseByteSize(in)
+		assert.NoError(t, err, "%v", in)
+		assert.Equal(t, expected, n, "%v", in)
+	}
+	_, err := parseByteSize(-1)
+	assert.Error(t, err)
+
+	for in, expected := range map[string]uint64{
+		"16777215T":            16777215 << 40,
+		"16777216T":            0, // 2^64
+		"18014398509481983K":   18014398509481983 << 10,
+		"18014398509481984K":   0,
+		"99999999999999999999": 0, // does not fit uint64 without a suffix
+	} {
+		n, err := parseByteSize(in)
+		if expected == 0 {
+			assert.Error(t, err, "%v", in)
+			continue
+		}
+		assert.NoError(t, err, "%v", in)
+		assert.Equal(t, expected, n, "%v", in)
+	}
+}
+
+func TestParseKeepalive(t *testing.T) {
+	k, err := parseKeepalive(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rpc.DefaultKeepalive, k)
+
+	k, err = parseKeepalive(map[string]interface{}{"heartbeat_interval": "0", "idle_timeout": "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, rpc.Keepalive{}, k)
+
+	_, err = parseKeepalive(map[string]interface{}{"heartbeat_interval": "1m", "idle_timeout": "1m"})
+	assert.Error(t, err)
+}
@@ -1,15 +1,21 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/zrepl/zrepl/util"
 	"io"
+	"io/ioutil"
 	golog "log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"time"
 )
 
 var controlCmd = &cobra.Command{
@@ -26,10 +32,45 @@ var pprofCmdArgs struct {
 	seconds int64
 }
 
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the status of the daemon's jobs",
+	Run:   doControlStatus,
+}
+var statusCmdArgs struct {
+	raw bool
+}
+
+var wakeupCmd = &cobra.Command{
+	Use:   "wakeup JOB",
+	Short: "run the replication cycle of JOB now and wait until it finished",
+	Run:   doControlWakeup,
+}
+var wakeupCmdArgs struct {
+	snapshot  bool
+	pruneOnly bool
+}
+
 func init() {
 	RootCmd.AddCommand(controlCmd)
 	controlCmd.AddCommand(pprofCmd)
 	pprofCmd.Flags().Int64Var(&pprofCmdArgs.seconds, "seconds", 30, "seconds to profile")
+	controlCmd.AddCommand(statusCmd)
+	statusCmd.Flags().BoolVar(&statusCmdArgs.raw, "raw", false, "print the JSON returned by the daemon")
+	controlCmd.AddCommand(wakeupCmd)
+	wakeupCmd.Flags().BoolVar(&wakeupCmdArgs.snapshot, "snapshot", false, "take snapshots first")
+	wakeupCmd.Flags().BoolVar(&wakeupCmdArgs.pruneOnly, "prune-only", false, "only prune")
+}
+
+// An HTTP client for the endpoints of the control job, the host part of URLs is ignored
+func controlHTTPClient(sockpath string) http.Client {
+	return http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", sockpath)
+			},
+		},
+	}
 }
 
 func doControlPProf(cmd *cobra.Command, args []string) {
@@ -71,13 +112,7 @@ func doControlPProf(cmd *cobra.Command, args []string) {
 	}
 
 	log.Printf("connecting to daemon")
-	httpc := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial("unix", conf.Global.Control.Sockpath)
-			},
-		},
-	}
+	httpc := controlHTTPClient(conf.Global.Control.Sockpath)
 
 	log.Printf("profiling...")
 	v := url.Values{}
@@ -98,3 +133,182 @@ func doControlPProf(cmd *cobra.Command, args []string) {
 	log.Printf("finished")
 
 }
+
+func doControlStatus(cmd *cobra.Command, args []string) {
+
+	log := golog.New(os.Stderr, "", 0)
+
+	die := func() {
+		log.Printf("exiting after error")
+		os.Exit(1)
+	}
+
+	conf, err := ParseConfig(rootArgs.configFile)
+	if err != nil {
+		log.Printf("error parsing config: %s", err)
+		die()
+	}
+
+	httpc := controlHTTPClient(conf.Global.Control.Sockpath)
+	resp, err := httpc.Get("http://unix" + ControlJobEndpointStatus)
+	if err != nil {
+		log.Printf("error: %s", err)
+		die()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("error: daemon responded with %s: %s", resp.Status, msg)
+		die()
+	}
+
+	if statusCmdArgs.raw {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			log.Printf("error: %s", err)
+			die()
+		}
+		return
+	}
+
+	var status map[string]JobStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		log.Printf("error decoding status: %s", err)
+		die()
+	}
+	printStatus(os.Stdout, status, time.Now())
+}
+
+func printStatus(w io.Writer, status map[string]JobStatus, now time.Time) {
+
+	const timeFmt = "2006-01-02 15:04:05"
+
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := status[name]
+		fmt.Fprintf(w, "job %s: %s\n", name, s.Phase)
+		if s.Supervisor.Restarts > 0 || s.Supervisor.TaskPanics > 0 {
+			fmt.Fprintf(w, "  restarted %d times", s.Supervisor.Restarts)
+			if s.Supervisor.TaskPanics > 0 {
+				fmt.Fprintf(w, ", %d task panics", s.Supervisor.TaskPanics)
+			}
+			if f := s.Supervisor.LastFailure; f != nil {
+				fmt.Fprintf(w, ", last failure at %s: ", f.Time.Format(timeFmt))
+				if f.Task != "" {
+					fmt.Fprintf(w, "task %s: ", f.Task)
+				}
+				fmt.Fprintf(w, "%s", f.Reason)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		for _, t := range s.Tasks {
+			fmt.Fprintf(w, "  task %s:", t.Name)
+			if t.Running {
+				fmt.Fprintf(w, " running for %s", now.Sub(t.Start).Round(time.Second))
+			}
+			if r := t.LastRun; r != nil {
+				fmt.Fprintf(w, " last run at %s took %s", r.Start.Format(timeFmt), r.Finish.Sub(r.Start).Round(time.Second))
+				if r.Error != "" {
+					fmt.Fprintf(w, " and failed: %s", r.Error)
+				}
+			}
+			if !t.NextRun.IsZero() {
+				fmt.Fprintf(w, " next run at %s", t.NextRun.Format(timeFmt))
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		if len(s.Replication) > 0 {
+			fmt.Fprintf(w, "  filesystems:\n")
+		}
+		for _, fs := range s.Replication {
+			fmt.Fprintf(w, "    %s: %s", fs.Filesystem, fs.State)
+			if fs.Steps > 0 {
+				fmt.Fprintf(w, " step %d/%d", fs.Step, fs.Steps)
+			}
+			if fs.BytesTransferred > 0 {
+				fmt.Fprintf(w, ", %s transferred", util.FormatBytes(fs.BytesTransferred))
+			}
+			if fs.Error != "" {
+				fmt.Fprintf(w, ": %s", fs.Error)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+func doControlWakeup(cmd *cobra.Command, args []string) {
+
+	log := golog.New(os.Stderr, "", 0)
+
+	die := func() {
+		log.Printf("exiting after error")
+		os.Exit(1)
+	}
+
+	if len(args) != 1 {
+		log.Printf("must specify exactly one job")
+		log.Printf("%s", cmd.UsageString())
+		die()
+	}
+	mode := WakeupModeReplicate
+	switch {
+	case wakeupCmdArgs.snapshot && wakeupCmdArgs.pruneOnly:
+		log.Printf("--snapshot and --prune-only are mutually exclusive")
+		die()
+	case wakeupCmdArgs.snapshot:
+		mode = WakeupModeSnapshot
+	case wakeupCmdArgs.pruneOnly:
+		mode = WakeupModePruneOnly
+	}
+
+	conf, err := ParseConfig(rootArgs.configFile)
+	if err != nil {
+		log.Printf("error parsing config: %s", err)
+		die()
+	}
+
+	httpc := controlHTTPClient(conf.Global.Control.Sockpath)
+	v := url.Values{}
+	v.Set("job", args[0])
+	v.Set("mode", string(mode))
+	log.Printf("waking up job %s, waiting for it to finish", args[0])
+	resp, err := httpc.Post("http://unix"+ControlJobEndpointWakeup+"?"+v.Encode(), "", nil)
+	if err != nil {
+		log.Printf("error: %s", err)
+		die()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("error: daemon responded with %s: %s", resp.Status, bytes.TrimSpace(msg))
+		die()
+	}
+
+	var results []TaskRunResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		log.Printf("error decoding results: %s", err)
+		die()
+	}
+	if !printWakeupResults(os.Stdout, results) {
+		die()
+	}
+}
+
+// Returns false if a task failed
+func printWakeupResults(w io.Writer, results []TaskRunResult) (ok bool) {
+	ok = true
+	for _, r := range results {
+		took := r.Finish.Sub(r.Start).Round(time.Millisecond)
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s failed after %s: %s\n", r.Name, took, r.Error)
+			ok = false
+		} else {
+			fmt.Fprintf(w, "%s finished after %s\n", r.Name, took)
+		}
+	}
+	return ok
+}
@@ -57,14 +57,20 @@ type contextKey string
 
 const (
 	contextKeyLog contextKey = contextKey("log")
+	// The *Daemon running the job
+	contextKeyDaemon contextKey = contextKey("daemon")
+	// The *jobSupervisor running the job
+	contextKeySupervisor contextKey = contextKey("supervisor")
 )
 
 type Daemon struct {
 	conf *Config
+	// By job name, populated by Loop
+	supervisors map[string]*jobSupervisor
 }
 
 func NewDaemon(initialConf *Config) *Daemon {
-	return &Daemon{initialConf}
+	return &Daemon{conf: initialConf, supervisors: make(map[string]*jobSupervisor)}
 }
 
 func (d *Daemon) Loop(ctx context.Context) {
@@ -79,17 +85,20 @@ func (d *Daemon) Loop(ctx context.Context) {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	log.Printf("starting jobs from config")
-	i := 0
+	for _, job := range d.conf.Jobs {
+		d.supervisors[job.JobName()] = newJobSupervisor(job)
+	}
+	// jobs are restarted by their supervisor until the daemon shuts down
 	for _, job := range d.conf.Jobs {
 		log.Printf("starting job %s", job.JobName())
 
 		logger := jobLogger{log, job.JobName()}
-		i++
 		jobCtx := context.WithValue(ctx, contextKeyLog, logger)
-		go func(j Job) {
-			j.JobStart(jobCtx)
+		jobCtx = context.WithValue(jobCtx, contextKeyDaemon, d)
+		go func(j Job, s *jobSupervisor) {
+			s.run(jobCtx)
 			finishs <- j
-		}(job)
+		}(job, d.supervisors[job.JobName()])
 	}
 
 	finishCount := 0
@@ -97,7 +106,7 @@ outer:
 	for {
 		select {
 		case j := <-finishs:
-			log.Printf("job finished: %s", j.JobName())
+			log.Printf("job finished: %s (restarts: %d)", j.JobName(), d.supervisors[j.JobName()].Status().Restarts)
 			finishCount++
 			if finishCount == len(d.conf.Jobs) {
 				log.Printf("all jobs finished")
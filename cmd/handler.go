@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
 	"github.com/zrepl/zrepl/zfs"
 )
 
@@ -24,22 +27,61 @@ type FilesystemVersionsRequest struct {
 type InitialTransferRequest struct {
 	Filesystem        *zfs.DatasetPath
 	FilesystemVersion zfs.FilesystemVersion
+	// The sender may set additional flags, see Handler.effectiveSendFlags
+	SendFlags zfs.SendFlags
 }
 
 type IncrementalTransferRequest struct {
 	Filesystem *zfs.DatasetPath
 	From       zfs.FilesystemVersion
 	To         zfs.FilesystemVersion
+	// The sender may set additional flags, see Handler.effectiveSendFlags
+	SendFlags zfs.SendFlags
+}
+
+// Asks for the estimated size in bytes of the stream of the corresponding
+// InitialTransferRequest (From == nil) or IncrementalTransferRequest
+type SendSizeEstimateRequest struct {
+	Filesystem *zfs.DatasetPath
+	From       *zfs.FilesystemVersion
+	To         zfs.FilesystemVersion
+	SendFlags  zfs.SendFlags
+}
+
+type ResumeTransferRequest struct {
+	Filesystem *zfs.DatasetPath
+	// The receive_resume_token of the receiving side's filesystem
+	Token string
+}
+
+type BookmarkRequest struct {
+	Filesystem *zfs.DatasetPath
+	// The snapshot to bookmark. The bookmark is named after the snapshot.
+	Snapshot zfs.FilesystemVersion
+}
+
+type LastReplicatedRequest struct {
+	Filesystem *zfs.DatasetPath
+	// The snapshot the client received most recently
+	Snapshot zfs.FilesystemVersion
 }
 
 type Handler struct {
+	// Cancels the zfs operations of the handler, e.g. when the job serving the client exits
+	ctx    context.Context
 	logger Logger
 	dsf    zfs.DatasetFilter
 	fsvf   zfs.FilesystemVersionFilter
+	// Identifies the client in the tags of the holds placed by this handler
+	clientIdentity string
+	// Flags set on every zfs send, regardless of the client's request
+	sendFlags zfs.SendFlags
+	// Limits the rate at which send streams are read
+	bandwidthLimit util.BandwidthLimit
 }
 
-func NewHandler(logger Logger, dsfilter zfs.DatasetFilter, snapfilter zfs.FilesystemVersionFilter) (h Handler) {
-	return Handler{logger, dsfilter, snapfilter}
+func NewHandler(ctx context.Context, logger Logger, dsfilter zfs.DatasetFilter, snapfilter zfs.FilesystemVersionFilter, clientIdentity string, sendFlags zfs.SendFlags, bandwidthLimit util.BandwidthLimit) (h Handler) {
+	return Handler{ctx, logger, dsfilter, snapfilter, clientIdentity, sendFlags, bandwidthLimit}
 }
 
 func registerEndpoints(server rpc.RPCServer, handler Handler) (err error) {
@@ -59,6 +101,22 @@ func registerEndpoints(server rpc.RPCServer, handler Handler) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	err = server.RegisterEndpoint("ResumeTransferRequest", handler.HandleResumeTransferRequest)
+	if err != nil {
+		panic(err)
+	}
+	err = server.RegisterEndpoint("SendSizeEstimateRequest", handler.HandleSendSizeEstimateRequest)
+	if err != nil {
+		panic(err)
+	}
+	err = server.RegisterEndpoint("BookmarkRequest", handler.HandleBookmarkRequest)
+	if err != nil {
+		panic(err)
+	}
+	err = server.RegisterEndpoint("LastReplicatedRequest", handler.HandleLastReplicatedRequest)
+	if err != nil {
+		panic(err)
+	}
 	return nil
 }
 
@@ -68,7 +126,7 @@ func (h Handler) HandleFilesystemRequest(r *FilesystemRequest, roots *[]*zfs.Dat
 
 	h.logger.Printf("using dsf: %#v", h.dsf)
 
-	allowed, err := zfs.ZFSListMapping(h.dsf)
+	allowed, err := zfs.ZFSListMapping(h.ctx, h.dsf)
 	if err != nil {
 		h.logger.Printf("handle fsr err: %v\n", err)
 		return
@@ -89,7 +147,7 @@ func (h Handler) HandleFilesystemVersionsRequest(r *FilesystemVersionsRequest, v
 	}
 
 	// find our versions
-	vs, err := zfs.ZFSListFilesystemVersions(r.Filesystem, h.fsvf)
+	vs, err := zfs.ZFSListFilesystemVersions(h.ctx, r.Filesystem, h.fsvf)
 	if err != nil {
 		h.logger.Printf("our versions error: %#v\n", err)
 		return
@@ -109,13 +167,25 @@ func (h Handler) HandleInitialTransferRequest(r *InitialTransferRequest, stream
 		return
 	}
 
-	h.logger.Printf("invoking zfs send")
+	flags, err := h.effectiveSendFlags(r.Filesystem, r.SendFlags)
+	if err != nil {
+		return
+	}
 
-	s, err := zfs.ZFSSend(r.Filesystem, &r.FilesystemVersion, nil)
+	release, err := h.holdForTransfer(r.Filesystem, r.FilesystemVersion)
+	if err != nil {
+		return
+	}
+
+	h.logger.Printf("invoking zfs send with %#v", flags)
+
+	s, err := zfs.ZFSSend(h.ctx, r.Filesystem, &r.FilesystemVersion, nil, flags)
 	if err != nil {
 		h.logger.Printf("error sending filesystem: %#v", err)
+		release()
+		return
 	}
-	*stream = s
+	*stream = &holdReleasingReader{Reader: util.NewRateLimitedReader(h.ctx, s, h.bandwidthLimit), release: release}
 
 	return
 
@@ -131,16 +201,330 @@ func (h Handler) HandleIncrementalTransferRequest(r *IncrementalTransferRequest,
 		return
 	}
 
-	h.logger.Printf("invoking zfs send")
+	flags, err := h.effectiveSendFlags(r.Filesystem, r.SendFlags)
+	if err != nil {
+		return
+	}
+
+	release, err := h.holdForTransfer(r.Filesystem, r.From, r.To)
+	if err != nil {
+		return
+	}
 
-	s, err := zfs.ZFSSend(r.Filesystem, &r.From, &r.To)
+	h.logger.Printf("invoking zfs send with %#v", flags)
+
+	s, err := zfs.ZFSSend(h.ctx, r.Filesystem, &r.From, &r.To, flags)
 	if err != nil {
 		h.logger.Printf("error sending filesystem: %#v", err)
+		release()
+		return
+	}
+
+	*stream = &holdReleasingReader{Reader: util.NewRateLimitedReader(h.ctx, s, h.bandwidthLimit), release: release}
+	return
+
+}
+
+func (h Handler) HandleSendSizeEstimateRequest(r *SendSizeEstimateRequest, size *uint64) (err error) {
+
+	h.logger.Printf("handling send size estimate request: %#v", r)
+	if r.From != nil {
+		if err = h.pullACLCheck(r.Filesystem, r.From); err != nil {
+			return
+		}
+	}
+	if err = h.pullACLCheck(r.Filesystem, &r.To); err != nil {
+		return
+	}
+
+	flags, err := h.effectiveSendFlags(r.Filesystem, r.SendFlags)
+	if err != nil {
+		return
 	}
 
-	*stream = s
+	h.logger.Printf("invoking zfs send dry run")
+
+	if r.From == nil {
+		*size, err = zfs.ZFSSendDry(h.ctx, r.Filesystem, &r.To, nil, flags)
+	} else {
+		*size, err = zfs.ZFSSendDry(h.ctx, r.Filesystem, r.From, &r.To, flags)
+	}
+	if err != nil {
+		h.logger.Printf("error estimating send size: %#v", err)
+	}
 	return
+}
 
+func (h Handler) HandleResumeTransferRequest(r *ResumeTransferRequest, stream *io.Reader) (err error) {
+
+	h.logger.Printf("handling resume transfer request: %#v", r)
+	if err = h.pullACLCheck(r.Filesystem, nil); err != nil {
+		return
+	}
+
+	// The token is opaque to the client, make sure it does not
+	// resume a stream of a filesystem or snapshot it has no access to
+	token, err := zfs.ZFSParseResumeToken(h.ctx, r.Token)
+	if err != nil {
+		err = errors.Wrap(err, "cannot decode resume token")
+		h.logger.Printf("%s", err)
+		return
+	}
+	fs, snapName, err := token.ToVersion()
+	if err != nil {
+		h.logger.Printf("%s", err)
+		return
+	}
+	if !fs.Equal(r.Filesystem) {
+		err = fmt.Errorf("resume token refers to %s, not to %s", token.ToName, r.Filesystem.ToString())
+		h.logger.Printf("%s", err)
+		return
+	}
+	to := zfs.FilesystemVersion{
+		Type: zfs.Snapshot,
+		Name: snapName,
+		Guid: token.ToGUID,
+	}
+	if err = h.pullACLCheck(r.Filesystem, &to); err != nil {
+		return
+	}
+	// The flags of a resumed send are those of the interrupted send
+	flags, err := h.effectiveSendFlags(r.Filesystem, zfs.SendFlags{Raw: token.Raw})
+	if err != nil {
+		return
+	}
+	if flags.Raw && !token.Raw {
+		err = fmt.Errorf("refusing to resume non-raw send of %s", r.Filesystem.ToString())
+		h.logger.Printf("%s", err)
+		return
+	}
+
+	release, err := h.holdForTransfer(r.Filesystem, to)
+	if err != nil {
+		return
+	}
+
+	h.logger.Printf("invoking zfs send -t")
+
+	s, err := zfs.ZFSSendResume(h.ctx, r.Token)
+	if err != nil {
+		h.logger.Printf("error resuming send: %#v", err)
+		release()
+		return
+	}
+
+	*stream = &holdReleasingReader{Reader: util.NewRateLimitedReader(h.ctx, s, h.bandwidthLimit), release: release}
+	return
+
+}
+
+func (h Handler) HandleBookmarkRequest(r *BookmarkRequest, bookmark *zfs.FilesystemVersion) (err error) {
+
+	h.logger.Printf("handling bookmark request: %#v", r)
+	if r.Snapshot.Type != zfs.Snapshot {
+		err = fmt.Errorf("can only bookmark snapshots, not %s", r.Snapshot)
+		h.logger.Printf("%s", err)
+		return
+	}
+	if err = h.pullACLCheck(r.Filesystem, &r.Snapshot); err != nil {
+		return
+	}
+
+	vs, err := zfs.ZFSListFilesystemVersions(h.ctx, r.Filesystem, h.fsvf)
+	if err != nil {
+		h.logger.Printf("error listing filesystem versions: %s", err)
+		return
+	}
+
+	// The client only knows the snapshot by name and GUID: make sure
+	// they identify the same snapshot on our side and that we do not
+	// bookmark it twice
+	var snap *zfs.FilesystemVersion
+	for i := range vs {
+		if vs[i].Guid != r.Snapshot.Guid {
+			continue
+		}
+		switch vs[i].Type {
+		case zfs.Bookmark:
+			h.logger.Printf("bookmark already exists: %s", vs[i].ToAbsPath(r.Filesystem))
+			*bookmark = vs[i]
+			return nil
+		case zfs.Snapshot:
+			if vs[i].Name == r.Snapshot.Name {
+				snap = &vs[i]
+			}
+		}
+	}
+	if snap == nil {
+		err = fmt.Errorf("snapshot %s with GUID %v does not exist", r.Snapshot.ToAbsPath(r.Filesystem), r.Snapshot.Guid)
+		h.logger.Printf("%s", err)
+		return
+	}
+
+	h.logger.Printf("invoking zfs bookmark")
+	if err = zfs.ZFSBookmark(h.ctx, r.Filesystem, *snap, snap.Name); err != nil {
+		h.logger.Printf("error creating bookmark: %s", err)
+		return
+	}
+
+	*bookmark = *snap
+	bookmark.Type = zfs.Bookmark
+	return
+
+}
+
+func (h Handler) HandleLastReplicatedRequest(r *LastReplicatedRequest, held *zfs.FilesystemVersion) (err error) {
+
+	h.logger.Printf("handling last replicated request: %#v", r)
+	if err = h.pullACLCheck(r.Filesystem, &r.Snapshot); err != nil {
+		return
+	}
+
+	vs, err := zfs.ZFSListFilesystemVersions(h.ctx, r.Filesystem, h.fsvf)
+	if err != nil {
+		h.logger.Printf("error listing filesystem versions: %s", err)
+		return
+	}
+
+	var snap *zfs.FilesystemVersion
+	for i := range vs {
+		if vs[i].Type == zfs.Snapshot && vs[i].Guid == r.Snapshot.Guid && vs[i].Name == r.Snapshot.Name {
+			snap = &vs[i]
+			break
+		}
+	}
+	if snap == nil {
+		err = fmt.Errorf("snapshot %s with GUID %v does not exist", r.Snapshot.ToAbsPath(r.Filesystem), r.Snapshot.Guid)
+		h.logger.Printf("%s", err)
+		return
+	}
+
+	lastTag := holdTagLastReplicated(h.clientIdentity)
+	h.logger.Printf("holding %s with tag %s", snap.ToAbsPath(r.Filesystem), lastTag)
+	if err = zfs.ZFSHold(h.ctx, r.Filesystem, *snap, lastTag); err != nil {
+		h.logger.Printf("error holding snapshot: %s", err)
+		return
+	}
+
+	// Move the hold, i.e. release all older snapshots held for this client.
+	// This includes transfer holds left behind by a crashed daemon.
+	transferTag := holdTagTransfer(h.clientIdentity)
+	// The bookmarks of the last replicated snapshots of all clients, by GUID
+	lastReplicated := map[uint64]bool{snap.Guid: true}
+	holdsKnown := true
+	for _, v := range vs {
+		if v.Type != zfs.Snapshot || v.UserRefs == 0 || v.Guid == snap.Guid {
+			continue
+		}
+		tags, err := zfs.ZFSHolds(h.ctx, r.Filesystem, v)
+		if err != nil {
+			h.logger.Printf("error listing holds of %s: %s", v.ToAbsPath(r.Filesystem), err)
+			holdsKnown = false
+			continue
+		}
+		for _, tag := range tags {
+			if tag != lastTag && strings.HasPrefix(tag, holdTagPrefixLastReplicated) {
+				lastReplicated[v.Guid] = true
+			}
+			release := func() error {
+				h.logger.Printf("releasing hold %s on %s", tag, v.ToAbsPath(r.Filesystem))
+				return zfs.ZFSRelease(h.ctx, r.Filesystem, v, tag)
+			}
+			var err error
+			switch tag {
+			case lastTag:
+				err = release()
+			case transferTag:
+				// other sessions of the client may still be sending v
+				err = transferHolds.releaseStale(r.Filesystem, v, tag, release)
+			default:
+				continue
+			}
+			if err != nil {
+				h.logger.Printf("error releasing hold: %s", err)
+			}
+		}
+	}
+
+	// Every step of a replication creates a bookmark. Only those of the last replicated
+	// snapshots can serve as incremental source, the older ones are destroyed so that
+	// they do not pile up. Another client's bookmark is kept as long as it holds its snapshot.
+	bookmarked := false
+	for _, v := range vs {
+		bookmarked = bookmarked || (v.Type == zfs.Bookmark && v.Guid == snap.Guid)
+	}
+	if !bookmarked || !holdsKnown {
+		h.logger.Printf("not destroying older bookmarks, %s is not bookmarked or holds are unknown", snap.ToAbsPath(r.Filesystem))
+	} else {
+		for _, v := range vs {
+			if v.Type != zfs.Bookmark || v.CreateTXG >= snap.CreateTXG || lastReplicated[v.Guid] {
+				continue
+			}
+			h.logger.Printf("destroying bookmark %s", v.ToAbsPath(r.Filesystem))
+			if err := zfs.ZFSDestroyFilesystemVersion(h.ctx, r.Filesystem, v); err != nil {
+				h.logger.Printf("error destroying bookmark: %s", err)
+			}
+		}
+	}
+
+	*held = *snap
+	return
+}
+
+// Hold the snapshots among vs for the duration of a transfer.
+// The returned release function must be called once the transfer is done,
+// the holds stay in place while other sessions of the client still send the snapshots.
+func (h Handler) holdForTransfer(fs *zfs.DatasetPath, vs ...zfs.FilesystemVersion) (release func(), err error) {
+
+	tag := holdTagTransfer(h.clientIdentity)
+
+	held := make([]zfs.FilesystemVersion, 0, len(vs))
+	release = func() {
+		for _, v := range held {
+			err := transferHolds.release(fs, v, tag, func() error {
+				h.logger.Printf("releasing hold %s on %s", tag, v.ToAbsPath(fs))
+				return zfs.ZFSRelease(h.ctx, fs, v, tag)
+			})
+			if err != nil {
+				h.logger.Printf("error releasing hold: %s", err)
+			}
+		}
+	}
+
+	for _, v := range vs {
+		if v.Type != zfs.Snapshot {
+			continue // bookmarks cannot be held and need not be
+		}
+		err = transferHolds.acquire(fs, v, tag, func() error {
+			h.logger.Printf("holding %s with tag %s", v.ToAbsPath(fs), tag)
+			return zfs.ZFSHold(h.ctx, fs, v, tag)
+		})
+		if err != nil {
+			h.logger.Printf("error holding snapshot for transfer: %s", err)
+			release()
+			return nil, err
+		}
+		held = append(held, v)
+	}
+
+	return release, nil
+}
+
+// The flags requested by the client combined with the handler's flags.
+// Encrypted filesystems are always sent raw so that their data never
+// leaves this host unencrypted.
+func (h Handler) effectiveSendFlags(fs *zfs.DatasetPath, requested zfs.SendFlags) (flags zfs.SendFlags, err error) {
+	flags = requested.Union(h.sendFlags)
+	encrypted, err := zfs.ZFSGetEncryptionEnabled(h.ctx, fs)
+	if err != nil {
+		h.logger.Printf("cannot determine encryption of %s: %s", fs.ToString(), err)
+		return
+	}
+	if encrypted && !flags.Raw {
+		h.logger.Printf("enforcing raw send of encrypted filesystem %s", fs.ToString())
+		flags.Raw = true
+	}
+	return
 }
 
 func (h Handler) pullACLCheck(p *zfs.DatasetPath, v *zfs.FilesystemVersion) (err error) {
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"io"
+	"sync"
+
+	"github.com/zrepl/zrepl/zfs"
+)
+
+// Tags of the user holds (zfs hold) the Handler places on the sending side.
+//
+// Snapshots that are currently streamed to a client carry the transfer tag,
+// the snapshot most recently replicated to a client carries the last-replicated tag.
+// Both are per client so that clients do not release each other's holds.
+const (
+	holdTagPrefixTransfer       string = "zrepl_transfer_"
+	holdTagPrefixLastReplicated string = "zrepl_last_"
+)
+
+func holdTagTransfer(clientIdentity string) string {
+	return holdTagPrefixTransfer + clientIdentity
+}
+
+func holdTagLastReplicated(clientIdentity string) string {
+	return holdTagPrefixLastReplicated + clientIdentity
+}
+
+// Concurrent sessions of a client share its transfer tag, and zfs hold succeeds
+// if the tag is already present. The transfer holds of this process are therefore
+// reference counted, the tag is only released once the last transfer using it is done.
+var transferHolds = transferHoldRefs{refs: make(map[transferHold]int)}
+
+type transferHold struct {
+	snapshot string // absolute path
+	guid     uint64 // tells apart snapshots recreated with the same name
+	tag      string
+}
+
+type transferHoldRefs struct {
+	// Also serializes the hold and release callbacks
+	mtx  sync.Mutex
+	refs map[transferHold]int
+}
+
+// Calls hold unless a transfer of this process already holds v with tag
+func (r *transferHoldRefs) acquire(fs *zfs.DatasetPath, v zfs.FilesystemVersion, tag string, hold func() error) error {
+	key := transferHold{v.ToAbsPath(fs), v.Guid, tag}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.refs[key] == 0 {
+		if err := hold(); err != nil {
+			return err
+		}
+	}
+	r.refs[key]++
+	return nil
+}
+
+// Calls release if this was the last transfer of this process holding v with tag.
+// Must follow a successful acquire.
+func (r *transferHoldRefs) release(fs *zfs.DatasetPath, v zfs.FilesystemVersion, tag string, release func() error) error {
+	key := transferHold{v.ToAbsPath(fs), v.Guid, tag}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.refs[key]--
+	if r.refs[key] > 0 {
+		return nil
+	}
+	delete(r.refs, key)
+	return release()
+}
+
+// Calls release unless a transfer of this process holds v with tag,
+// i.e. if the hold was left behind by a crashed daemon
+func (r *transferHoldRefs) releaseStale(fs *zfs.DatasetPath, v zfs.FilesystemVersion, tag string, release func() error) error {
+	key := transferHold{v.ToAbsPath(fs), v.Guid, tag}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.refs[key] > 0 {
+		return nil
+	}
+	return release()
+}
+
+// Calls release once the wrapped stream is exhausted, has failed or is closed,
+// whatever comes first.
+type holdReleasingReader struct {
+	io.Reader
+	release func()
+	once    sync.Once
+}
+
+func (r *holdReleasingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if err != nil {
+		r.once.Do(r.release)
+	}
+	return
+}
+
+func (r *holdReleasingReader) Close() (err error) {
+	if c, ok := r.Reader.(io.Closer); ok {
+		err = c.Close()
+	}
+	r.once.Do(r.release)
+	return
+}
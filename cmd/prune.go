@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/zrepl/zrepl/util"
 	"github.com/zrepl/zrepl/zfs"
@@ -22,6 +23,9 @@ type PruneResult struct {
 	All        []zfs.FilesystemVersion
 	Keep       []zfs.FilesystemVersion
 	Remove     []zfs.FilesystemVersion
+	// Versions the prune policy wanted to remove but which are held (zfs hold),
+	// e.g. because they are being replicated or are the last replicated snapshot
+	Skipped []zfs.FilesystemVersion
 }
 
 func (p *Pruner) Run(ctx context.Context) (r []PruneResult, err error) {
@@ -32,7 +36,7 @@ func (p *Pruner) Run(ctx context.Context) (r []PruneResult, err error) {
 		log.Printf("doing dry run")
 	}
 
-	filesystems, err := zfs.ZFSListMapping(p.DatasetFilter)
+	filesystems, err := zfs.ZFSListMapping(ctx, p.DatasetFilter)
 	if err != nil {
 		log.Printf("error applying filesystem filter: %s", err)
 		return nil, err
@@ -46,7 +50,7 @@ func (p *Pruner) Run(ctx context.Context) (r []PruneResult, err error) {
 
 	for _, fs := range filesystems {
 
-		fsversions, err := zfs.ZFSListFilesystemVersions(fs, &PrefixSnapshotFilter{p.SnapshotPrefix})
+		fsversions, err := zfs.ZFSListFilesystemVersions(ctx, fs, &PrefixSnapshotFilter{p.SnapshotPrefix})
 		if err != nil {
 			log.Printf("error listing filesytem versions of %s: %s", fs, err)
 			continue
@@ -79,8 +83,6 @@ func (p *Pruner) Run(ctx context.Context) (r []PruneResult, err error) {
 		dbgj, err = json.Marshal(remove)
 		l.Printf("DEBUG: REMOVE=%s", dbgj)
 
-		r = append(r, PruneResult{fs, fsversions, keep, remove})
-
 		describe := func(v zfs.FilesystemVersion) string {
 			timeSince := v.Creation.Sub(p.Now)
 			const day time.Duration = 24 * time.Hour
@@ -89,20 +91,48 @@ func (p *Pruner) Run(ctx context.Context) (r []PruneResult, err error) {
 			return fmt.Sprintf("%s@%dd%s from now", v.ToAbsPath(fs), days, remainder)
 		}
 
+		removed := make([]zfs.FilesystemVersion, 0, len(remove))
+		skipped := make([]zfs.FilesystemVersion, 0)
 		for _, v := range remove {
+			if v.UserRefs > 0 {
+				l.Printf("skip %s: held by %d user holds", describe(v), v.UserRefs)
+				skipped = append(skipped, v)
+				continue
+			}
 			l.Printf("remove %s", describe(v))
 			// echo what we'll do and exec zfs destroy if not dry run
-			// TODO special handling for EBUSY (zfs hold)
-			// TODO error handling for clones? just echo to cli, skip over, and exit with non-zero status code (we're idempotent)
 			if !p.DryRun {
-				err := zfs.ZFSDestroyFilesystemVersion(fs, v)
-				if err != nil {
-					// handle
+				err := zfs.ZFSDestroyFilesystemVersion(ctx, fs, v)
+				var (
+					busy     *zfs.DatasetBusyError
+					clones   *zfs.HasClonesError
+					notExist *zfs.DatasetDoesNotExistError
+					denied   *zfs.PermissionDeniedError
+				)
+				switch {
+				case err == nil:
+				case errors.As(err, &busy), errors.As(err, &clones):
+					// held or in use since we listed the versions, or cloned
+					l.Printf("skip %s: %s", describe(v), err)
+					skipped = append(skipped, v)
+					continue
+				case errors.As(err, &notExist):
+					// destroyed since we listed the versions, we're idempotent
+					l.Printf("already removed %s", describe(v))
+				case errors.As(err, &denied):
+					// destroying any other version will fail, too
 					l.Printf("error: %s", err)
+					return r, err
+				default:
+					l.Printf("error: %s", err)
+					continue
 				}
 			}
+			removed = append(removed, v)
 		}
 
+		r = append(r, PruneResult{fs, fsversions, keep, removed, skipped})
+
 	}
 
 	return
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+)
+
+type PushContext struct {
+	// The sending side: the endpoints of a Handler, usually on a LocalRPC
+	Local rpc.RPCClient
+	// The endpoints of a SinkHandler
+	Remote            rpc.RPCClient
+	Log               Logger
+	InitialReplPolicy InitialReplPolicy
+	SendFlags         zfs.SendFlags
+	// Updated with the progress of every filesystem, may be nil
+	Status *replicationStatus
+}
+
+// Replicates the filesystems offered by push.Local to push.Remote.
+// Filesystems that diverged from or share no snapshot with the sink are skipped,
+// the conflict has to be resolved on the sink.
+// Cancelling ctx stops the replication before the next filesystem, doPush then returns ctx.Err().
+func doPush(ctx context.Context, push PushContext) (err error) {
+
+	local, remote := push.Local, push.Remote
+	log := push.Log
+
+	log.Printf("requesting local filesystem list")
+	var filesystems []*zfs.DatasetPath
+	if err = local.Call(ctx, "FilesystemRequest", &FilesystemRequest{}, &filesystems); err != nil {
+		return
+	}
+
+	push.Status.reset(filesystems)
+
+	log.Printf("start per-filesystem push")
+	for _, fs := range filesystems {
+
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		push.Status.start(fs)
+
+		log := func(format string, args ...interface{}) {
+			log.Printf("[%s]: %s", fs.ToString(), fmt.Sprintf(format, args...))
+		}
+
+		log("requesting local filesystem versions")
+		var ours []zfs.FilesystemVersion
+		if err := local.Call(ctx, "FilesystemVersionsRequest", &FilesystemVersionsRequest{fs}, &ours); err != nil {
+			log("cannot get local filesystem versions: %s", err)
+			push.Status.fail(fs, err)
+			continue
+		}
+
+		log("requesting filesystem state from sink")
+		var state SinkFilesystemState
+		if err := remote.Call(ctx, "SinkFilesystemStateRequest", &SinkFilesystemStateRequest{fs}, &state); err != nil {
+			log("cannot get filesystem state from sink: %s", err)
+			push.Status.fail(fs, err)
+			continue
+		}
+
+		diff := zfs.MakeFilesystemDiff(state.Versions, ours)
+		log("%s", diff)
+
+		// Sends the full (from == nil) or incremental stream to the sink
+		transfer := func(from *zfs.FilesystemVersion, to zfs.FilesystemVersion) bool {
+
+			log := func(format string, args ...interface{}) {
+				if from == nil {
+					log("[full %s]: %s", to.Name, fmt.Sprintf(format, args...))
+				} else {
+					log("[%s => %s]: %s", from.Name, to.Name, fmt.Sprintf(format, args...))
+				}
+			}
+
+			var size uint64
+			estimate := SendSizeEstimateRequest{Filesystem: fs, From: from, To: to, SendFlags: push.SendFlags}
+			if err := local.Call(ctx, "SendSizeEstimateRequest", &estimate, &size); err != nil {
+				log("cannot estimate stream size: %s", err)
+			}
+
+			var stream io.Reader
+			var err error
+			if from == nil {
+				r := InitialTransferRequest{Filesystem: fs, FilesystemVersion: to, SendFlags: push.SendFlags}
+				err = local.Call(ctx, "InitialTransferRequest", &r, &stream)
+			} else {
+				r := IncrementalTransferRequest{Filesystem: fs, From: *from, To: to, SendFlags: push.SendFlags}
+				err = local.Call(ctx, "IncrementalTransferRequest", &r, &stream)
+			}
+			if err != nil {
+				log("error invoking zfs send: %s", err)
+				push.Status.fail(fs, err)
+				return false
+			}
+			// releases the holds if the stream is not sent until EOF
+			defer func() {
+				if c, ok := stream.(io.Closer); ok {
+					c.Close()
+				}
+			}()
+
+			var ok bool
+			if err = remote.Call(ctx, "SinkReceiveRequest", &SinkReceiveRequest{fs, from != nil}, &ok); err != nil {
+				log("sink rejected receive request: %s", err)
+				push.Status.fail(fs, err)
+				return false
+			}
+
+			log("sending stream")
+			progress := util.TransferProgress{Expected: size, Start: time.Now()}
+			step := push.Status.nextStep(fs)
+			watcher := util.IOProgressWatcher{Reader: stream}
+			watcher.KickOff(1*time.Second, func(p util.IOProgress) {
+				log("progress on send operation: %s", progress.Format(p.TotalRX, time.Now()))
+				push.Status.progress(fs, step, p.TotalRX)
+			})
+			err = remote.Call(ctx, "SinkReceiveStream", &watcher, &ok)
+			totalTx := watcher.Finish().TotalRX
+			if err != nil {
+				log("error receiving stream on sink: %s", err)
+				push.Status.fail(fs, err)
+				return false
+			}
+			push.Status.progress(fs, step, totalTx)
+			log("finished sending stream, %s", progress.Format(totalTx, time.Now()))
+
+			// Bookmark and hold like a Handler does for a pulling client,
+			// failure is not fatal for the current replication run.
+			var bookmark zfs.FilesystemVersion
+			if err := local.Call(ctx, "BookmarkRequest", &BookmarkRequest{fs, to}, &bookmark); err != nil {
+				log("error bookmarking %s: %s", to, err)
+			}
+			var held zfs.FilesystemVersion
+			if err := local.Call(ctx, "LastReplicatedRequest", &LastReplicatedRequest{fs, to}, &held); err != nil {
+				log("error holding %s: %s", to, err)
+			}
+			return true
+		}
+
+		followIncrementalPath := func(path []zfs.FilesystemVersion) {
+			log("following incremental path: %v steps", len(path)-1)
+			for i := 0; i < len(path)-1; i++ {
+				if !transfer(&path[i], path[i+1]) {
+					return
+				}
+			}
+		}
+
+		switch diff.Conflict {
+		case zfs.ConflictAllRight:
+
+			log("performing initial sync, following policy: '%s'", push.InitialReplPolicy)
+			snapsOnly := make([]zfs.FilesystemVersion, 0, len(diff.MRCAPathRight))
+			for _, v := range diff.MRCAPathRight {
+				if v.Type == zfs.Snapshot {
+					snapsOnly = append(snapsOnly, v)
+				}
+			}
+			if len(snapsOnly) < 1 {
+				log("cannot perform initial sync: no local snapshots")
+				push.Status.fail(fs, nil)
+				continue
+			}
+			path := snapsOnly[len(snapsOnly)-1:]
+			if push.InitialReplPolicy == InitialReplPolicyAll {
+				path = snapsOnly
+			}
+			push.Status.addSteps(fs, len(path))
+			if !transfer(nil, path[0]) {
+				continue
+			}
+			if len(path) > 1 {
+				followIncrementalPath(path)
+			}
+
+		case zfs.ConflictIncremental:
+
+			if len(diff.IncrementalPath) < 2 {
+				log("local and sink are in sync")
+				push.Status.finish(fs)
+				continue
+			}
+			push.Status.addSteps(fs, len(diff.IncrementalPath)-1)
+			followIncrementalPath(diff.IncrementalPath)
+
+		case zfs.ConflictNoCommonAncestor:
+			log("local and sink filesystem have snapshots, but no common one")
+			log("destroy the filesystem on the sink or perform manual replication to establish a common snapshot history")
+			push.Status.fail(fs, nil)
+
+		case zfs.ConflictDiverged:
+			log("local and sink filesystem share a history but have diverged")
+			log("destroy the sink-only snapshots to establish an incremental replication path")
+			for _, v := range diff.MRCAPathLeft[1:] {
+				log("sink-only version: %s (GUID %v)", v, v.Guid)
+			}
+			push.Status.fail(fs, nil)
+		}
+		push.Status.finish(fs)
+	}
+
+	return ctx.Err()
+}
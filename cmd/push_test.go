@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+	"github.com/zrepl/zrepl/zfs/zfstest"
+)
+
+// Sets up an in-memory zfs backend with pools src and dst, and a push
+// of src/data (and its children) to a sink receiving below dst/sink/prod1.
+// The sink is served by an rpc.Server over a net.Pipe.
+// The returned func closes the connection and restores the previous backend.
+func pushTest(t *testing.T) (b *zfstest.Backend, push PushContext, done func()) {
+
+	b = zfstest.NewBackend("src", "dst")
+	previous := zfs.SetBackend(b)
+
+	assert.NoError(t, b.CreateFilesystem("src/data"))
+	assert.NoError(t, b.CreateFilesystem("src/data/child"))
+
+	log := testLogger{t}
+	datasets := NewDatasetMapFilter(1, true)
+	if err := datasets.Add("src/data<", "ok"); err != nil {
+		t.Fatal(err)
+	}
+	local := rpc.NewLocalRPC()
+	handler := NewHandler(context.Background(), log, datasets, &PrefixVersionFilter{testSnapshotPrefix}, "testsink", zfs.SendFlags{}, util.BandwidthLimit{})
+	if err := registerEndpoints(local, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	server := rpc.NewServer(serverConn)
+	sink := NewSinkHandler(context.Background(), log, testPath(t, "dst/sink/prod1"), zfs.RecvProperties{})
+	if err := registerSinkEndpoints(server, sink); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	push = PushContext{local, rpc.NewClient(clientConn), log, InitialReplPolicyMostRecent, zfs.SendFlags{}, nil}
+	done = func() {
+		// not client.Close(): both sides write a close frame, which deadlocks on an unbuffered net.Pipe
+		clientConn.Close()
+		zfs.SetBackend(previous)
+	}
+	return
+}
+
+func TestPushInitialAndIncremental(t *testing.T) {
+	b, push, done := pushTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPush(context.Background(), push))
+
+	state, err := zfs.ZFSListFilesystemState(context.Background())
+	assert.NoError(t, err)
+	for _, p := range []string{"dst/sink", "dst/sink/prod1", "dst/sink/prod1/src"} {
+		assert.True(t, state[p].Placeholder, p)
+	}
+	assert.False(t, state["dst/sink/prod1/src/data"].Placeholder)
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/sink/prod1/src/data"))
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/sink/prod1/src/data/child"))
+
+	props, err := zfs.ZFSList(context.Background(), []string{"readonly"}, "dst/sink/prod1/src/data")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"on"}}, props)
+
+	testSnapshot(t, "src/data", "zrepl_2")
+	testSnapshot(t, "src/data", "zrepl_3")
+	assert.NoError(t, doPush(context.Background(), push))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2", "@zrepl_3"}, versionNames(t, "dst/sink/prod1/src/data"))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2", "@zrepl_3"}, versionNames(t, "dst/sink/prod1/src/data/child"))
+
+	// the pushing side bookmarks and holds like for a pulling client
+	holds, err := b.Holds(context.Background(), testPath(t, "src/data"), zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "zrepl_3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{holdTagLastReplicated("testsink")}, holds)
+	assert.Contains(t, versionNames(t, "src/data"), "#zrepl_3")
+}
+
+func TestPushSkipsDivergedFilesystem(t *testing.T) {
+	_, push, done := pushTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPush(context.Background(), push))
+	testSnapshot(t, "dst/sink/prod1/src/data", "local_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+
+	assert.NoError(t, doPush(context.Background(), push))
+	assert.Equal(t, []string{"@zrepl_1", "@local_1"}, versionNames(t, "dst/sink/prod1/src/data"))
+}
+
+func TestSinkRefusesUnannouncedAndFullStreamOverExisting(t *testing.T) {
+	_, push, done := pushTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPush(context.Background(), push))
+
+	versions, err := zfs.ZFSListFilesystemVersions(context.Background(), testPath(t, "src/data"), &PrefixVersionFilter{testSnapshotPrefix})
+	assert.NoError(t, err)
+	zrepl1 := versions[len(versions)-1]
+	assert.Equal(t, "@zrepl_1", zrepl1.String())
+
+	var ok bool
+	stream, err := zfs.ZFSSend(context.Background(), testPath(t, "src/data"), &zrepl1, nil, zfs.SendFlags{})
+	assert.NoError(t, err)
+	assert.Error(t, push.Remote.Call(context.Background(), "SinkReceiveStream", stream, &ok))
+
+	assert.NoError(t, push.Remote.Call(context.Background(), "SinkReceiveRequest", &SinkReceiveRequest{testPath(t, "src/data"), false}, &ok))
+	stream, err = zfs.ZFSSend(context.Background(), testPath(t, "src/data"), &zrepl1, nil, zfs.SendFlags{})
+	assert.NoError(t, err)
+	assert.Error(t, push.Remote.Call(context.Background(), "SinkReceiveStream", stream, &ok))
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/sink/prod1/src/data"))
+}
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/zrepl/zrepl/rpc"
@@ -27,6 +30,49 @@ const (
 	InitialReplPolicyAll        InitialReplPolicy = "all"
 )
 
+const DEFAULT_CONFLICT_RESOLUTION = ConflictResolutionManual
+
+// How doPull handles local filesystems that diverged from
+// or share no snapshot with the remote filesystem
+type ConflictResolution string
+
+const (
+	// Stop replicating the filesystem, the user resolves the conflict
+	ConflictResolutionManual ConflictResolution = "manual"
+	// Roll the local filesystem back to the most recent common snapshot
+	ConflictResolutionRollback ConflictResolution = "rollback"
+	// Rename the local filesystem aside and perform an initial sync
+	ConflictResolutionRename ConflictResolution = "rename"
+)
+
+// The backoff of jobs between connect attempts, see connectWithBackoff
+func newConnectBackoff() *util.Backoff {
+	return util.NewBackoff(time.Second, time.Minute, 0.5)
+}
+
+// Retries failed connect attempts with backoff until one succeeds or ctx is done.
+// Gives up with the error of the last attempt if the next one would start after deadline.
+func connectWithBackoff(ctx context.Context, log Logger, connecter RWCConnecter, backoff *util.Backoff, deadline time.Time) (rwc io.ReadWriteCloser, err error) {
+	for {
+		if rwc, err = connecter.Connect(ctx); err == nil {
+			return rwc, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		delay := backoff.Next()
+		if time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		log.Printf("error connecting (attempt %d), retrying in %s: %s", backoff.Attempts(), delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
 func closeRPCWithTimeout(log Logger, remote rpc.RPCClient, timeout time.Duration, goodbye string) {
 	log.Printf("closing rpc connection")
 
@@ -55,9 +101,20 @@ type PullContext struct {
 	Log               Logger
 	Mapping           DatasetMapping
 	InitialReplPolicy InitialReplPolicy
+	// Requested from the remote for every transfer
+	SendFlags zfs.SendFlags
+	// Applied to every receive
+	RecvProperties     zfs.RecvProperties
+	ConflictResolution ConflictResolution
+	// Limits the rate at which streams are received
+	BandwidthLimit util.BandwidthLimit
+	// Updated with the progress of every filesystem, may be nil
+	Status *replicationStatus
 }
 
-func doPull(pull PullContext) (err error) {
+// Cancelling ctx kills running zfs operations and stops the replication
+// before the next filesystem, doPull then returns ctx.Err().
+func doPull(ctx context.Context, pull PullContext) (err error) {
 
 	remote := pull.Remote
 	log := pull.Log
@@ -65,7 +122,7 @@ func doPull(pull PullContext) (err error) {
 	log.Printf("requesting remote filesystem list")
 	fsr := FilesystemRequest{}
 	var remoteFilesystems []*zfs.DatasetPath
-	if err = remote.Call("FilesystemRequest", &fsr, &remoteFilesystems); err != nil {
+	if err = remote.Call(ctx, "FilesystemRequest", &fsr, &remoteFilesystems); err != nil {
 		return
 	}
 
@@ -94,15 +151,31 @@ func doPull(pull PullContext) (err error) {
 		localTraversal.Add(m.Local)
 	}
 
+	queued := make([]*zfs.DatasetPath, 0, len(replMapping))
+	for _, m := range replMapping {
+		queued = append(queued, m.Local)
+	}
+	pull.Status.reset(queued)
+
 	log.Printf("build cache for already present local filesystem state")
-	localFilesystemState, err := zfs.ZFSListFilesystemState()
+	localFilesystemState, err := zfs.ZFSListFilesystemState(ctx)
 	if err != nil {
 		log.Printf("error requesting local filesystem state: %s", err)
 		return err
 	}
 
+	// Set if a failure will recur for every remaining filesystem
+	aborted := false
+	// Of the filesystems that were attempted, doPull fails if any of them did
+	var attempted int
+	var failures []string
+
 	log.Printf("start per-filesystem sync")
-	localTraversal.WalkTopDown(func(v zfs.DatasetPathVisit) bool {
+	localTraversal.WalkTopDown(func(v zfs.DatasetPathVisit) (descend bool) {
+
+		if ctx.Err() != nil || aborted {
+			return false
+		}
 
 		if v.FilledIn {
 			if _, exists := localFilesystemState[v.Path.ToString()]; exists {
@@ -110,8 +183,20 @@ func doPull(pull PullContext) (err error) {
 				// to know we can add child filesystems to it
 				return true
 			}
+		}
+
+		// The failure of this filesystem, shadows the result of doPull
+		var err error
+		attempted++
+		defer func() {
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", v.Path.ToString(), err))
+			}
+		}()
+
+		if v.FilledIn {
 			log.Printf("creating placeholder filesystem %s", v.Path.ToString())
-			err = zfs.ZFSCreatePlaceholderFilesystem(v.Path)
+			err = zfs.ZFSCreatePlaceholderFilesystem(ctx, v.Path)
 			if err != nil {
 				err = fmt.Errorf("aborting, cannot create placeholder filesystem %s: %s", v.Path, err)
 				return false
@@ -124,12 +209,160 @@ func doPull(pull PullContext) (err error) {
 			panic("internal inconsistency: replMapping should contain mapping for any path that was not filled in by WalkTopDown()")
 		}
 
+		pull.Status.start(m.Local)
+		defer func() {
+			if !descend {
+				pull.Status.fail(m.Local, err)
+			}
+			pull.Status.finish(m.Local)
+		}()
+
 		log := func(format string, args ...interface{}) {
 			log.Printf("[%s => %s]: %s", m.Remote.ToString(), m.Local.ToString(), fmt.Sprintf(format, args...))
 		}
 
+		// Streams received over the network report the effect of compression
+		logWireStats := func(stream io.Reader) {
+			s, ok := stream.(rpc.DataStatsReader)
+			if !ok || s.DataStats().Payload == 0 {
+				return
+			}
+			stats := s.DataStats()
+			log("%s of stream data, %s on the wire (%d%%)", util.FormatBytes(stats.Payload),
+				util.FormatBytes(stats.Wire), 100*stats.Wire/stats.Payload)
+		}
+
+		// Only failures of the local zfs recv are classified by the zfs package.
+		// If the sending side failed, recv only sees a truncated stream, the remote's
+		// error (util.IOCommandError or RPC error text) is not classified.
+		// Failures that affect every filesystem abort the run, the others fail this filesystem only
+		// and are retried on the next run, e.g. a destination modified since its most recent snapshot.
+		recvFailed := func(recvErr error) {
+			log("error receiving stream: %s", recvErr)
+			var (
+				space  *zfs.OutOfSpaceError
+				denied *zfs.PermissionDeniedError
+			)
+			if errors.As(recvErr, &space) || errors.As(recvErr, &denied) {
+				log("aborting replication of all remaining filesystems")
+				aborted = true
+			}
+		}
+
+		// Tell the remote that v has been replicated:
+		//   - it bookmarks v so that it can serve as incremental source even
+		//     after the remote pruned the snapshot
+		//   - it holds v (zfs hold) so that its pruner does not remove the
+		//     most recent snapshot we have
+		// Failure is not fatal for the current replication run.
+		markReplicated := func(v zfs.FilesystemVersion) {
+			log("requesting remote to bookmark %s", v)
+			br := BookmarkRequest{
+				Filesystem: m.Remote,
+				Snapshot:   v,
+			}
+			var bookmark zfs.FilesystemVersion
+			if err := remote.Call(ctx, "BookmarkRequest", &br, &bookmark); err != nil {
+				log("error bookmarking %s on remote: %s", v, err)
+				log("incremental replication will not be possible once the remote prunes %s", v)
+			} else {
+				log("remote bookmarked %s as %s", v, bookmark)
+			}
+
+			log("requesting remote to hold %s as last replicated snapshot", v)
+			lr := LastReplicatedRequest{
+				Filesystem: m.Remote,
+				Snapshot:   v,
+			}
+			var held zfs.FilesystemVersion
+			if err := remote.Call(ctx, "LastReplicatedRequest", &lr, &held); err != nil {
+				log("error holding %s on remote: %s", v, err)
+			}
+		}
+
+		// Steps after v was received, initial if the transfer created the local filesystem
+		finishReceive := func(v zfs.FilesystemVersion, initial bool) bool {
+			if initial && !pull.RecvProperties.Contains("readonly") {
+				log("configuring properties of received filesystem")
+				if err = zfs.ZFSSet(ctx, m.Local, "readonly", "on"); err != nil {
+					log("error setting readonly=on: %s", err)
+					return false
+				}
+			}
+			markReplicated(v)
+			return true
+		}
+
 		log("examing local filesystem state")
 		localState, localExists := localFilesystemState[m.Local.ToString()]
+
+		if localExists && localState.ResumeToken != "" {
+
+			log("local filesystem has receive_resume_token, resuming interrupted transfer")
+			// An interrupted initial transfer leaves a filesystem without snapshots
+			var before []zfs.FilesystemVersion
+			if before, err = zfs.ZFSListFilesystemVersions(ctx, m.Local, nil); err != nil {
+				log("cannot get local filesystem versions: %s", err)
+				return false
+			}
+			r := ResumeTransferRequest{
+				Filesystem: m.Remote,
+				Token:      localState.ResumeToken,
+			}
+			var stream io.Reader
+			if err = remote.Call(ctx, "ResumeTransferRequest", &r, &stream); err != nil {
+				log("error requesting resumed stream: %s", err)
+				log("discarding partially received state, falling back to fresh transfer")
+				if err = zfs.ZFSRecvAbortResumable(ctx, m.Local); err != nil {
+					log("cannot discard partially received state: %s", err)
+					return false
+				}
+			} else {
+				log("invoking zfs receive")
+				pull.Status.addSteps(m.Local, 1)
+				step := pull.Status.nextStep(m.Local)
+				watcher := util.IOProgressWatcher{Reader: util.NewRateLimitedReader(ctx, stream, pull.BandwidthLimit)}
+				watcher.KickOff(1*time.Second, func(p util.IOProgress) {
+					log("progress on receive operation: %v bytes received", p.TotalRX)
+					pull.Status.progress(m.Local, step, p.TotalRX)
+				})
+				err = zfs.ZFSRecv(ctx, m.Local, &watcher, pull.RecvProperties, "-u", "-s")
+				totalRx := watcher.Finish().TotalRX
+				if err != nil {
+					recvFailed(err)
+					return false
+				}
+				pull.Status.progress(m.Local, step, totalRx)
+				log("finished resumed transfer, %v bytes total", totalRx)
+				logWireStats(stream)
+
+				// the resumed snapshot is the most recent one
+				var after []zfs.FilesystemVersion
+				if after, err = zfs.ZFSListFilesystemVersions(ctx, m.Local, nil); err != nil {
+					log("cannot get local filesystem versions: %s", err)
+					return false
+				}
+				resumed := latestSnapshot(after)
+				if resumed == nil {
+					err = fmt.Errorf("no snapshot of %s after resumed transfer", m.Local.ToString())
+					log("%s", err)
+					return false
+				}
+				if !finishReceive(*resumed, latestSnapshot(before) == nil) {
+					return false
+				}
+			}
+
+			// Both outcomes change the local filesystem:
+			// aborting an initial receive even removes it entirely.
+			log("re-examining local filesystem state")
+			var state map[string]zfs.FilesystemState
+			if state, err = zfs.ZFSListFilesystemState(ctx); err != nil {
+				log("cannot get local filesystem state: %s", err)
+				return false
+			}
+			localState, localExists = state[m.Local.ToString()]
+		}
 		var versions []zfs.FilesystemVersion
 		switch {
 		case !localExists:
@@ -139,7 +372,7 @@ func doPull(pull PullContext) (err error) {
 		default:
 			log("local filesystem exists")
 			log("requesting local filesystem versions")
-			if versions, err = zfs.ZFSListFilesystemVersions(m.Local, nil); err != nil {
+			if versions, err = zfs.ZFSListFilesystemVersions(ctx, m.Local, nil); err != nil {
 				log("cannot get local filesystem versions: %s", err)
 				return false
 			}
@@ -150,7 +383,7 @@ func doPull(pull PullContext) (err error) {
 			Filesystem: m.Remote,
 		}
 		var theirVersions []zfs.FilesystemVersion
-		if err = remote.Call("FilesystemVersionsRequest", &r, &theirVersions); err != nil {
+		if err = remote.Call(ctx, "FilesystemVersionsRequest", &r, &theirVersions); err != nil {
 			log("error requesting remote filesystem versions: %s", err)
 			log("stopping replication for all filesystems mapped as children of %s", m.Local.ToString())
 			return false
@@ -164,15 +397,162 @@ func doPull(pull PullContext) (err error) {
 			panic("internal inconsistency: local placeholder implies ConflictAllRight")
 		}
 
+		if diff.Conflict == zfs.ConflictDiverged || diff.Conflict == zfs.ConflictNoCommonAncestor {
+
+			log := func(format string, args ...interface{}) {
+				log("conflict resolution '%s': %s", pull.ConflictResolution, fmt.Sprintf(format, args...))
+			}
+
+			switch pull.ConflictResolution {
+			case ConflictResolutionRollback:
+
+				if diff.Conflict == zfs.ConflictNoCommonAncestor {
+					log("not possible, there is no common snapshot to roll back to")
+					break
+				}
+				mrca := diff.MRCAPathLeft[0]
+				if mrca.Type != zfs.Snapshot {
+					log("not possible, most recent common version %s is not a snapshot", mrca)
+					break
+				}
+
+				log("rolling back local filesystem to most recent common snapshot %s", mrca)
+				for _, v := range diff.MRCAPathLeft[1:] {
+					log("destroying local-only version %s (GUID %v)", v, v.Guid)
+				}
+				if err = zfs.ZFSRollback(ctx, m.Local, mrca, true); err != nil {
+					log("error rolling back: %s", err)
+					return false
+				}
+
+				log("requesting local filesystem versions")
+				if versions, err = zfs.ZFSListFilesystemVersions(ctx, m.Local, nil); err != nil {
+					log("cannot get local filesystem versions: %s", err)
+					return false
+				}
+				diff = zfs.MakeFilesystemDiff(versions, theirVersions)
+				log("%s", diff)
+
+			case ConflictResolutionRename:
+
+				var aside *zfs.DatasetPath
+				asideName := fmt.Sprintf("%s_conflict_%s", m.Local.ToString(), time.Now().UTC().Format("20060102_150405"))
+				if aside, err = zfs.NewDatasetPath(asideName); err != nil {
+					log("cannot build name to rename local filesystem to: %s", err)
+					return false
+				}
+
+				log("renaming local filesystem and its children to %s", aside.ToString())
+				if err = zfs.ZFSRename(ctx, m.Local, aside); err != nil {
+					log("error renaming: %s", err)
+					return false
+				}
+				log("%s is no longer replicated, destroy it once it is not needed anymore", aside.ToString())
+
+				// the children of m.Local were renamed, too
+				log("re-examining local filesystem state")
+				if localFilesystemState, err = zfs.ZFSListFilesystemState(ctx); err != nil {
+					log("cannot get local filesystem state: %s", err)
+					return false
+				}
+				versions = nil
+				diff = zfs.MakeFilesystemDiff(versions, theirVersions)
+				log("%s", diff)
+
+			}
+		}
+
+		// The size of the stream of a full (from == nil) or incremental transfer
+		// as estimated by the remote, 0 if unknown.
+		// Failure is not fatal, progress reports will lack percentages and ETA.
+		estimateSize := func(from *zfs.FilesystemVersion, to zfs.FilesystemVersion) (size uint64) {
+			r := SendSizeEstimateRequest{
+				Filesystem: m.Remote,
+				From:       from,
+				To:         to,
+				SendFlags:  pull.SendFlags,
+			}
+			if err := remote.Call(ctx, "SendSizeEstimateRequest", &r, &size); err != nil {
+				log("cannot get size estimate for %s from remote: %s", to, err)
+				return 0
+			}
+			return size
+		}
+
+		// Incremental transfers along path, path[0] must exist locally
+		followIncrementalPath := func(path []zfs.FilesystemVersion) bool {
+
+			log("following incremental path")
+			var pathRx uint64
+
+			log("requesting size estimates for incremental path")
+			estimates, pathExpected := estimateIncrementalPath(path, estimateSize)
+			pathProgress := util.TransferProgress{Expected: pathExpected, Start: time.Now()}
+			if pathExpected > 0 {
+				log("incremental path: %v steps, %s total", len(path)-1, util.FormatBytes(pathExpected))
+			} else {
+				log("incremental path: %v steps, total size unknown", len(path)-1)
+			}
+
+			for i := 0; i < len(path)-1; i++ {
+
+				from, to := path[i], path[i+1]
+
+				prefix := fmt.Sprintf("[%v/%v][%s => %s]", i+1, len(path)-1, from.Name, to.Name)
+				log := func(format string, args ...interface{}) {
+					log("%s: %s", prefix, fmt.Sprintf(format, args...))
+				}
+
+				log("requesting incremental snapshot stream")
+				r := IncrementalTransferRequest{
+					Filesystem: m.Remote,
+					From:       from,
+					To:         to,
+					SendFlags:  pull.SendFlags,
+				}
+				var stream io.Reader
+				if err = remote.Call(ctx, "IncrementalTransferRequest", &r, &stream); err != nil {
+					log("error requesting incremental snapshot stream: %s", err)
+					return false
+				}
+
+				log("invoking zfs receive")
+				progress := util.TransferProgress{Expected: estimates[i], Start: time.Now()}
+				previousRx := pathRx
+				step := pull.Status.nextStep(m.Local)
+				watcher := util.IOProgressWatcher{Reader: util.NewRateLimitedReader(ctx, stream, pull.BandwidthLimit)}
+				watcher.KickOff(1*time.Second, func(p util.IOProgress) {
+					now := time.Now()
+					log("progress on receive operation: %s, incremental path: %s",
+						progress.Format(p.TotalRX, now), pathProgress.Format(previousRx+p.TotalRX, now))
+					pull.Status.progress(m.Local, step, p.TotalRX)
+				})
+
+				err = zfs.ZFSRecv(ctx, m.Local, &watcher, pull.RecvProperties, "-s")
+				totalRx := watcher.Finish().TotalRX
+				if err != nil {
+					recvFailed(err)
+					return false
+				}
+
+				pull.Status.progress(m.Local, step, totalRx)
+				pathRx += totalRx
+				log("finished incremental transfer, %s", progress.Format(totalRx, time.Now()))
+				logWireStats(stream)
+
+				finishReceive(to, false)
+
+			}
+
+			log("finished following incremental path, %s", pathProgress.Format(pathRx, time.Now()))
+			return true
+		}
+
 		switch diff.Conflict {
 		case zfs.ConflictAllRight:
 
 			log("performing initial sync, following policy: '%s'", pull.InitialReplPolicy)
 
-			if pull.InitialReplPolicy != InitialReplPolicyMostRecent {
-				panic(fmt.Sprintf("policy '%s' not implemented", pull.InitialReplPolicy))
-			}
-
 			snapsOnly := make([]zfs.FilesystemVersion, 0, len(diff.MRCAPathRight))
 			for s := range diff.MRCAPathRight {
 				if diff.MRCAPathRight[s].Type == zfs.Snapshot {
@@ -181,50 +561,77 @@ func doPull(pull PullContext) (err error) {
 			}
 
 			if len(snapsOnly) < 1 {
-				log("cannot perform initial sync: no remote snapshots. stopping...")
+				err = fmt.Errorf("cannot perform initial sync: no remote snapshots")
+				log("%s", err)
 				return false
 			}
 
+			// The initial full transfer is followed by incremental transfers along path
+			var path []zfs.FilesystemVersion
+			switch pull.InitialReplPolicy {
+			case InitialReplPolicyMostRecent:
+				path = snapsOnly[len(snapsOnly)-1:]
+			case InitialReplPolicyAll:
+				path = snapsOnly
+			default:
+				panic(fmt.Sprintf("policy '%s' not implemented", pull.InitialReplPolicy))
+			}
+			pull.Status.addSteps(m.Local, len(path))
+
 			r := InitialTransferRequest{
 				Filesystem:        m.Remote,
-				FilesystemVersion: snapsOnly[len(snapsOnly)-1],
+				FilesystemVersion: path[0],
+				SendFlags:         pull.SendFlags,
 			}
 
+			log("requesting size estimate for %s", r.FilesystemVersion)
+			progress := util.TransferProgress{Expected: estimateSize(nil, r.FilesystemVersion)}
+
 			log("requesting snapshot stream for %s", r.FilesystemVersion)
 
 			var stream io.Reader
 
-			if err = remote.Call("InitialTransferRequest", &r, &stream); err != nil {
+			if err = remote.Call(ctx, "InitialTransferRequest", &r, &stream); err != nil {
 				log("error requesting initial transfer: %s", err)
 				return false
 			}
 			log("received initial transfer request response")
 
 			log("invoking zfs receive")
-			watcher := util.IOProgressWatcher{Reader: stream}
+			progress.Start = time.Now()
+			step := pull.Status.nextStep(m.Local)
+			watcher := util.IOProgressWatcher{Reader: util.NewRateLimitedReader(ctx, stream, pull.BandwidthLimit)}
 			watcher.KickOff(1*time.Second, func(p util.IOProgress) {
-				log("progress on receive operation: %v bytes received", p.TotalRX)
+				log("progress on receive operation: %s", progress.Format(p.TotalRX, time.Now()))
+				pull.Status.progress(m.Local, step, p.TotalRX)
 			})
 
-			recvArgs := []string{"-u"}
+			recvArgs := []string{"-u", "-s"}
 			if localState.Placeholder {
 				log("receive with forced rollback to replace placeholder filesystem")
 				recvArgs = append(recvArgs, "-F")
 			}
 
-			if err = zfs.ZFSRecv(m.Local, &watcher, recvArgs...); err != nil {
-				log("error receiving stream: %s", err)
+			err = zfs.ZFSRecv(ctx, m.Local, &watcher, pull.RecvProperties, recvArgs...)
+			totalRx := watcher.Finish().TotalRX
+			if err != nil {
+				recvFailed(err)
 				return false
 			}
-			log("finished receiving stream, %v bytes total", watcher.Progress().TotalRX)
-
-			log("configuring properties of received filesystem")
-			if err = zfs.ZFSSet(m.Local, "readonly", "on"); err != nil {
+			pull.Status.progress(m.Local, step, totalRx)
+			log("finished receiving stream, %s", progress.Format(totalRx, time.Now()))
+			logWireStats(stream)
 
+			if !finishReceive(r.FilesystemVersion, true) {
+				return false
 			}
 
 			log("finished initial transfer")
-			return true
+
+			if len(path) < 2 {
+				return true
+			}
+			return followIncrementalPath(path)
 
 		case zfs.ConflictIncremental:
 
@@ -233,52 +640,12 @@ func doPull(pull PullContext) (err error) {
 				return true
 			}
 
-			log("following incremental path from diff")
-			var pathRx uint64
-
-			for i := 0; i < len(diff.IncrementalPath)-1; i++ {
-
-				from, to := diff.IncrementalPath[i], diff.IncrementalPath[i+1]
-
-				log := func(format string, args ...interface{}) {
-					log("[%v/%v][%s => %s]: %s", i+1, len(diff.IncrementalPath)-1,
-						from.Name, to.Name, fmt.Sprintf(format, args...))
-				}
-
-				log("requesting incremental snapshot stream")
-				r := IncrementalTransferRequest{
-					Filesystem: m.Remote,
-					From:       from,
-					To:         to,
-				}
-				var stream io.Reader
-				if err = remote.Call("IncrementalTransferRequest", &r, &stream); err != nil {
-					log("error requesting incremental snapshot stream: %s", err)
-					return false
-				}
-
-				log("invoking zfs receive")
-				watcher := util.IOProgressWatcher{Reader: stream}
-				watcher.KickOff(1*time.Second, func(p util.IOProgress) {
-					log("progress on receive operation: %v bytes received", p.TotalRX)
-				})
-
-				if err = zfs.ZFSRecv(m.Local, &watcher); err != nil {
-					log("error receiving stream: %s", err)
-					return false
-				}
-
-				totalRx := watcher.Progress().TotalRX
-				pathRx += totalRx
-				log("finished incremental transfer, %v bytes total", totalRx)
-
-			}
-
-			log("finished following incremental path, %v bytes total", pathRx)
-			return true
+			pull.Status.addSteps(m.Local, len(diff.IncrementalPath)-1)
+			return followIncrementalPath(diff.IncrementalPath)
 
 		case zfs.ConflictNoCommonAncestor:
 
+			err = fmt.Errorf("no common snapshot with remote filesystem %s", m.Remote.ToString())
 			log("remote and local filesystem have snapshots, but no common one")
 			log("perform manual replication to establish a common snapshot history")
 			log("remote versions:")
@@ -293,6 +660,7 @@ func doPull(pull PullContext) (err error) {
 
 		case zfs.ConflictDiverged:
 
+			err = fmt.Errorf("diverged from remote filesystem %s", m.Remote.ToString())
 			log("remote and local filesystem share a history but have diverged")
 			log("perform manual replication or delete snapshots on the receiving" +
 				"side  to establish an incremental replication parse")
@@ -313,6 +681,38 @@ func doPull(pull PullContext) (err error) {
 
 	})
 
-	return
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d filesystems failed: %s", len(failures), attempted, strings.Join(failures, "; "))
+	}
+	return nil
+
+}
 
+// The estimated sizes of the transfers along path, 0 if unknown.
+// The total is unknown (0) if any of the estimates is.
+func estimateIncrementalPath(path []zfs.FilesystemVersion, estimate func(from *zfs.FilesystemVersion, to zfs.FilesystemVersion) uint64) (steps []uint64, total uint64) {
+	steps = make([]uint64, len(path)-1)
+	known := true
+	for i := range steps {
+		steps[i] = estimate(&path[i], path[i+1])
+		known = known && steps[i] > 0
+		total += steps[i]
+	}
+	if !known {
+		total = 0
+	}
+	return steps, total
+}
+
+// The snapshot among vs with the highest createtxg, nil if there is none
+func latestSnapshot(vs []zfs.FilesystemVersion) (latest *zfs.FilesystemVersion) {
+	for i := range vs {
+		if vs[i].Type == zfs.Snapshot && (latest == nil || vs[i].CreateTXG > latest.CreateTXG) {
+			latest = &vs[i]
+		}
+	}
+	return latest
 }
@@ -0,0 +1,555 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+	"github.com/zrepl/zrepl/zfs/zfstest"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, v ...interface{}) {
+	l.t.Logf(format, v...)
+}
+
+const testSnapshotPrefix = "zrepl_"
+
+// Sets up an in-memory zfs backend with pools src and dst, and a pull
+// from src/data (and its children) to dst/backups/data over a local RPC.
+// The returned func restores the previous backend.
+func replicationTest(t *testing.T) (b *zfstest.Backend, pull PullContext, done func()) {
+
+	b = zfstest.NewBackend("src", "dst")
+	previous := zfs.SetBackend(b)
+	done = func() { zfs.SetBackend(previous) }
+
+	assert.NoError(t, b.CreateFilesystem("src/data"))
+	assert.NoError(t, b.CreateFilesystem("src/data/child"))
+
+	log := testLogger{t}
+	local := rpc.NewLocalRPC()
+	handler := NewHandler(context.Background(), log, localPullACL{}, &PrefixVersionFilter{testSnapshotPrefix}, "testclient", zfs.SendFlags{}, util.BandwidthLimit{})
+	if err := registerEndpoints(local, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := NewDatasetMapFilter(1, false)
+	if err := mapping.Add("src/data<", "dst/backups/data"); err != nil {
+		t.Fatal(err)
+	}
+
+	pull = PullContext{local, log, mapping, InitialReplPolicyMostRecent, zfs.SendFlags{}, zfs.RecvProperties{}, ConflictResolutionManual, util.BandwidthLimit{}, nil}
+	return
+}
+
+func testPath(t *testing.T, s string) *zfs.DatasetPath {
+	p, err := zfs.NewDatasetPath(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testSnapshot(t *testing.T, fs, name string) {
+	if err := zfs.ZFSSnapshot(context.Background(), testPath(t, fs), name, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func versionNames(t *testing.T, fs string) (names []string) {
+	versions, err := zfs.ZFSListFilesystemVersions(context.Background(), testPath(t, fs), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = v.String()
+	}
+	return
+}
+
+func TestPullInitialAndIncremental(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	state, err := zfs.ZFSListFilesystemState(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, state["dst/backups"].Placeholder)
+	assert.False(t, state["dst/backups/data"].Placeholder)
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/backups/data"))
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/backups/data/child"))
+
+	testSnapshot(t, "src/data", "zrepl_2")
+	testSnapshot(t, "src/data", "zrepl_3")
+	assert.NoError(t, doPull(context.Background(), pull))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2", "@zrepl_3"}, versionNames(t, "dst/backups/data"))
+
+	// the sender bookmarks and holds only the most recent replicated snapshot
+	assert.Equal(t,
+		[]string{"@zrepl_1", "@zrepl_2", "#zrepl_3", "@zrepl_3"},
+		versionNames(t, "src/data"))
+	for _, s := range []string{"zrepl_1", "zrepl_2"} {
+		holds, err := b.Holds(context.Background(), testPath(t, "src/data"), zfs.FilesystemVersion{Type: zfs.Snapshot, Name: s})
+		assert.NoError(t, err)
+		assert.Len(t, holds, 0, s)
+	}
+	holds, err := b.Holds(context.Background(), testPath(t, "src/data"), zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "zrepl_3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{holdTagLastReplicated("testclient")}, holds)
+}
+
+func TestPullInitialReplPolicyAll(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+	pull.InitialReplPolicy = InitialReplPolicyAll
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+	testSnapshot(t, "src/data", "zrepl_3")
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2", "@zrepl_3"}, versionNames(t, "dst/backups/data"))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2", "@zrepl_3"}, versionNames(t, "dst/backups/data/child"))
+}
+
+func TestPullEncryptedFilesystemIsSentRaw(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	assert.NoError(t, zfs.ZFSSet(context.Background(), testPath(t, "src/data"), "encryption", "aes-256-gcm"))
+	testSnapshot(t, "src/data", "zrepl_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+	pull.InitialReplPolicy = InitialReplPolicyAll
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	for _, fs := range []string{"dst/backups/data", "dst/backups/data/child"} {
+		encrypted, err := zfs.ZFSGetEncryptionEnabled(context.Background(), testPath(t, fs))
+		assert.NoError(t, err)
+		assert.True(t, encrypted, fs)
+	}
+	encrypted, err := zfs.ZFSGetEncryptionEnabled(context.Background(), testPath(t, "dst/backups"))
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+}
+
+func TestPullRecvProperties(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	src := testPath(t, "src/data")
+	assert.NoError(t, zfs.ZFSSet(context.Background(), src, "sharenfs", "on"))
+	assert.NoError(t, zfs.ZFSSet(context.Background(), src, "compression", "lz4"))
+	testSnapshot(t, "src/data", "zrepl_1")
+
+	pull.SendFlags = zfs.SendFlags{Properties: true}
+	pull.RecvProperties = zfs.RecvProperties{
+		Override: map[string]string{"mountpoint": "none", "compression": "gzip"},
+		Exclude:  []string{"sharenfs"},
+	}
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	props, err := zfs.ZFSList(context.Background(), []string{"mountpoint", "compression", "sharenfs", "readonly"}, "dst/backups/data")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"none", "gzip", "-", "on"}}, props)
+}
+
+func TestPullConflictResolutionManual(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+	testSnapshot(t, "dst/backups/data", "local_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+
+	err := doPull(context.Background(), pull)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "dst/backups/data: diverged from remote filesystem src/data")
+	}
+	assert.Equal(t, []string{"@zrepl_1", "@local_1"}, versionNames(t, "dst/backups/data"))
+}
+
+func TestPullConflictResolutionRollback(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+	pull.ConflictResolution = ConflictResolutionRollback
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+	testSnapshot(t, "dst/backups/data", "local_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+
+	assert.NoError(t, doPull(context.Background(), pull))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2"}, versionNames(t, "dst/backups/data"))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2"}, versionNames(t, "dst/backups/data/child"))
+}
+
+func TestPullConflictResolutionRename(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+	pull.ConflictResolution = ConflictResolutionRename
+
+	assert.NoError(t, b.CreateFilesystem("dst/backups"))
+	assert.NoError(t, b.CreateFilesystem("dst/backups/data"))
+	assert.NoError(t, b.CreateFilesystem("dst/backups/data/child"))
+	testSnapshot(t, "dst/backups/data", "other")
+	testSnapshot(t, "src/data", "zrepl_1")
+
+	assert.NoError(t, doPull(context.Background(), pull))
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/backups/data"))
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/backups/data/child"))
+
+	filesystems, err := zfs.ZFSList(context.Background(), []string{"name"}, "-r", "-t", "filesystem", "dst/backups")
+	assert.NoError(t, err)
+	assert.Len(t, filesystems, 5)
+	var aside string
+	for _, fs := range filesystems {
+		if strings.HasPrefix(fs[0], "dst/backups/data_conflict_") && !strings.Contains(fs[0], "child") {
+			aside = fs[0]
+		}
+	}
+	assert.Equal(t, []string{"@other"}, versionNames(t, aside))
+	assert.Equal(t, []string{"@other"}, versionNames(t, aside+"/child"))
+}
+
+func TestSendSizeEstimateRequest(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+	zrepl1 := zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "zrepl_1"}
+	zrepl2 := zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "zrepl_2"}
+
+	var size uint64
+	r := SendSizeEstimateRequest{Filesystem: testPath(t, "src/data"), To: zrepl1}
+	assert.NoError(t, pull.Remote.Call(context.Background(), "SendSizeEstimateRequest", &r, &size))
+	assert.EqualValues(t, b.StreamSize, size)
+
+	r = SendSizeEstimateRequest{Filesystem: testPath(t, "src/data"), From: &zrepl1, To: zrepl2}
+	assert.NoError(t, pull.Remote.Call(context.Background(), "SendSizeEstimateRequest", &r, &size))
+	assert.EqualValues(t, b.StreamSize, size)
+
+	r = SendSizeEstimateRequest{Filesystem: testPath(t, "src/data"), From: &zrepl2, To: zrepl1}
+	assert.Error(t, pull.Remote.Call(context.Background(), "SendSizeEstimateRequest", &r, &size))
+}
+
+func TestEstimateIncrementalPath(t *testing.T) {
+	path := []zfs.FilesystemVersion{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	sizes := map[string]uint64{"b": 100, "c": 200, "d": 300}
+	estimate := func(from *zfs.FilesystemVersion, to zfs.FilesystemVersion) uint64 {
+		return sizes[to.Name]
+	}
+
+	steps, total := estimateIncrementalPath(path, estimate)
+	assert.Equal(t, []uint64{100, 200, 300}, steps)
+	assert.Equal(t, uint64(600), total)
+
+	// the later steps are still estimated
+	delete(sizes, "b")
+	steps, total = estimateIncrementalPath(path, estimate)
+	assert.Equal(t, []uint64{0, 200, 300}, steps)
+	assert.Equal(t, uint64(0), total)
+}
+
+func TestPullOverNetworkRPC(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	clientConn, serverConn := net.Pipe()
+	server := rpc.NewServer(serverConn)
+	handler := NewHandler(context.Background(), pull.Log, localPullACL{}, &PrefixVersionFilter{testSnapshotPrefix}, "testclient", zfs.SendFlags{}, util.BandwidthLimit{})
+	if err := registerEndpoints(server, handler); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	// not client.Close(): both sides write a close frame, which deadlocks on an unbuffered net.Pipe
+	defer clientConn.Close()
+
+	client := rpc.NewClient(clientConn)
+	pull.Remote = client
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+	testSnapshot(t, "src/data", "zrepl_2")
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2"}, versionNames(t, "dst/backups/data/child"))
+}
+
+func TestPullCancelled(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, doPull(ctx, pull))
+
+	_, err := b.List(context.Background(), []string{"name"}, "dst/backups")
+	assert.Error(t, err, "nothing must be replicated")
+}
+
+func TestPullResumesInterruptedTransfer(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	b.InterruptNextSendAfter = 1000
+	assert.Error(t, doPull(context.Background(), pull))
+
+	state, err := zfs.ZFSListFilesystemState(context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, state["dst/backups/data"].ResumeToken)
+
+	assert.NoError(t, doPull(context.Background(), pull))
+	state, err = zfs.ZFSListFilesystemState(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, state["dst/backups/data"].ResumeToken)
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/backups/data"))
+	assert.Equal(t, []string{"@zrepl_1"}, versionNames(t, "dst/backups/data/child"))
+
+	// the resumed initial transfer is finished like an uninterrupted one
+	props, err := zfs.ZFSList(context.Background(), []string{"readonly"}, "dst/backups/data")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"on"}}, props)
+	assert.Equal(t, []string{"#zrepl_1", "@zrepl_1"}, versionNames(t, "src/data"))
+	holds, err := b.Holds(context.Background(), testPath(t, "src/data"), zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "zrepl_1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{holdTagLastReplicated("testclient")}, holds)
+}
+
+func TestPullIncrementalFromBookmark(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	// the sender prunes the snapshot the receiver has, only the bookmark remains
+	src := testPath(t, "src/data")
+	zrepl1 := zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "zrepl_1"}
+	assert.NoError(t, b.Release(context.Background(), src, zrepl1, holdTagLastReplicated("testclient")))
+	assert.NoError(t, zfs.ZFSDestroy(context.Background(), "src/data@zrepl_1"))
+	testSnapshot(t, "src/data", "zrepl_2")
+
+	assert.NoError(t, doPull(context.Background(), pull))
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2"}, versionNames(t, "dst/backups/data"))
+}
+
+func TestPrunerSkipsHeldSnapshots(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+	testSnapshot(t, "src/data", "zrepl_2")
+
+	p := Pruner{
+		Now:            time.Now(),
+		DatasetFilter:  pull.Mapping.(*DatasetMapFilter).AsFilter(),
+		SnapshotPrefix: testSnapshotPrefix,
+		PrunePolicy:    removeAllPrunePolicy{},
+	}
+	ctx := context.WithValue(context.Background(), contextKeyLog, pull.Log)
+	results, err := p.Run(ctx)
+	assert.NoError(t, err)
+
+	for _, r := range results {
+		if r.Filesystem.ToString() != "src/data" {
+			continue
+		}
+		assert.Len(t, r.Remove, 1)
+		assert.Equal(t, "zrepl_2", r.Remove[0].Name)
+		assert.Len(t, r.Skipped, 1)
+		assert.Equal(t, "zrepl_1", r.Skipped[0].Name)
+	}
+	assert.Equal(t, []string{"#zrepl_1", "@zrepl_1"}, versionNames(t, "src/data"))
+}
+
+func TestSourceJobHoldsPerClient(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+
+	datasets := NewDatasetMapFilter(1, true)
+	assert.NoError(t, datasets.Add("src/data<", "ok"))
+	job := &SourceJob{Name: "source", Datasets: datasets, SnapshotPrefix: testSnapshotPrefix}
+
+	// pulls src/data to target as client
+	pullAs := func(client, target string) PullContext {
+		local := rpc.NewLocalRPC()
+		if err := registerEndpoints(local, job.handler(context.Background(), pull.Log, client)); err != nil {
+			t.Fatal(err)
+		}
+		mapping := NewDatasetMapFilter(1, false)
+		assert.NoError(t, mapping.Add("src/data<", target))
+		p := pull
+		p.Remote, p.Mapping = local, mapping
+		return p
+	}
+	pullA, pullB := pullAs("a", "dst/a"), pullAs("b", "dst/b")
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pullA))
+	testSnapshot(t, "src/data", "zrepl_2")
+	assert.NoError(t, doPull(context.Background(), pullB))
+
+	holds := func(snapshot string) []string {
+		tags, err := b.Holds(context.Background(), testPath(t, "src/data"), zfs.FilesystemVersion{Type: zfs.Snapshot, Name: snapshot})
+		assert.NoError(t, err)
+		return tags
+	}
+	assert.Equal(t, []string{"zrepl_last_a"}, holds("zrepl_1"), "b must not release the hold of a")
+	assert.Equal(t, []string{"zrepl_last_b"}, holds("zrepl_2"))
+
+	// the bookmark of a's last replicated snapshot is kept, too
+	assert.Equal(t, []string{"#zrepl_1", "@zrepl_1", "#zrepl_2", "@zrepl_2"}, versionNames(t, "src/data"))
+
+	// a moves its hold, b keeps its own
+	assert.NoError(t, doPull(context.Background(), pullA))
+	assert.Empty(t, holds("zrepl_1"))
+	assert.Equal(t, []string{"zrepl_last_a", "zrepl_last_b"}, holds("zrepl_2"))
+	assert.Equal(t, []string{"@zrepl_1", "#zrepl_2", "@zrepl_2"}, versionNames(t, "src/data"))
+}
+
+func TestReplicationStepsLeaveBoundedBookmarks(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+	pull.InitialReplPolicy = InitialReplPolicyAll
+
+	bookmarks := func() (n int) {
+		for _, v := range versionNames(t, "src/data") {
+			if strings.HasPrefix(v, "#") {
+				n++
+			}
+		}
+		return n
+	}
+	for i := 1; i <= 10; i++ {
+		// several steps per run
+		testSnapshot(t, "src/data", fmt.Sprintf("zrepl_%d_a", i))
+		testSnapshot(t, "src/data", fmt.Sprintf("zrepl_%d_b", i))
+		assert.NoError(t, doPull(context.Background(), pull))
+		assert.Equal(t, 1, bookmarks(), "run %d", i)
+	}
+	assert.Contains(t, versionNames(t, "src/data"), "#zrepl_10_b")
+}
+
+func TestConcurrentSessionsOfClientShareTransferHolds(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+	src := testPath(t, "src/data")
+	versions, err := zfs.ZFSListFilesystemVersions(context.Background(), src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zrepl1, zrepl2 := versions[0], versions[1]
+	holds := func(v zfs.FilesystemVersion) []string {
+		tags, err := zfs.ZFSHolds(context.Background(), src, v)
+		assert.NoError(t, err)
+		return tags
+	}
+
+	// every session has its own handler
+	newHandler := func() Handler {
+		return NewHandler(context.Background(), pull.Log, localPullACL{}, &PrefixVersionFilter{testSnapshotPrefix}, "testclient", zfs.SendFlags{}, util.BandwidthLimit{})
+	}
+	streams := make([]io.Reader, 3)
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := &InitialTransferRequest{Filesystem: src, FilesystemVersion: zrepl1}
+			assert.NoError(t, newHandler().HandleInitialTransferRequest(r, &streams[i]))
+		}(i)
+	}
+	wg.Wait()
+	transferTag := holdTagTransfer("testclient")
+	assert.Equal(t, []string{transferTag}, holds(zrepl1))
+
+	assert.NoError(t, streams[0].(io.Closer).Close())
+	assert.Equal(t, []string{transferTag}, holds(zrepl1), "other sessions are still sending")
+
+	// another session finished replicating zrepl_2
+	var held zfs.FilesystemVersion
+	assert.NoError(t, newHandler().HandleLastReplicatedRequest(&LastReplicatedRequest{src, zrepl2}, &held))
+	assert.Equal(t, []string{transferTag}, holds(zrepl1), "only stale transfer holds are released")
+
+	for _, s := range streams[1:] {
+		_, err := io.Copy(ioutil.Discard, s)
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, holds(zrepl1))
+	assert.Equal(t, []string{holdTagLastReplicated("testclient")}, holds(zrepl2))
+}
+
+type removeAllPrunePolicy struct{}
+
+func (p removeAllPrunePolicy) Prune(fs *zfs.DatasetPath, versions []zfs.FilesystemVersion) (keep, remove []zfs.FilesystemVersion, err error) {
+	return []zfs.FilesystemVersion{}, versions, nil
+}
+
+type flakyConnecter struct {
+	failures int
+	attempts int
+}
+
+func (c *flakyConnecter) Connect(ctx context.Context) (io.ReadWriteCloser, error) {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return nil, errors.New("connection refused")
+	}
+	clientConn, _ := net.Pipe()
+	return clientConn, nil
+}
+
+func TestConnectWithBackoff(t *testing.T) {
+	log := testLogger{t}
+	deadline := time.Now().Add(time.Minute)
+
+	c := &flakyConnecter{failures: 3}
+	rwc, err := connectWithBackoff(context.Background(), log, c, util.NewBackoff(time.Millisecond, 4*time.Millisecond, 0.5), deadline)
+	assert.NoError(t, err)
+	assert.NotNil(t, rwc)
+	assert.Equal(t, 4, c.attempts)
+
+	// gives up if the next attempt would be after the deadline
+	c = &flakyConnecter{failures: 1000}
+	backoff := util.NewBackoff(10*time.Millisecond, 40*time.Millisecond, 0)
+	_, err = connectWithBackoff(context.Background(), log, c, backoff, time.Now().Add(60*time.Millisecond))
+	if assert.Error(t, err) {
+		assert.Equal(t, "connection refused", err.Error())
+	}
+	assert.Equal(t, 3, c.attempts, "10ms + 20ms, 40ms more would pass the deadline")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	c = &flakyConnecter{failures: 1000}
+	_, err = connectWithBackoff(ctx, log, c, util.NewBackoff(time.Millisecond, 5*time.Millisecond, 0), deadline)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+)
+
+// Limits the number of connections a job serves concurrently.
+// A limit of 0 means unlimited.
+type sessionLimiter struct {
+	max          int
+	maxPerClient int
+
+	mtx       sync.Mutex
+	total     int
+	perClient map[string]int
+}
+
+type SessionLimitError struct {
+	ClientIdentity string
+	// Whether the limit per client identity was reached, otherwise the job's limit
+	PerClient bool
+	Limit     int
+}
+
+func (e *SessionLimitError) Error() string {
+	if e.PerClient {
+		return fmt.Sprintf("client %s reached the limit of %d concurrent sessions", e.ClientIdentity, e.Limit)
+	}
+	return fmt.Sprintf("job reached the limit of %d concurrent sessions", e.Limit)
+}
+
+func newSessionLimiter(max, maxPerClient int) *sessionLimiter {
+	return &sessionLimiter{max: max, maxPerClient: maxPerClient, perClient: make(map[string]int)}
+}
+
+// Every successful acquire must be followed by a release with the same clientIdentity
+func (l *sessionLimiter) acquire(clientIdentity string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return &SessionLimitError{clientIdentity, false, l.max}
+	}
+	if l.maxPerClient > 0 && l.perClient[clientIdentity] >= l.maxPerClient {
+		return &SessionLimitError{clientIdentity, true, l.maxPerClient}
+	}
+	l.total++
+	l.perClient[clientIdentity]++
+	return nil
+}
+
+func (l *sessionLimiter) release(clientIdentity string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.perClient[clientIdentity] <= 0 {
+		panic(fmt.Sprintf("release of session of client %s without acquire", clientIdentity))
+	}
+	l.total--
+	l.perClient[clientIdentity]--
+	if l.perClient[clientIdentity] == 0 {
+		delete(l.perClient, clientIdentity)
+	}
+}
+
+// Serves every connection accepted on listener in its own session, i.e. goroutine,
+// at most as many concurrently as limiter allows.
+// Returns once listener failed or ctx is done, and all sessions exited.
+func serveSessions(ctx context.Context, log Logger, listener AuthenticatedChannelListener, limiter *sessionLimiter,
+	serve func(ctx context.Context, log Logger, rwc io.ReadWriteCloser, clientIdentity string)) {
+
+	type accepted struct {
+		rwc            io.ReadWriteCloser
+		clientIdentity string
+		err            error
+	}
+	// buffered: the pending Accept returns after the listener is closed, with nobody receiving
+	acceptChan := make(chan accepted, 1)
+
+	var sessions sync.WaitGroup
+	sessionCount := 0
+
+	// Serve connections until interrupted or error
+outer:
+	for {
+
+		go func() {
+			rwc, clientIdentity, err := listener.Accept()
+			acceptChan <- accepted{rwc, clientIdentity, err}
+		}()
+
+		select {
+
+		case a := <-acceptChan:
+
+			if a.err != nil {
+				log.Printf("error accepting connection: %s", a.err)
+				if isTemporaryError(a.err) {
+					continue // e.g. a single client failed to authenticate
+				}
+				break outer
+			}
+
+			if err := limiter.acquire(a.clientIdentity); err != nil {
+				log.Printf("rejecting connection: %s", err)
+				a.rwc.Close()
+				continue
+			}
+
+			sessionCount++
+			sessionLog := util.NewPrefixLogger(log, fmt.Sprintf("session #%d (%s)", sessionCount, a.clientIdentity))
+			sessions.Add(1)
+			go func() {
+				defer sessions.Done()
+				defer limiter.release(a.clientIdentity)
+				sessionLog.Printf("serving connection")
+				serve(ctx, sessionLog, a.rwc, a.clientIdentity)
+				sessionLog.Printf("session exited")
+			}()
+
+		case <-ctx.Done():
+			log.Printf("context: %s", ctx.Err())
+			break outer
+
+		}
+
+	}
+
+	log.Printf("closing listener")
+	if err := listener.Close(); err != nil {
+		log.Printf("error closing listener: %s", err)
+	}
+
+	log.Printf("waiting for active sessions to exit")
+	sessions.Wait()
+}
+
+// Like net.Error, an AuthenticatedChannelListener returns errors with Temporary() == true
+// if only the connection to accept failed, not the listener
+func isTemporaryError(err error) bool {
+	var t interface {
+		Temporary() bool
+	}
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// Serves the endpoints registered by register on rwc until the client hangs up or ctx is done
+func serveRPC(ctx context.Context, log Logger, rwc io.ReadWriteCloser, debug JobDebugSettings, keepalive rpc.Keepalive,
+	register func(server rpc.RPCServer)) {
+
+	rwc, err := util.NewReadWriteCloserLogger(rwc, debug.Conn.ReadDump, debug.Conn.WriteDump)
+	if err != nil {
+		panic(err)
+	}
+
+	rpcServer := rpc.NewServer(rwc)
+	if debug.RPC.Log {
+		rpclog := util.NewPrefixLogger(log, "rpc")
+		rpcServer.SetLogger(rpclog, true)
+	}
+	rpcServer.SetKeepalive(keepalive)
+	register(rpcServer)
+
+	// closing the connection makes Serve return if the job is cancelled
+	served := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			rwc.Close()
+		case <-served:
+		}
+	}()
+	if err = rpcServer.Serve(); err != nil {
+		log.Printf("error serving connection: %s", err)
+	}
+	close(served)
+	rwc.Close()
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	l := newSessionLimiter(3, 2)
+
+	assert.NoError(t, l.acquire("a"))
+	assert.NoError(t, l.acquire("a"))
+	err := l.acquire("a")
+	if assert.IsType(t, &SessionLimitError{}, err) {
+		assert.True(t, err.(*SessionLimitError).PerClient)
+	}
+
+	assert.NoError(t, l.acquire("b"))
+	err = l.acquire("c")
+	if assert.IsType(t, &SessionLimitError{}, err) {
+		assert.False(t, err.(*SessionLimitError).PerClient)
+	}
+
+	l.release("a")
+	assert.NoError(t, l.acquire("c"))
+
+	unlimited := newSessionLimiter(0, 0)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, unlimited.acquire("a"))
+	}
+}
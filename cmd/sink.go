@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/zfs"
+)
+
+// Requests of a push job to a sink job.
+// Filesystems are named as on the pushing side, the sink maps them below its root for the client.
+
+type SinkFilesystemStateRequest struct {
+	Filesystem *zfs.DatasetPath
+}
+
+type SinkFilesystemState struct {
+	Exists bool
+	// The filesystem was created by the sink to hold received children, see zfs.ZFSCreatePlaceholderFilesystem
+	Placeholder bool
+	// All snapshots and bookmarks, empty for placeholders
+	Versions []zfs.FilesystemVersion
+}
+
+// Announces the stream of the next SinkReceiveStream request
+type SinkReceiveRequest struct {
+	Filesystem *zfs.DatasetPath
+	// A full stream requires that the filesystem does not exist or is a placeholder
+	Incremental bool
+}
+
+// Handles the requests of a single push client, hence it has state
+type SinkHandler struct {
+	ctx    context.Context
+	logger Logger
+	// The client's filesystems are received below root, e.g. pool/sink/client/zroot/var/db for zroot/var/db
+	root           *zfs.DatasetPath
+	recvProperties zfs.RecvProperties
+	// Set by SinkReceiveRequest, consumed by SinkReceiveStream
+	pending *SinkReceiveRequest
+	// Whether any stream has been received
+	received bool
+}
+
+func NewSinkHandler(ctx context.Context, logger Logger, root *zfs.DatasetPath, recvProperties zfs.RecvProperties) *SinkHandler {
+	return &SinkHandler{ctx: ctx, logger: logger, root: root, recvProperties: recvProperties}
+}
+
+func registerSinkEndpoints(server rpc.RPCServer, handler *SinkHandler) (err error) {
+	err = server.RegisterEndpoint("SinkFilesystemStateRequest", handler.HandleFilesystemStateRequest)
+	if err != nil {
+		panic(err)
+	}
+	err = server.RegisterEndpoint("SinkReceiveRequest", handler.HandleReceiveRequest)
+	if err != nil {
+		panic(err)
+	}
+	err = server.RegisterEndpoint("SinkReceiveStream", handler.HandleReceiveStream)
+	if err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+func (h *SinkHandler) mapFilesystem(fs *zfs.DatasetPath) (local *zfs.DatasetPath, err error) {
+	if fs == nil || fs.Empty() {
+		return nil, errors.New("filesystem must not be empty")
+	}
+	local = h.root.Copy()
+	local.Extend(fs)
+	return local, nil
+}
+
+func (h *SinkHandler) HandleFilesystemStateRequest(r *SinkFilesystemStateRequest, state *SinkFilesystemState) (err error) {
+
+	h.logger.Printf("handling filesystem state request: %#v", r)
+
+	local, err := h.mapFilesystem(r.Filesystem)
+	if err != nil {
+		return
+	}
+
+	states, err := zfs.ZFSListFilesystemState(h.ctx)
+	if err != nil {
+		return
+	}
+	s, exists := states[local.ToString()]
+	*state = SinkFilesystemState{Exists: exists, Placeholder: s.Placeholder}
+	if !exists || s.Placeholder {
+		return nil
+	}
+
+	state.Versions, err = zfs.ZFSListFilesystemVersions(h.ctx, local, nil)
+	return
+}
+
+func (h *SinkHandler) HandleReceiveRequest(r *SinkReceiveRequest, ok *bool) (err error) {
+
+	h.logger.Printf("handling receive request: %#v", r)
+
+	if _, err = h.mapFilesystem(r.Filesystem); err != nil {
+		return
+	}
+	h.pending = r
+	*ok = true
+	return
+}
+
+// Creates placeholders for the missing ancestors of local, except for the pool
+func (h *SinkHandler) createPlaceholders(local *zfs.DatasetPath, states map[string]zfs.FilesystemState) (err error) {
+	comps := strings.Split(local.ToString(), "/")
+	for i := 2; i < len(comps); i++ {
+		ancestor := strings.Join(comps[:i], "/")
+		if _, exists := states[ancestor]; exists {
+			continue
+		}
+		p, err := zfs.NewDatasetPath(ancestor)
+		if err != nil {
+			return err
+		}
+		h.logger.Printf("creating placeholder filesystem %s", ancestor)
+		if err = zfs.ZFSCreatePlaceholderFilesystem(h.ctx, p); err != nil {
+			return errors.Wrapf(err, "cannot create placeholder filesystem %s", ancestor)
+		}
+	}
+	return nil
+}
+
+func (h *SinkHandler) HandleReceiveStream(stream io.Reader, ok *bool) (err error) {
+
+	r := h.pending
+	h.pending = nil
+	if r == nil {
+		return errors.New("stream was not announced by a receive request")
+	}
+	h.logger.Printf("handling receive stream: %#v", r)
+
+	local, err := h.mapFilesystem(r.Filesystem)
+	if err != nil {
+		return
+	}
+
+	states, err := zfs.ZFSListFilesystemState(h.ctx)
+	if err != nil {
+		return
+	}
+	state, exists := states[local.ToString()]
+
+	args := []string{"-u"}
+	if !r.Incremental {
+		if exists && !state.Placeholder {
+			return errors.Errorf("refusing full stream, %s already exists", local.ToString())
+		}
+		if err = h.createPlaceholders(local, states); err != nil {
+			return
+		}
+		if state.Placeholder {
+			h.logger.Printf("receive with forced rollback to replace placeholder filesystem")
+			args = append(args, "-F")
+		}
+	}
+
+	h.logger.Printf("invoking zfs receive into %s", local.ToString())
+	if err = zfs.ZFSRecv(h.ctx, local, stream, h.recvProperties, args...); err != nil {
+		h.logger.Printf("error receiving stream: %s", err)
+		return
+	}
+	h.received = true
+
+	if !r.Incremental && !h.recvProperties.Contains("readonly") {
+		h.logger.Printf("configuring properties of received filesystem")
+		if err = zfs.ZFSSet(h.ctx, local, "readonly", "on"); err != nil {
+			return
+		}
+	}
+
+	*ok = true
+	return
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zrepl/zrepl/zfs"
+)
+
+// Reported by the control job's status endpoint
+type JobStatus struct {
+	// One of the JobPhase constants, replication also names the filesystem and step
+	Phase string
+	Tasks []TaskStatus `json:",omitempty"`
+	// Of the current or most recent replication run
+	Replication []FilesystemReplicationStatus `json:",omitempty"`
+	Supervisor  JobSupervisorStatus
+}
+
+const (
+	JobPhaseStarting     string = "starting"
+	JobPhaseIdle         string = "idle"
+	JobPhaseSnapshotting string = "snapshotting"
+	JobPhaseReplicating  string = "replicating"
+	JobPhasePruning      string = "pruning"
+	// Of jobs that only serve requests, e.g. the sink job
+	JobPhaseServing string = "serving"
+)
+
+type TaskStatus struct {
+	Name    string
+	Running bool
+	// Of the current run
+	Start time.Time `json:",omitempty"`
+	// Zero if the task is not scheduled, e.g. because it runs after another task
+	NextRun time.Time      `json:",omitempty"`
+	LastRun *TaskRunStatus `json:",omitempty"`
+}
+
+type TaskRunStatus struct {
+	Start  time.Time
+	Finish time.Time
+	// Empty if the run succeeded
+	Error string `json:",omitempty"`
+}
+
+// Implemented by jobs with more to report than their supervisor status
+type jobStatusReporter interface {
+	JobStatus() JobStatus
+}
+
+// The status of all jobs by name
+func (d *Daemon) Status() map[string]JobStatus {
+	status := make(map[string]JobStatus, len(d.supervisors))
+	for name, s := range d.supervisors {
+		js := JobStatus{Phase: JobPhaseServing}
+		if r, ok := s.job.(jobStatusReporter); ok {
+			js = r.JobStatus()
+		}
+		js.Supervisor = s.Status()
+		status[name] = js
+	}
+	return status
+}
+
+type FilesystemReplicationState string
+
+const (
+	FilesystemReplicationQueued      FilesystemReplicationState = "queued"
+	FilesystemReplicationReplicating FilesystemReplicationState = "replicating"
+	FilesystemReplicationDone        FilesystemReplicationState = "done"
+	FilesystemReplicationFailed      FilesystemReplicationState = "failed"
+)
+
+type FilesystemReplicationStatus struct {
+	// On the receiving side
+	Filesystem string
+	State      FilesystemReplicationState
+	// The current transfer of this run, starting at 1
+	Step  int `json:",omitempty"`
+	Steps int `json:",omitempty"`
+	// Received or sent in this run
+	BytesTransferred uint64
+	// Empty if the reason for the failure was only logged
+	Error string `json:",omitempty"`
+
+	// BytesTransferred by the previous steps
+	previousSteps uint64
+}
+
+// Tracks the filesystems of a replication run, safe for concurrent use.
+// The methods do nothing on a nil *replicationStatus.
+type replicationStatus struct {
+	mtx         sync.Mutex
+	filesystems []*FilesystemReplicationStatus
+}
+
+// Starts a new run, all filesystems are queued
+func (s *replicationStatus) reset(filesystems []*zfs.DatasetPath) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.filesystems = make([]*FilesystemReplicationStatus, len(filesystems))
+	for i, fs := range filesystems {
+		s.filesystems[i] = &FilesystemReplicationStatus{Filesystem: fs.ToString(), State: FilesystemReplicationQueued}
+	}
+	sort.Slice(s.filesystems, func(i, j int) bool {
+		return s.filesystems[i].Filesystem < s.filesystems[j].Filesystem
+	})
+}
+
+// Returns the status of fs, added if it was not queued by reset, s.mtx must be held
+func (s *replicationStatus) get(fs *zfs.DatasetPath) *FilesystemReplicationStatus {
+	name := fs.ToString()
+	for _, f := range s.filesystems {
+		if f.Filesystem == name {
+			return f
+		}
+	}
+	f := &FilesystemReplicationStatus{Filesystem: name}
+	s.filesystems = append(s.filesystems, f)
+	return f
+}
+
+func (s *replicationStatus) update(fs *zfs.DatasetPath, u func(f *FilesystemReplicationStatus)) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u(s.get(fs))
+}
+
+func (s *replicationStatus) start(fs *zfs.DatasetPath) {
+	s.update(fs, func(f *FilesystemReplicationStatus) {
+		f.State = FilesystemReplicationReplicating
+	})
+}
+
+// Adds n transfers to the steps of fs
+func (s *replicationStatus) addSteps(fs *zfs.DatasetPath, n int) {
+	s.update(fs, func(f *FilesystemReplicationStatus) {
+		f.Steps += n
+	})
+}
+
+// Starts the next transfer of fs, pass the returned step to progress
+func (s *replicationStatus) nextStep(fs *zfs.DatasetPath) (step int) {
+	s.update(fs, func(f *FilesystemReplicationStatus) {
+		f.previousSteps = f.BytesTransferred
+		f.Step++
+		step = f.Step
+	})
+	return step
+}
+
+// Sets the bytes transferred by step so far, ignored if fs moved on to another step
+func (s *replicationStatus) progress(fs *zfs.DatasetPath, step int, bytes uint64) {
+	s.update(fs, func(f *FilesystemReplicationStatus) {
+		if f.Step == step {
+			f.BytesTransferred = f.previousSteps + bytes
+		}
+	})
+}
+
+// err may be nil if the reason is only logged
+func (s *replicationStatus) fail(fs *zfs.DatasetPath, err error) {
+	s.update(fs, func(f *FilesystemReplicationStatus) {
+		f.State = FilesystemReplicationFailed
+		if err != nil {
+			f.Error = err.Error()
+		}
+	})
+}
+
+// Marks fs done, unless it failed
+func (s *replicationStatus) finish(fs *zfs.DatasetPath) {
+	s.update(fs, func(f *FilesystemReplicationStatus) {
+		if f.State != FilesystemReplicationFailed {
+			f.State = FilesystemReplicationDone
+		}
+	})
+}
+
+// The filesystem being replicated
+func (s *replicationStatus) current() (f FilesystemReplicationStatus, ok bool) {
+	if s == nil {
+		return f, false
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, f := range s.filesystems {
+		if f.State == FilesystemReplicationReplicating {
+			return *f, true
+		}
+	}
+	return f, false
+}
+
+func (s *replicationStatus) list() []FilesystemReplicationStatus {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	fss := make([]FilesystemReplicationStatus, len(s.filesystems))
+	for i, f := range s.filesystems {
+		fss[i] = *f
+	}
+	return fss
+}
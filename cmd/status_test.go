@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/jobrun"
+)
+
+func TestPullReportsReplicationStatus(t *testing.T) {
+	_, pull, done := replicationTest(t)
+	defer done()
+	pull.Status = &replicationStatus{}
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	fss := pull.Status.list()
+	if assert.Len(t, fss, 2) {
+		for i, name := range []string{"dst/backups/data", "dst/backups/data/child"} {
+			assert.Equal(t, name, fss[i].Filesystem)
+			assert.Equal(t, FilesystemReplicationDone, fss[i].State, name)
+			assert.Equal(t, 1, fss[i].Step, name)
+			assert.Equal(t, 1, fss[i].Steps, name)
+			assert.True(t, fss[i].BytesTransferred > 0, name)
+		}
+	}
+
+	// diverged, so the child is not replicated either
+	testSnapshot(t, "dst/backups/data", "local_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+	assert.Error(t, doPull(context.Background(), pull))
+
+	fss = pull.Status.list()
+	if assert.Len(t, fss, 2) {
+		assert.Equal(t, FilesystemReplicationFailed, fss[0].State)
+		assert.Equal(t, "diverged from remote filesystem src/data", fss[0].Error)
+		assert.Equal(t, 0, fss[0].Steps)
+		assert.Equal(t, uint64(0), fss[0].BytesTransferred)
+		assert.Equal(t, FilesystemReplicationQueued, fss[1].State)
+	}
+}
+
+func TestPullReportsFailedResume(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+	pull.Status = &replicationStatus{}
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	b.InterruptNextSendAfter = 1000
+	assert.Error(t, doPull(context.Background(), pull))
+
+	// the resumed transfer is interrupted, too
+	b.InterruptNextSendAfter = 1000
+	err := doPull(context.Background(), pull)
+	assert.Error(t, err)
+
+	fss := pull.Status.list()
+	if assert.Len(t, fss, 2) {
+		assert.Equal(t, FilesystemReplicationFailed, fss[0].State)
+		assert.NotEmpty(t, fss[0].Error)
+		assert.Contains(t, err.Error(), fss[0].Error)
+		assert.Equal(t, 1, fss[0].Steps)
+		assert.Equal(t, FilesystemReplicationQueued, fss[1].State)
+	}
+}
+
+func TestPullFailsIfAnyFilesystemFailed(t *testing.T) {
+	b, pull, done := replicationTest(t)
+	defer done()
+	pull.Status = &replicationStatus{}
+
+	assert.NoError(t, b.CreateFilesystem("src/data/a"))
+	assert.NoError(t, b.CreateFilesystem("src/data/b"))
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(context.Background(), pull))
+
+	// a fails, the filesystems replicated after it succeed
+	testSnapshot(t, "dst/backups/data/a", "local_1")
+	testSnapshot(t, "src/data", "zrepl_2")
+	err := doPull(context.Background(), pull)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "1 of 4 filesystems failed: dst/backups/data/a: "), err.Error())
+	}
+
+	states := make(map[string]FilesystemReplicationState)
+	for _, fs := range pull.Status.list() {
+		states[fs.Filesystem] = fs.State
+	}
+	assert.Equal(t, map[string]FilesystemReplicationState{
+		"dst/backups/data":       FilesystemReplicationDone,
+		"dst/backups/data/a":     FilesystemReplicationFailed,
+		"dst/backups/data/b":     FilesystemReplicationDone,
+		"dst/backups/data/child": FilesystemReplicationDone,
+	}, states)
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2"}, versionNames(t, "dst/backups/data/b"))
+}
+
+func TestReplicationStatusSteps(t *testing.T) {
+	s := &replicationStatus{}
+	fs := testPath(t, "pool/fs")
+	s.reset(nil)
+
+	s.start(fs)
+	s.addSteps(fs, 2)
+	step := s.nextStep(fs)
+	s.progress(fs, step, 100)
+	s.progress(fs, step, 300)
+	step = s.nextStep(fs)
+	s.progress(fs, step-1, 1000) // late report of the first step
+	s.progress(fs, step, 50)
+
+	current, ok := s.current()
+	assert.True(t, ok)
+	assert.Equal(t, FilesystemReplicationStatus{Filesystem: "pool/fs", State: FilesystemReplicationReplicating,
+		Step: 2, Steps: 2, BytesTransferred: 350, previousSteps: 300}, current)
+
+	s.finish(fs)
+	_, ok = s.current()
+	assert.False(t, ok)
+	assert.Equal(t, FilesystemReplicationDone, s.list()[0].State)
+
+	// nil does nothing
+	var n *replicationStatus
+	n.start(fs)
+	n.fail(fs, nil)
+	assert.Nil(t, n.list())
+}
+
+func TestJobTasksStatus(t *testing.T) {
+
+	var tasks jobTasks
+	assert.Equal(t, JobPhaseStarting, tasks.status().Phase)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	defer cancel()
+
+	replicating := make(chan struct{})
+	release := make(chan struct{})
+	pull := &jobTask{name: "pull", phase: JobPhaseReplicating, repeat: jobrun.NoRepeatStrategy{},
+		do: func(ctx context.Context) error {
+			fs := testPath(t, "pool/fs")
+			tasks.replication.reset(nil)
+			tasks.replication.start(fs)
+			tasks.replication.addSteps(fs, 3)
+			tasks.replication.nextStep(fs)
+			close(replicating)
+			<-release
+			tasks.replication.finish(fs)
+			return nil
+		}}
+	snap := &jobTask{name: "autosnap", phase: JobPhaseSnapshotting, next: pull,
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: time.Hour}, do: func(ctx context.Context) error { return nil }}
+
+	done := make(chan struct{})
+	go func() {
+		tasks.run(ctx, snap, time.Now())
+		close(done)
+	}()
+
+	<-replicating
+	s := tasks.status()
+	assert.Equal(t, "replicating pool/fs step 1/3", s.Phase)
+	if assert.Len(t, s.Tasks, 2) {
+		assert.Equal(t, "autosnap", s.Tasks[0].Name)
+		assert.False(t, s.Tasks[0].Running)
+		assert.NotNil(t, s.Tasks[0].LastRun)
+		assert.False(t, s.Tasks[0].NextRun.IsZero())
+		assert.Equal(t, "pull", s.Tasks[1].Name)
+		assert.True(t, s.Tasks[1].Running)
+		assert.Nil(t, s.Tasks[1].LastRun)
+	}
+
+	close(release)
+	for tasks.status().Phase != JobPhaseIdle {
+		time.Sleep(time.Millisecond)
+	}
+	s = tasks.status()
+	assert.Equal(t, FilesystemReplicationDone, s.Replication[0].State)
+	assert.Equal(t, "", s.Tasks[1].LastRun.Error)
+
+	cancel()
+	<-done
+}
+
+func TestPrintStatus(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	status := map[string]JobStatus{
+		"sink": {Phase: JobPhaseServing},
+		"push": {
+			Phase:      JobPhaseIdle,
+			Supervisor: JobSupervisorStatus{TaskPanics: 2, LastFailure: &JobFailure{Time: now, Task: "push", Reason: "panic: test"}},
+		},
+		"pull": {
+			Phase: "replicating pool/fs step 1/2",
+			Tasks: []TaskStatus{
+				{Name: "prune", LastRun: &TaskRunStatus{Start: now.Add(-time.Hour), Finish: now.Add(-time.Hour + time.Minute), Error: "no space"}},
+				{Name: "pull", Running: true, Start: now.Add(-10 * time.Second)},
+			},
+			Replication: []FilesystemReplicationStatus{
+				{Filesystem: "pool/fs", State: FilesystemReplicationReplicating, Step: 1, Steps: 2, BytesTransferred: 2048},
+			},
+			Supervisor: JobSupervisorStatus{Restarts: 1, LastFailure: &JobFailure{Time: now, Reason: "panic: test"}},
+		},
+	}
+
+	var out bytes.Buffer
+	printStatus(&out, status, now)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, []string{
+		"job pull: replicating pool/fs step 1/2",
+		"  restarted 1 times, last failure at 2017-01-01 12:00:00: panic: test",
+		"  task prune: last run at 2017-01-01 11:00:00 took 1m0s and failed: no space",
+		"  task pull: running for 10s",
+		"  filesystems:",
+		"    pool/fs: replicating step 1/2, 2.0 KiB transferred",
+		"job push: idle",
+		"  restarted 0 times, 2 task panics, last failure at 2017-01-01 12:00:00: task push: panic: test",
+		"job sink: serving",
+	}, lines)
+}
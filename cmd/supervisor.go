@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/zrepl/zrepl/util"
+)
+
+// A job that returned before the daemon shut down, or panicked, or one of its tasks that panicked
+type JobFailure struct {
+	Time time.Time
+	// Empty if the job itself failed
+	Task string `json:",omitempty"`
+	// The recovered panic value, or that the job returned
+	Reason string
+	// Of the panicking goroutine, empty if the job returned
+	Stack string
+}
+
+type JobSupervisorStatus struct {
+	// How often the job was restarted after a failure
+	Restarts int
+	// How often a task of the job panicked, the job keeps running and retries the task
+	TaskPanics  int
+	LastFailure *JobFailure
+}
+
+// Runs a job until ctx is done, restarting it with backoff if it returns early or panics.
+// Only panics of the goroutine running JobStart are recovered here,
+// jobTask recovers the panics of its goroutine and reports them with taskPanicked.
+// A panic in any other goroutine started by the job still crashes the daemon.
+type jobSupervisor struct {
+	job     Job
+	backoff *util.Backoff
+	// If the job ran at least this long before it failed, the backoff starts over
+	stableAfter time.Duration
+
+	mtx    sync.Mutex
+	status JobSupervisorStatus
+}
+
+func newJobSupervisor(job Job) *jobSupervisor {
+	return &jobSupervisor{
+		job:         job,
+		backoff:     util.NewBackoff(time.Second, 5*time.Minute, 0.2),
+		stableAfter: 10 * time.Minute,
+	}
+}
+
+func (s *jobSupervisor) Status() JobSupervisorStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.status
+}
+
+// Returns once ctx is done and the job returned
+func (s *jobSupervisor) run(ctx context.Context) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
+	ctx = context.WithValue(ctx, contextKeySupervisor, s)
+
+	for {
+		start := time.Now()
+		failure := s.runOnce(ctx)
+		if failure == nil {
+			return
+		}
+
+		if failure.Stack != "" {
+			log.Printf("job failed: %s\n%s", failure.Reason, failure.Stack)
+		} else {
+			log.Printf("job failed: %s", failure.Reason)
+		}
+
+		if failure.Time.Sub(start) >= s.stableAfter {
+			s.backoff.Reset()
+		}
+		delay := s.backoff.Next()
+
+		s.mtx.Lock()
+		s.status.Restarts++
+		s.status.LastFailure = failure
+		restarts := s.status.Restarts
+		s.mtx.Unlock()
+
+		log.Printf("restarting job in %s (restart #%d)", delay.Round(time.Millisecond), restarts)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Records a panic recovered by a task of the job, does nothing on a nil *jobSupervisor
+func (s *jobSupervisor) taskPanicked(failure *JobFailure) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status.TaskPanics++
+	s.status.LastFailure = failure
+}
+
+// Returns nil if the job returned because ctx is done.
+// The context passed to the job is cancelled once it returned or panicked,
+// so that goroutines it started do not outlive it, e.g. a server still listening.
+func (s *jobSupervisor) runOnce(ctx context.Context) (failure *JobFailure) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			failure = &JobFailure{Time: time.Now(), Reason: fmt.Sprintf("panic: %v", r), Stack: string(debug.Stack())}
+		}
+	}()
+	s.job.JobStart(runCtx)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return &JobFailure{Time: time.Now(), Reason: "job returned before daemon shutdown"}
+}
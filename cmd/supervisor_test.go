@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/jobrun"
+	"github.com/zrepl/zrepl/util"
+)
+
+// Panics in the first runs, returns early in the next ones and then runs until cancelled
+type failingJob struct {
+	panics, returns int
+
+	mtx  sync.Mutex
+	runs int
+	// closed once the job runs until cancelled
+	stable chan struct{}
+}
+
+func (j *failingJob) JobName() string { return "failing" }
+
+func (j *failingJob) JobStart(ctx context.Context) {
+	j.mtx.Lock()
+	j.runs++
+	run := j.runs
+	j.mtx.Unlock()
+	switch {
+	case run <= j.panics:
+		var m map[string]int
+		m["internal inconsistency"]++ // nil map
+	case run <= j.panics+j.returns:
+		return
+	default:
+		close(j.stable)
+		<-ctx.Done()
+	}
+}
+
+func testSupervisor(job Job) *jobSupervisor {
+	s := newJobSupervisor(job)
+	s.backoff = util.NewBackoff(time.Millisecond, 4*time.Millisecond, 0)
+	return s
+}
+
+func TestJobSupervisorRestartsFailedJob(t *testing.T) {
+	job := &failingJob{panics: 2, returns: 1, stable: make(chan struct{})}
+	s := testSupervisor(job)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-job.stable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not restarted")
+	}
+	status := s.Status()
+	assert.Equal(t, 3, status.Restarts)
+	if assert.NotNil(t, status.LastFailure) {
+		assert.Equal(t, "job returned before daemon shutdown", status.LastFailure.Reason)
+		assert.Equal(t, "", status.LastFailure.Stack)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not return after cancellation")
+	}
+	assert.Equal(t, 4, job.runs)
+}
+
+func TestJobSupervisorRecordsPanic(t *testing.T) {
+	job := &failingJob{panics: 1, stable: make(chan struct{})}
+	s := testSupervisor(job)
+	s.backoff = util.NewBackoff(time.Hour, time.Hour, 0)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	// the supervisor waits for the backoff, cancellation ends the wait
+	for s.Status().Restarts == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	failure := s.Status().LastFailure
+	if assert.NotNil(t, failure) {
+		assert.True(t, strings.HasPrefix(failure.Reason, "panic: "), failure.Reason)
+		assert.Contains(t, failure.Stack, "failingJob")
+	}
+	assert.Equal(t, 1, job.runs)
+}
+
+// Starts a goroutine serving until ctx is done, then panics in the first run
+type leakingJob struct {
+	runs int
+	// closed by the goroutine of the first run when it exits
+	served chan struct{}
+	// receives whether the goroutine of the first run exited before the second run started
+	restarted chan bool
+}
+
+func (j *leakingJob) JobName() string { return "leaking" }
+
+func (j *leakingJob) JobStart(ctx context.Context) {
+	j.runs++
+	if j.runs == 1 {
+		go func() {
+			<-ctx.Done()
+			close(j.served)
+		}()
+		panic("internal inconsistency")
+	}
+	select {
+	case <-j.served:
+		j.restarted <- true
+	case <-time.After(5 * time.Second):
+		j.restarted <- false
+	}
+	<-ctx.Done()
+}
+
+func TestJobSupervisorCancelsFailedJob(t *testing.T) {
+	job := &leakingJob{served: make(chan struct{}), restarted: make(chan bool, 1)}
+	s := testSupervisor(job)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	assert.True(t, <-job.restarted, "goroutines of the failed run must exit on its context")
+	cancel()
+	<-done
+	assert.Equal(t, 1, s.Status().Restarts)
+}
+
+// Runs a task that panics in its first run and succeeds in the next ones
+type panickingTaskJob struct {
+	tasks jobTasks
+	runs  int
+	// closed by the second run of the task
+	recovered chan struct{}
+}
+
+func (j *panickingTaskJob) JobName() string { return "panicking" }
+
+func (j *panickingTaskJob) JobStart(ctx context.Context) {
+	task := &jobTask{name: "snap", phase: JobPhaseSnapshotting, repeat: &jobrun.PeriodicRepeatStrategy{Interval: time.Millisecond},
+		do: func(ctx context.Context) error {
+			j.runs++
+			switch j.runs {
+			case 1:
+				var m map[string]int
+				m["internal inconsistency"]++ // nil map
+			case 2:
+				close(j.recovered)
+			}
+			return nil
+		}}
+	j.tasks.run(ctx, task, time.Now())
+}
+
+func TestJobSupervisorRecordsTaskPanic(t *testing.T) {
+	job := &panickingTaskJob{recovered: make(chan struct{})}
+	s := testSupervisor(job)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-job.recovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not run again after its panic")
+	}
+	cancel()
+	<-done
+
+	status := s.Status()
+	assert.Equal(t, 0, status.Restarts)
+	assert.Equal(t, 1, status.TaskPanics)
+	if assert.NotNil(t, status.LastFailure) {
+		assert.Equal(t, "snap", status.LastFailure.Task)
+		assert.True(t, strings.HasPrefix(status.LastFailure.Reason, "panic: "), status.LastFailure.Reason)
+		assert.Contains(t, status.LastFailure.Stack, "panickingTaskJob")
+	}
+}
+
+func TestJobTaskPanicFailsRun(t *testing.T) {
+	var mtx sync.Mutex
+	task := &jobTask{name: "snap", mtx: &mtx, do: func(ctx context.Context) error {
+		panic("internal inconsistency")
+	}}
+	err := task.JobDo(context.Background(), testLogger{t})
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "panic: internal inconsistency\n"), err.Error())
+		assert.Contains(t, err.Error(), "TestJobTaskPanicFailsRun")
+	}
+	// the mutex was released
+	mtx.Lock()
+}
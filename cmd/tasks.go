@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/jobrun"
+)
+
+// Initial delay before a failed task is retried, at most the job's interval
+const DEFAULT_RETRY_BACKOFF = time.Minute
+
+// A step of a job, e.g. snapshotting, replicating or pruning, run by a jobrun.JobRunner
+type jobTask struct {
+	name string
+	// Reported as the job's phase while the task runs, one of the JobPhase constants
+	phase  string
+	do     func(ctx context.Context) error
+	repeat jobrun.RepeatStrategy
+	// Added to the runner whenever this task finished, regardless of its result.
+	// Should not be rescheduled by its own repeat strategy.
+	next *jobTask
+	// Shared by the tasks of a job, they never run concurrently
+	mtx *sync.Mutex
+	// Of the job, nil if the tasks do not run under a supervisor
+	supervisor *jobSupervisor
+}
+
+func (t *jobTask) JobName() string {
+	return t.name
+}
+
+// A panic of the task fails its run, JobDo runs in a goroutine of the JobRunner
+// where the supervisor of the job cannot recover it.
+func (t *jobTask) JobDo(ctx context.Context, log jobrun.Logger) (err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			failure := &JobFailure{Time: time.Now(), Task: t.name, Reason: fmt.Sprintf("panic: %v", r), Stack: string(debug.Stack())}
+			t.supervisor.taskPanicked(failure)
+			err = errors.Errorf("%s\n%s", failure.Reason, failure.Stack)
+		}
+	}()
+	return t.do(context.WithValue(ctx, contextKeyLog, log))
+}
+
+func (t *jobTask) JobRepeatStrategy() jobrun.RepeatStrategy {
+	return t.repeat
+}
+
+// The tasks of a job
+type jobTasks struct {
+	// Updated by the replicating task, if any
+	replication replicationStatus
+
+	mtx    sync.Mutex
+	runner *jobrun.JobRunner // nil until run
+	first  *jobTask
+	// Handled by run, replaced whenever run starts
+	wakeups chan *taskWakeup
+	// Closed when run returns
+	stopped chan struct{}
+}
+
+// Runs first at firstDue and then as decided by its repeat strategy,
+// each run followed by the chain of next tasks.
+// Returns once ctx is done and no task is running anymore.
+func (j *jobTasks) run(ctx context.Context, first *jobTask, firstDue time.Time) {
+
+	log := ctx.Value(contextKeyLog).(Logger)
+
+	var mtx sync.Mutex
+	supervisor, _ := ctx.Value(contextKeySupervisor).(*jobSupervisor)
+	for t := first; t != nil; t = t.next {
+		t.mtx, t.supervisor = &mtx, supervisor
+	}
+
+	runner := jobrun.NewJobRunner(log)
+	events := make(chan jobrun.JobEvent)
+	runner.SetNotificationChannel(events)
+	runner.AddJobAt(first, firstDue)
+	wakeups, stopped := make(chan *taskWakeup), make(chan struct{})
+	defer close(stopped)
+	j.mtx.Lock()
+	j.runner, j.first, j.wakeups, j.stopped = runner, first, wakeups, stopped
+	j.mtx.Unlock()
+	go runner.Run(ctx)
+
+	queued := make(map[string]bool)
+	var waiting []*taskWakeup
+	for {
+		select {
+		case w := <-wakeups:
+			if j.startWakeup(runner, queued, w) {
+				log.Printf("woken up, %s is already running, waiting for it to finish", w.task.name)
+			} else {
+				log.Printf("woken up, running %s now", w.task.name)
+			}
+			waiting = append(waiting, w)
+
+		case e := <-events:
+			switch e := e.(type) {
+			case jobrun.JobFinishedEvent:
+				t := e.Job.(*jobTask)
+				if e.Result.Error != nil {
+					log.Printf("%s failed after %s: %s", t.name, e.Result.RunTime().Round(time.Millisecond), e.Result.Error)
+				} else {
+					log.Printf("%s finished after %s", t.name, e.Result.RunTime().Round(time.Millisecond))
+				}
+				queued[t.name] = false
+				if t.next != nil && !queued[t.next.name] && ctx.Err() == nil {
+					queued[t.next.name] = true
+					runner.AddJob(t.next)
+				}
+				waiting = finishWakeups(ctx, waiting, t, e.Result)
+			case jobrun.JobScheduledEvent:
+				log.Printf("next %s in %s", e.Job.JobName(), time.Until(e.DueAt).Round(time.Second))
+			case jobrun.JobrunFinishedEvent:
+				return
+			}
+		}
+	}
+}
+
+func (j *jobTasks) status() (s JobStatus) {
+
+	j.mtx.Lock()
+	runner := j.runner
+	j.mtx.Unlock()
+
+	s.Phase = JobPhaseIdle
+	if runner == nil {
+		s.Phase = JobPhaseStarting
+		return s
+	}
+
+	for _, m := range runner.Jobs() {
+		t := m.Job.(*jobTask)
+		ts := TaskStatus{Name: t.name, Running: m.Running}
+		if m.Running {
+			ts.Start = m.LastStart
+			s.Phase = t.phase
+			if fs, ok := j.replication.current(); ok && t.phase == JobPhaseReplicating {
+				s.Phase = fmt.Sprintf("%s %s step %d/%d", t.phase, fs.Filesystem, fs.Step, fs.Steps)
+			}
+		}
+		if m.Pending {
+			ts.NextRun = m.DueAt
+		}
+		if !m.LastResult.Finish.IsZero() {
+			ts.LastRun = &TaskRunStatus{Start: m.LastResult.Start, Finish: m.LastResult.Finish}
+			if m.LastResult.Error != nil {
+				ts.LastRun.Error = m.LastResult.Error.Error()
+			}
+		}
+		s.Tasks = append(s.Tasks, ts)
+	}
+	s.Replication = j.replication.list()
+	return s
+}
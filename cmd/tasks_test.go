@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/jobrun"
+)
+
+func TestRunJobTasks(t *testing.T) {
+
+	var mtx sync.Mutex
+	var order []string
+	running := 0
+	concurrent := false
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	defer cancel()
+
+	task := func(name string, err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			mtx.Lock()
+			running++
+			concurrent = concurrent || running > 1
+			order = append(order, name)
+			if len(order) >= 9 {
+				cancel()
+			}
+			mtx.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+			return err
+		}
+	}
+
+	prune := &jobTask{name: "prune", do: task("prune", nil), repeat: jobrun.NoRepeatStrategy{}}
+	repl := &jobTask{name: "repl", do: task("repl", errors.New("failed")), next: prune, repeat: jobrun.NoRepeatStrategy{}}
+	snap := &jobTask{name: "autosnap", do: task("autosnap", nil), next: repl,
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: 20 * time.Millisecond}}
+
+	done := make(chan struct{})
+	go func() {
+		var tasks jobTasks
+		tasks.run(ctx, snap, time.Now())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runJobTasks did not return after cancellation")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.False(t, concurrent, "tasks of a job must not run concurrently")
+	// every snapshot is followed by replication and pruning, even if replication fails
+	assert.Equal(t, []string{"autosnap", "repl", "prune", "autosnap", "repl", "prune"}, order[:6])
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/rpc"
+	"github.com/zrepl/zrepl/util"
+	"github.com/zrepl/zrepl/zfs"
+)
+
+func TestClientAddressMap(t *testing.T) {
+
+	m, err := parseClientAddressMap(map[string]string{
+		"10.0.0.0/8":  "rack",
+		"10.1.2.3":    "db1",
+		"10.1.0.0/16": "row1",
+		"fd00::/8":    "ula",
+		"::1":         "localhost6",
+	})
+	assert.NoError(t, err)
+
+	for ip, expected := range map[string]string{
+		"10.1.2.3":   "db1",
+		"10.1.2.4":   "row1",
+		"10.2.0.1":   "rack",
+		"fd00::1":    "ula",
+		"::1":        "localhost6",
+		"192.0.2.1":  "",
+		"2001:db8::": "",
+	} {
+		identity, ok := m.lookup(net.ParseIP(ip))
+		assert.Equal(t, expected != "", ok, ip)
+		assert.Equal(t, expected, identity, ip)
+	}
+
+	_, err = parseClientAddressMap(map[string]string{})
+	assert.Error(t, err)
+	_, err = parseClientAddressMap(map[string]string{"10.0.0.1": ""})
+	assert.Error(t, err)
+	_, err = parseClientAddressMap(map[string]string{"prod1.example.com": "prod1"})
+	assert.Error(t, err)
+	_, err = parseClientAddressMap(map[string]string{"10.0.0.0/33": "prod1"})
+	assert.Error(t, err)
+}
+
+func TestTCPListenerRejectsUnknownAddress(t *testing.T) {
+	clients, err := parseClientAddressMap(map[string]string{"192.0.2.1": "prod1"})
+	assert.NoError(t, err)
+	l, err := (&TCPListenerFactory{"127.0.0.1:0", clients}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := acceptAsync(l)
+	conn, err := (&TCPConnecter{Address: l.(*TCPListener).Addr().String()}).Connect(context.Background())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	a := <-accepted
+	assert.Error(t, a.err)
+	assert.True(t, isTemporaryError(a.err), "%v", a.err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "listener closes the connection")
+}
+
+// Serves the source side of the pull set up by replicationTest on listener
+// and pulls using connecter
+func testPullOverTransport(t *testing.T, listener AuthenticatedChannelListener, connecter RWCConnecter) {
+	_, pull, done := replicationTest(t)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	clientIdentities := make(chan string, 1)
+	go func() {
+		defer close(served)
+		serveSessions(ctx, pull.Log, listener, newSessionLimiter(0, 0), func(ctx context.Context, log Logger, rwc io.ReadWriteCloser, clientIdentity string) {
+			clientIdentities <- clientIdentity
+			handler := NewHandler(ctx, log, localPullACL{}, &PrefixVersionFilter{testSnapshotPrefix}, clientIdentity, zfs.SendFlags{}, util.BandwidthLimit{})
+			serveRPC(ctx, log, rwc, JobDebugSettings{}, rpc.Keepalive{}, func(server rpc.RPCServer) {
+				registerEndpoints(server, handler)
+			})
+		})
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	rwc, err := connecter.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(rwc)
+	pull.Remote = client
+
+	testSnapshot(t, "src/data", "zrepl_1")
+	assert.NoError(t, doPull(ctx, pull))
+	testSnapshot(t, "src/data", "zrepl_2")
+	assert.NoError(t, doPull(ctx, pull))
+	closeRPCWithTimeout(pull.Log, client, time.Second, "")
+	assert.NoError(t, rwc.Close())
+
+	assert.Equal(t, []string{"@zrepl_1", "@zrepl_2"}, versionNames(t, "dst/backups/data/child"))
+	assert.Equal(t, "testclient", <-clientIdentities)
+}
+
+func TestPullOverTCPTransport(t *testing.T) {
+	clients, err := parseClientAddressMap(map[string]string{"127.0.0.0/8": "testclient"})
+	assert.NoError(t, err)
+	l, err := (&TCPListenerFactory{"127.0.0.1:0", clients}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPullOverTransport(t, l, &TCPConnecter{Address: l.(*TCPListener).Addr().String()})
+}
+
+func TestPullOverUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zrepl-unix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sock")
+	f, err := parseUnixListenerFactory(JobParsingContext{}, map[string]interface{}{"path": path, "client_identity": "testclient"})
+	assert.NoError(t, err)
+	l, err := f.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPullOverTransport(t, l, &UnixConnecter{path})
+}
@@ -203,6 +203,13 @@ func doTestPrunePolicy(cmd *cobra.Command, args []string) {
 			}
 		}
 
+		if len(r.Skipped) > 0 {
+			fmt.Fprintf(&b, "\tskipped (held):\n")
+			for _, v := range r.Skipped {
+				fmt.Fprintf(&b, "\t- %s\n", v.Name)
+			}
+		}
+
 	}
 
 	log.Printf("pruning result:\n%s", b.String())
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+// Creates a CA in a temporary directory, its certificate is written to ca.crt
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	ca := &testCA{t: t, dir: dir}
+	ca.key, ca.cert = ca.issue(name, nil, nil)
+	ca.write(name+".crt", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+func (ca *testCA) write(name, pemType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// Self-signed CA certificate if parent is nil
+func (ca *testCA) issue(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return key, cert
+}
+
+// Writes a certificate with the given CN and its key, signed by ca
+func (ca *testCA) keyPair(caFile, cn string) tlsKeyPair {
+	key, cert := ca.issue(cn, ca.cert, ca.key)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return tlsKeyPair{
+		CA:   caFile,
+		Cert: ca.write(cn+".crt", "CERTIFICATE", cert.Raw),
+		Key:  ca.write(cn+".key", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func tlsTest(t *testing.T) (dir string, ca *testCA, listener *TLSListener, done func()) {
+	dir, err := ioutil.TempDir("", "zrepl-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca = newTestCA(t, dir, "ca")
+	f := &TLSListenerFactory{"127.0.0.1:0", ca.keyPair(filepath.Join(dir, "ca.crt"), "backuphost"), time.Second}
+	l, err := f.Listen()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	listener = l.(*TLSListener)
+	done = func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+type acceptResult struct {
+	rwc            io.ReadWriteCloser
+	clientIdentity string
+	err            error
+}
+
+func acceptAsync(l AuthenticatedChannelListener) <-chan acceptResult {
+	c := make(chan acceptResult, 1)
+	go func() {
+		rwc, clientIdentity, err := l.Accept()
+		c <- acceptResult{rwc, clientIdentity, err}
+	}()
+	return c
+}
+
+func TestTLSClientCertCNIsClientIdentity(t *testing.T) {
+	dir, ca, listener, done := tlsTest(t)
+	defer done()
+
+	connecter := &TLSConnecter{listener.Addr().String(), ca.keyPair(filepath.Join(dir, "ca.crt"), "prod1"), "backuphost", time.Second}
+
+	accepted := acceptAsync(listener)
+	client, err := connecter.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	a := <-accepted
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	defer a.rwc.Close()
+	assert.Equal(t, "prod1", a.clientIdentity)
+
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(a.rwc, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestTLSRejectsUnknownCAAndWrongServerCN(t *testing.T) {
+	dir, ca, listener, done := tlsTest(t)
+	defer done()
+	caFile := filepath.Join(dir, "ca.crt")
+
+	// client certificate of another CA: the listener stays usable
+	other := newTestCA(t, dir, "otherca")
+	connecter := &TLSConnecter{listener.Addr().String(), other.keyPair(caFile, "intruder"), "backuphost", time.Second}
+	accepted := acceptAsync(listener)
+	if client, err := connecter.Connect(context.Background()); err == nil {
+		// TLS 1.3 clients learn about the rejection with the first read
+		_, err = client.Read(make([]byte, 1))
+		assert.Error(t, err)
+		client.Close()
+	}
+	a := <-accepted
+	assert.Error(t, a.err)
+	assert.True(t, isTemporaryError(a.err), "%v", a.err)
+
+	// server certificate with unexpected CN
+	connecter = &TLSConnecter{listener.Addr().String(), ca.keyPair(caFile, "prod1"), "someotherhost", time.Second}
+	accepted = acceptAsync(listener)
+	_, err := connecter.Connect(context.Background())
+	assert.Error(t, err)
+	a = <-accepted
+	assert.Error(t, a.err)
+
+	connecter.ServerCN = "backuphost"
+	accepted = acceptAsync(listener)
+	client, err := connecter.Connect(context.Background())
+	assert.NoError(t, err)
+	a = <-accepted
+	assert.NoError(t, a.err)
+	assert.Equal(t, "prod1", a.clientIdentity)
+	client.Close()
+	a.rwc.Close()
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/zrepl/zrepl/jobrun"
+)
+
+// Where the cycle of a job starts when it is woken up
+type WakeupMode string
+
+const (
+	// The replication task and its follow-ups, or all tasks if the job does not replicate
+	WakeupModeReplicate WakeupMode = "replicate"
+	// All tasks, starting with taking snapshots
+	WakeupModeSnapshot WakeupMode = "snapshot"
+	// Only the prune task
+	WakeupModePruneOnly WakeupMode = "prune"
+)
+
+func parseWakeupMode(s string) (m WakeupMode, err error) {
+	switch WakeupMode(s) {
+	case "", WakeupModeReplicate:
+		return WakeupModeReplicate, nil
+	case WakeupModeSnapshot, WakeupModePruneOnly:
+		return WakeupMode(s), nil
+	}
+	return "", errors.Errorf("unknown wakeup mode '%s'", s)
+}
+
+// Reported by the control job's wakeup endpoint for every task of the cycle
+type TaskRunResult struct {
+	Name string
+	TaskRunStatus
+}
+
+// Implemented by jobs that can run their cycle on demand
+type jobWaker interface {
+	Wakeup(ctx context.Context, mode WakeupMode) ([]TaskRunResult, error)
+}
+
+// Runs the cycle of the job now and returns the results of its tasks once it finished.
+// Tasks that failed are reported in the results, not as err.
+func (d *Daemon) Wakeup(ctx context.Context, job string, mode WakeupMode) (results []TaskRunResult, err error) {
+	s, ok := d.supervisors[job]
+	if !ok {
+		return nil, errors.Errorf("job '%s' does not exist", job)
+	}
+	w, ok := s.job.(jobWaker)
+	if !ok {
+		return nil, errors.Errorf("job '%s' cannot be woken up", job)
+	}
+	return w.Wakeup(ctx, mode)
+}
+
+// A wakeup handled by jobTasks.run, waiting for the next run of task to finish
+type taskWakeup struct {
+	task *jobTask
+	// Whether to wait for the chain of next tasks, too
+	followUps bool
+	results   []TaskRunResult
+	// Closed once the last task finished
+	done chan struct{}
+}
+
+func (j *jobTasks) wakeup(ctx context.Context, mode WakeupMode) (results []TaskRunResult, err error) {
+
+	j.mtx.Lock()
+	first, wakeups, stopped := j.first, j.wakeups, j.stopped
+	j.mtx.Unlock()
+
+	if wakeups == nil {
+		return nil, errors.New("job has not started yet")
+	}
+
+	w := &taskWakeup{followUps: mode != WakeupModePruneOnly, done: make(chan struct{})}
+	for t := first; t != nil; t = t.next {
+		switch {
+		case mode == WakeupModeSnapshot && t == first && t.phase == JobPhaseSnapshotting,
+			mode == WakeupModeReplicate && t.phase == JobPhaseReplicating,
+			mode == WakeupModePruneOnly && t.phase == JobPhasePruning:
+			w.task = t
+		}
+	}
+	if w.task == nil && mode == WakeupModeReplicate {
+		w.task = first
+	}
+	if w.task == nil {
+		return nil, errors.Errorf("job has no task for wakeup mode '%s'", mode)
+	}
+
+	select {
+	case wakeups <- w:
+	case <-stopped:
+		return nil, errors.New("job stopped")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case <-w.done:
+		return w.results, nil
+	case <-stopped:
+		return w.results, errors.New("job stopped before the woken up tasks finished")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Makes w.task run now, called by run.
+// If it is already running, w waits for that run instead.
+func (j *jobTasks) startWakeup(runner *jobrun.JobRunner, queued map[string]bool, w *taskWakeup) (running bool) {
+
+	var m jobrun.JobMetadata
+	for _, jm := range runner.Jobs() {
+		if jm.Job == w.task {
+			m = jm
+		}
+	}
+
+	switch {
+	case m.Running:
+		return true
+	case m.Pending || queued[w.task.name]:
+		runner.Wakeup(w.task.name)
+	default:
+		queued[w.task.name] = true
+		runner.AddJob(w.task)
+	}
+	return false
+}
+
+// Records the result of t for the wakeups waiting for it and returns those still waiting
+func finishWakeups(ctx context.Context, waiting []*taskWakeup, t *jobTask, result jobrun.JobRunResult) (stillWaiting []*taskWakeup) {
+	for _, w := range waiting {
+		if w.task != t {
+			stillWaiting = append(stillWaiting, w)
+			continue
+		}
+		r := TaskRunResult{Name: t.name, TaskRunStatus: TaskRunStatus{Start: result.Start, Finish: result.Finish}}
+		if result.Error != nil {
+			r.Error = result.Error.Error()
+		}
+		w.results = append(w.results, r)
+		if w.followUps && t.next != nil && ctx.Err() == nil {
+			w.task = t.next
+			stillWaiting = append(stillWaiting, w)
+			continue
+		}
+		close(w.done)
+	}
+	return stillWaiting
+}
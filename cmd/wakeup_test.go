@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/jobrun"
+)
+
+func resultNames(results []TaskRunResult) (names []string) {
+	for _, r := range results {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// Retries until tasks.run started
+func wakeupStarted(t *testing.T, ctx context.Context, tasks *jobTasks, mode WakeupMode) ([]TaskRunResult, error) {
+	for {
+		results, err := tasks.wakeup(ctx, mode)
+		if err == nil || err.Error() != "job has not started yet" {
+			return results, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobTasksWakeup(t *testing.T) {
+
+	var tasks jobTasks
+	_, err := tasks.wakeup(context.Background(), WakeupModeReplicate)
+	assert.Error(t, err, "not started yet")
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	defer cancel()
+
+	var mtx sync.Mutex
+	runs := make(map[string]int)
+	count := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			runs[name]++
+			return err
+		}
+	}
+
+	prune := &jobTask{name: "prune", phase: JobPhasePruning, do: count("prune", nil), repeat: jobrun.NoRepeatStrategy{}}
+	push := &jobTask{name: "push", phase: JobPhaseReplicating, do: count("push", errors.New("sink unreachable")),
+		next: prune, repeat: jobrun.NoRepeatStrategy{}}
+	snap := &jobTask{name: "autosnap", phase: JobPhaseSnapshotting, do: count("autosnap", nil), next: push,
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: time.Hour}}
+
+	done := make(chan struct{})
+	go func() {
+		// the first cycle only runs when woken up
+		tasks.run(ctx, snap, time.Now().Add(time.Hour))
+		close(done)
+	}()
+
+	results, err := wakeupStarted(t, ctx, &tasks, WakeupModeReplicate)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"push", "prune"}, resultNames(results))
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "sink unreachable", results[0].Error)
+		assert.Equal(t, "", results[1].Error)
+		assert.False(t, results[0].Finish.Before(results[0].Start))
+	}
+
+	results, err = tasks.wakeup(ctx, WakeupModeSnapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"autosnap", "push", "prune"}, resultNames(results))
+
+	results, err = tasks.wakeup(ctx, WakeupModePruneOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prune"}, resultNames(results))
+
+	mtx.Lock()
+	assert.Equal(t, map[string]int{"autosnap": 1, "push": 2, "prune": 3}, runs)
+	mtx.Unlock()
+
+	cancel()
+	<-done
+	_, err = tasks.wakeup(context.Background(), WakeupModeReplicate)
+	assert.Error(t, err, "stopped")
+}
+
+func TestJobTasksWakeupWithoutSnapshots(t *testing.T) {
+
+	var tasks jobTasks
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, testLogger{t}))
+	defer cancel()
+
+	pull := &jobTask{name: "pull", phase: JobPhaseReplicating, do: func(context.Context) error { return nil },
+		repeat: &jobrun.PeriodicRepeatStrategy{Interval: time.Hour}}
+	done := make(chan struct{})
+	go func() {
+		tasks.run(ctx, pull, time.Now().Add(time.Hour))
+		close(done)
+	}()
+
+	results, err := wakeupStarted(t, ctx, &tasks, WakeupModeReplicate)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pull"}, resultNames(results))
+	_, err = tasks.wakeup(ctx, WakeupModeSnapshot)
+	assert.Error(t, err)
+	_, err = tasks.wakeup(ctx, WakeupModePruneOnly)
+	assert.Error(t, err)
+
+	cancel()
+	<-done
+}
+
+// Signals lines containing match
+type matchingLogger struct {
+	testLogger
+	match   string
+	matched chan struct{}
+	once    sync.Once
+}
+
+func (l *matchingLogger) Printf(format string, v ...interface{}) {
+	l.testLogger.Printf(format, v...)
+	if strings.Contains(fmt.Sprintf(format, v...), l.match) {
+		l.once.Do(func() { close(l.matched) })
+	}
+}
+
+func TestJobTasksWakeupWaitsForRunningTask(t *testing.T) {
+
+	var tasks jobTasks
+	log := &matchingLogger{testLogger: testLogger{t}, match: "already running", matched: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKeyLog, log))
+	defer cancel()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	runs := 0
+	pull := &jobTask{name: "pull", phase: JobPhaseReplicating, repeat: &jobrun.PeriodicRepeatStrategy{Interval: time.Hour},
+		do: func(context.Context) error {
+			runs++
+			if runs == 1 {
+				close(started)
+				<-release
+			}
+			return errors.New("remote unreachable")
+		}}
+	done := make(chan struct{})
+	go func() {
+		tasks.run(ctx, pull, time.Now())
+		close(done)
+	}()
+
+	<-started
+	type wakeupResult struct {
+		results []TaskRunResult
+		err     error
+	}
+	woken := make(chan wakeupResult)
+	go func() {
+		results, err := tasks.wakeup(ctx, WakeupModeReplicate)
+		woken <- wakeupResult{results, err}
+	}()
+	<-log.matched
+	close(release)
+
+	r := <-woken
+	assert.NoError(t, r.err)
+	if assert.Len(t, r.results, 1) {
+		assert.Equal(t, "remote unreachable", r.results[0].Error)
+	}
+	cancel()
+	<-done
+	assert.Equal(t, 1, runs, "the running run is reported, not another one")
+}
+
+func TestDaemonWakeupUnknownJob(t *testing.T) {
+	d := NewDaemon(&Config{})
+	d.supervisors["control"] = newJobSupervisor(&ControlJob{Name: "control"})
+	_, err := d.Wakeup(context.Background(), "nonexistent", WakeupModeReplicate)
+	assert.Error(t, err)
+	_, err = d.Wakeup(context.Background(), "control", WakeupModeReplicate)
+	assert.Error(t, err)
+
+	_, err = parseWakeupMode("everything")
+	assert.Error(t, err)
+	mode, err := parseWakeupMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, WakeupModeReplicate, mode)
+}
@@ -1,7 +1,9 @@
 package jobrun
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
@@ -21,7 +23,8 @@ func (l jobLogger) Printf(format string, v ...interface{}) {
 
 type Job interface {
 	JobName() string
-	JobDo(log Logger) (err error)
+	// ctx is cancelled when the JobRunner's context is done
+	JobDo(ctx context.Context, log Logger) (err error)
 	JobRepeatStrategy() RepeatStrategy
 }
 
@@ -49,6 +52,12 @@ type JobMetadata struct {
 	LastStart time.Time
 	LastError error
 	DueAt     time.Time
+	// Whether the job waits for DueAt
+	Pending bool
+	// Whether the job is currently running, LastStart is the start of the current run then
+	Running bool
+	// Of the last finished run, zero if the job has not finished yet
+	LastResult JobRunResult
 }
 
 type JobRunResult struct {
@@ -63,31 +72,82 @@ type RepeatStrategy interface {
 	ShouldReschedule(lastResult JobRunResult) (nextDue time.Time, reschedule bool)
 }
 
+type newJob struct {
+	job   Job
+	dueAt time.Time
+}
+
 type JobRunner struct {
 	logger           Logger
 	notificationChan chan<- JobEvent
-	newJobChan       chan Job
+	newJobChan       chan newJob
+	wakeupChan       chan string
 	finishedJobChan  chan JobMetadata
 	scheduleTimer    <-chan time.Time
-	pending          map[string]JobMetadata
-	running          map[string]JobMetadata
-	wait             sync.WaitGroup
+	// closed when Run returns
+	stopped chan struct{}
+
+	// protects pending, running and finished, which are only modified by Run,
+	// so Run itself only locks for writing
+	mtx     sync.Mutex
+	pending map[string]JobMetadata
+	running map[string]JobMetadata
+	// Jobs that were not rescheduled, kept for their LastResult until added again
+	finished map[string]JobMetadata
 }
 
 func NewJobRunner(logger Logger) *JobRunner {
 	return &JobRunner{
 		logger:          logger,
-		newJobChan:      make(chan Job),
+		newJobChan:      make(chan newJob),
+		wakeupChan:      make(chan string),
 		finishedJobChan: make(chan JobMetadata),
+		stopped:         make(chan struct{}),
 		pending:         make(map[string]JobMetadata),
 		running:         make(map[string]JobMetadata),
+		finished:        make(map[string]JobMetadata),
 	}
 }
 
+// The job runs as soon as possible
 func (r *JobRunner) AddJob(j Job) {
-	go func(j Job) {
-		r.newJobChan <- j
-	}(j)
+	r.AddJobAt(j, time.Time{})
+}
+
+// The job first runs at dueAt, afterwards as decided by its RepeatStrategy
+func (r *JobRunner) AddJobAt(j Job, dueAt time.Time) {
+	go func() {
+		select {
+		case r.newJobChan <- newJob{j, dueAt}:
+		case <-r.stopped:
+		}
+	}()
+}
+
+// Makes the pending job with the given name due now, does nothing if it is not pending
+func (r *JobRunner) Wakeup(name string) {
+	go func() {
+		select {
+		case r.wakeupChan <- name:
+		case <-r.stopped:
+		}
+	}()
+}
+
+// A snapshot of all jobs in the runner, sorted by name
+func (r *JobRunner) Jobs() []JobMetadata {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	jobs := make([]JobMetadata, 0, len(r.pending)+len(r.running)+len(r.finished))
+	for _, m := range []map[string]JobMetadata{r.pending, r.running, r.finished} {
+		for _, jm := range m {
+			jobs = append(jobs, jm)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].name < jobs[j].name
+	})
+	return jobs
 }
 
 func (r *JobRunner) SetNotificationChannel(c chan<- JobEvent) {
@@ -100,51 +160,97 @@ func (r *JobRunner) postEvent(n JobEvent) {
 	}
 }
 
-func (r *JobRunner) Run() {
+// Runs jobs until there are none left or ctx is done.
+// Once ctx is done, no more jobs are started and Run returns when the running ones have finished.
+// JobrunFinishedEvent is always the last event posted.
+func (r *JobRunner) Run(ctx context.Context) {
+
+	defer close(r.stopped)
+	defer r.postEvent(JobrunFinishedEvent{})
+
+	done := ctx.Done()
+	stopping := false
 
 loop:
 	select {
 
-	case j := <-r.newJobChan:
+	case nj := <-r.newJobChan:
 
+		j := nj.job
 		jn := j.JobName()
 
+		r.mtx.Lock()
 		_, jobPending := r.pending[jn]
 		_, jobRunning := r.running[jn]
 
 		if jobPending || jobRunning {
+			r.mtx.Unlock()
 			panic("job already in runner")
 		}
 
-		jm := JobMetadata{name: jn, Job: j}
+		jm, ok := r.finished[jn]
+		if !ok {
+			jm = JobMetadata{name: jn}
+		}
+		jm.Job, jm.DueAt, jm.Pending = j, nj.dueAt, true
 
+		delete(r.finished, jn)
 		r.pending[jn] = jm
+		r.mtx.Unlock()
 
 	case finishedJob := <-r.finishedJobChan:
 
-		delete(r.running, finishedJob.name)
-
 		res := JobRunResult{
 			Start:  finishedJob.LastStart,
 			Finish: time.Now(),
 			Error:  finishedJob.LastError,
 		}
-
-		r.postEvent(JobFinishedEvent{finishedJob.Job, res})
+		finishedJob.Running = false
+		finishedJob.LastResult = res
 
 		dueTime, resched := finishedJob.Job.JobRepeatStrategy().ShouldReschedule(res)
+
+		r.mtx.Lock()
+		delete(r.running, finishedJob.name)
 		if resched {
-			r.postEvent(JobScheduledEvent{finishedJob.Job, dueTime})
 			finishedJob.DueAt = dueTime
+			finishedJob.Pending = true
 			r.pending[finishedJob.name] = finishedJob
+		} else {
+			r.finished[finishedJob.name] = finishedJob
+		}
+		r.mtx.Unlock()
+
+		r.postEvent(JobFinishedEvent{finishedJob.Job, res})
+		if resched {
+			r.postEvent(JobScheduledEvent{finishedJob.Job, dueTime})
 		}
 
+	case name := <-r.wakeupChan:
+
+		jm, ok := r.pending[name]
+		if !ok {
+			goto loop
+		}
+		jm.DueAt = time.Now()
+		r.mtx.Lock()
+		r.pending[name] = jm
+		r.mtx.Unlock()
+
 	case <-r.scheduleTimer:
+
+	case <-done:
+		done = nil
+		stopping = true
 	}
 
-	if len(r.pending) == 0 && len(r.running) == 0 {
+	if len(r.running) == 0 && (stopping || len(r.pending) == 0) {
 		return
 	}
+	if stopping {
+		// wait for the running jobs
+		goto loop
+	}
 
 	// Find jobs to run
 	var now time.Time
@@ -155,6 +261,7 @@ loop:
 
 	nextJobDue := now.Add(time.Minute) // max(pending.Interval)
 
+	r.mtx.Lock()
 	for jobName, job := range r.pending {
 
 		if job.DueAt.After(now) {
@@ -167,16 +274,19 @@ loop:
 		// This job is due, run it
 
 		delete(r.pending, jobName)
-		r.running[jobName] = job
 		job.LastStart = now
+		job.Pending = false
+		job.Running = true
+		r.running[jobName] = job
 
 		go func(job JobMetadata) {
 			jobLog := jobLogger{r.logger, job.name}
-			job.LastError = job.Job.JobDo(jobLog)
+			job.LastError = job.Job.JobDo(ctx, jobLog)
 			r.finishedJobChan <- job
 		}(job)
 
 	}
+	r.mtx.Unlock()
 
 	if jobPending || len(r.running) > 0 {
 		r.postEvent(JobrunIdleEvent{nextJobDue})
@@ -184,6 +294,4 @@ loop:
 		goto loop
 	}
 
-	r.postEvent(JobrunFinishedEvent{})
-
 }
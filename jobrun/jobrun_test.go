@@ -0,0 +1,179 @@
+package jobrun
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, v ...interface{}) {
+	l.t.Logf(format, v...)
+}
+
+type countingJob struct {
+	name   string
+	repeat RepeatStrategy
+	err    error
+
+	mtx  sync.Mutex
+	runs int
+}
+
+func (j *countingJob) JobName() string { return j.name }
+
+func (j *countingJob) JobDo(ctx context.Context, log Logger) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.runs++
+	return j.err
+}
+
+func (j *countingJob) JobRepeatStrategy() RepeatStrategy { return j.repeat }
+
+func (j *countingJob) Runs() int {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.runs
+}
+
+func TestJobRunnerRunsUntilCancelled(t *testing.T) {
+
+	periodic := &countingJob{name: "periodic", repeat: &PeriodicRepeatStrategy{time.Millisecond}}
+	once := &countingJob{name: "once", repeat: NoRepeatStrategy{}, err: errors.New("failed")}
+
+	r := NewJobRunner(testLogger{t})
+	events := make(chan JobEvent)
+	r.SetNotificationChannel(events)
+	r.AddJob(periodic)
+	r.AddJobAt(once, time.Now().Add(5*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+
+	var onceResult *JobRunResult
+	var last JobEvent
+	for e := range events {
+		last = e
+		switch e := e.(type) {
+		case JobFinishedEvent:
+			if e.Job == once {
+				onceResult = &e.Result
+			}
+			if onceResult != nil && periodic.Runs() >= 3 {
+				cancel()
+			}
+		case JobrunFinishedEvent:
+			close(events)
+		}
+	}
+	<-done
+
+	assert.IsType(t, JobrunFinishedEvent{}, last)
+	if assert.NotNil(t, onceResult) {
+		assert.Equal(t, once.err, onceResult.Error)
+	}
+	assert.Equal(t, 1, once.Runs())
+
+	jobs := r.Jobs()
+	if assert.Equal(t, 2, len(jobs)) {
+		// sorted by name
+		assert.Equal(t, once, jobs[0].Job)
+		assert.False(t, jobs[0].Pending)
+		assert.Equal(t, once.err, jobs[0].LastResult.Error)
+
+		assert.Equal(t, periodic, jobs[1].Job)
+		assert.True(t, jobs[1].Pending)
+		assert.False(t, jobs[1].Running)
+		assert.NoError(t, jobs[1].LastResult.Error)
+		assert.False(t, jobs[1].LastResult.Finish.IsZero())
+	}
+}
+
+func TestJobRunnerReturnsWithoutJobs(t *testing.T) {
+	r := NewJobRunner(testLogger{t})
+	r.AddJob(&countingJob{name: "once", repeat: NoRepeatStrategy{}})
+	done := make(chan struct{})
+	go func() {
+		r.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runner did not return after its only job finished")
+	}
+	jobs := r.Jobs()
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.False(t, jobs[0].Pending || jobs[0].Running)
+		assert.False(t, jobs[0].LastResult.Finish.IsZero())
+	}
+}
+
+func TestBackoffRepeatStrategy(t *testing.T) {
+
+	s := NewBackoffRepeatStrategy(time.Hour, time.Minute)
+	now := time.Now()
+	failed := JobRunResult{Start: now.Add(-time.Second), Finish: now, Error: errors.New("failed")}
+
+	var last time.Duration
+	for i := 0; i < 10; i++ {
+		next, resched := s.ShouldReschedule(failed)
+		assert.True(t, resched)
+		delay := next.Sub(now)
+		assert.True(t, delay <= time.Hour, "delay %s exceeds interval", delay)
+		if i < 5 {
+			// jitter is less than the doubling
+			assert.True(t, delay > last, "delay %s not greater than %s", delay, last)
+		}
+		last = delay
+	}
+
+	// success resets the backoff and the job runs Interval after its last start
+	next, resched := s.ShouldReschedule(JobRunResult{Start: now, Finish: now})
+	assert.True(t, resched)
+	assert.Equal(t, now.Add(time.Hour), next)
+	next, _ = s.ShouldReschedule(failed)
+	assert.True(t, next.Sub(now) <= time.Minute)
+}
+
+func TestJobRunnerWakeup(t *testing.T) {
+
+	periodic := &countingJob{name: "periodic", repeat: &PeriodicRepeatStrategy{time.Hour}}
+
+	r := NewJobRunner(testLogger{t})
+	events := make(chan JobEvent)
+	r.SetNotificationChannel(events)
+	r.AddJob(periodic)
+	r.Wakeup("unknown")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	for e := range events {
+		switch e.(type) {
+		case JobScheduledEvent:
+			if periodic.Runs() == 1 {
+				r.Wakeup("periodic")
+			} else {
+				cancel()
+			}
+		case JobrunFinishedEvent:
+			close(events)
+		}
+	}
+	assert.Equal(t, 2, periodic.Runs())
+}
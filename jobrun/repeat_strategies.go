@@ -2,6 +2,8 @@ package jobrun
 
 import (
 	"time"
+
+	"github.com/zrepl/zrepl/util"
 )
 
 type NoRepeatStrategy struct{}
@@ -23,3 +25,22 @@ func (s *PeriodicRepeatStrategy) ShouldReschedule(lastResult JobRunResult) (next
 	}
 	return
 }
+
+// Like PeriodicRepeatStrategy, but a failed run is retried after an exponentially growing delay,
+// at most Interval after the failure. The delay starts over after a successful run.
+type BackoffRepeatStrategy struct {
+	Interval time.Duration
+	backoff  *util.Backoff
+}
+
+func NewBackoffRepeatStrategy(interval, initialBackoff time.Duration) *BackoffRepeatStrategy {
+	return &BackoffRepeatStrategy{interval, util.NewBackoff(initialBackoff, interval, 0.2)}
+}
+
+func (s *BackoffRepeatStrategy) ShouldReschedule(lastResult JobRunResult) (next time.Time, shouldRun bool) {
+	if lastResult.Error == nil {
+		s.backoff.Reset()
+		return (&PeriodicRepeatStrategy{s.Interval}).ShouldReschedule(lastResult)
+	}
+	return lastResult.Finish.Add(s.backoff.Next()), true
+}
@@ -2,20 +2,31 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
 type Client struct {
+	// The connection as passed to NewClient, closed if a call's context is done
+	rwc    io.ReadWriteCloser
 	ml     *MessageLayer
 	logger Logger
+	// The handshake is performed before the first request
+	handshakeDone bool
+	handshakeErr  error
+	features      Feature
+	compression   Compression
+	keepalive     Keepalive
 }
 
 func NewClient(rwc io.ReadWriteCloser) *Client {
-	return &Client{NewMessageLayer(rwc), noLogger{}}
+	return &Client{rwc: rwc, ml: NewMessageLayer(rwc), logger: noLogger{}}
 }
 
 func (c *Client) SetLogger(logger Logger, logMessageLayer bool) {
@@ -27,8 +38,46 @@ func (c *Client) SetLogger(logger Logger, logMessageLayer bool) {
 	}
 }
 
+// Request compression of octet bodies, only effective if the server supports it
+// (FeatureCompression), see Features.
+func (c *Client) SetCompression(compression Compression) {
+	c.compression = compression
+}
+
+// Must be called before the first request, the zero value (default) disables keepalive
+func (c *Client) SetKeepalive(k Keepalive) {
+	c.keepalive = k
+}
+
+func (c *Client) handshake() error {
+	if !c.handshakeDone {
+		c.logger.Printf("performing handshake")
+		c.ml.startKeepalive(c.keepalive)
+		c.features, c.handshakeErr = c.ml.HandshakeClient()
+		c.handshakeDone = true
+		if c.handshakeErr != nil {
+			c.ml.stopKeepalive()
+		} else {
+			c.logger.Printf("negotiated features: %s", c.features)
+			c.ml.keepaliveNegotiated(c.features)
+		}
+	}
+	return c.handshakeErr
+}
+
+// The features supported by both client and server.
+// Performs the handshake if no request has been made yet.
+func (c *Client) Features() (Feature, error) {
+	err := c.handshake()
+	return c.features, err
+}
+
 func (c *Client) Close() (err error) {
 
+	if err = c.handshake(); err != nil {
+		return
+	}
+
 	c.logger.Printf("sending Close request")
 	header := Header{
 		DataType: DataTypeControl,
@@ -78,7 +127,78 @@ func (c *Client) writeRequest(h *Header) (err error) {
 	return
 }
 
-func (c *Client) Call(endpoint string, in, out interface{}) (err error) {
+// Watches ctx during a call: the protocol cannot abort a request in flight,
+// hence the connection is torn down if ctx is done before the returned stop is called.
+// Returns the error the interrupted call should return instead of the connection's.
+func (c *Client) watchContext(ctx context.Context) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	stopped := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-stopped:
+			interrupted <- nil
+		case <-ctx.Done():
+			c.logger.Printf("context done during call, closing connection: %s", ctx.Err())
+			c.rwc.Close()
+			c.ml.stopKeepalive()
+			interrupted <- ctx.Err()
+		}
+	}()
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			close(stopped)
+			err = <-interrupted
+		})
+		return err
+	}
+}
+
+// An octet response body that stops watching the call's context once consumed
+type callBodyReader struct {
+	DataStatsReader
+	stop func() error
+}
+
+func (r *callBodyReader) Read(p []byte) (n int, err error) {
+	n, err = r.DataStatsReader.Read(p)
+	if err != nil {
+		if ctxErr := r.stop(); ctxErr != nil {
+			err = ctxErr
+		}
+	}
+	return n, err
+}
+
+// If in is an io.Reader, it is sent as DataTypeOctets body until EOF, which requires
+// an endpoint with an io.Reader input parameter on the server. Otherwise in is marshaled as JSON.
+//
+// If ctx is done before the response is received (for octet responses: read until EOF),
+// the connection is closed and Call (or reading the response) fails with ctx.Err().
+// The Client is unusable afterwards.
+func (c *Client) Call(ctx context.Context, endpoint string, in, out interface{}) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	stop := c.watchContext(ctx)
+	stopOnReturn := true
+	defer func() {
+		if !stopOnReturn {
+			return
+		}
+		if ctxErr := stop(); ctxErr != nil && err != nil {
+			err = ctxErr
+		}
+	}()
+
+	if err = c.handshake(); err != nil {
+		return err
+	}
 
 	var accept DataType
 	{
@@ -90,22 +210,39 @@ func (c *Client) Call(endpoint string, in, out interface{}) (err error) {
 		}
 	}
 
+	inReader, inIsReader := in.(io.Reader)
+
 	h := Header{
 		Endpoint: endpoint,
 		DataType: DataTypeMarshaledJSON,
 		Accept:   accept,
 	}
+	if inIsReader {
+		h.DataType = DataTypeOctets
+	}
+	if c.features.Has(FeatureCompression) {
+		h.Compression = c.compression
+	}
 
 	if err = c.writeRequest(&h); err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	if err = json.NewEncoder(&buf).Encode(in); err != nil {
-		panic("cannot encode 'in' parameter")
-	}
-	if err = c.ml.WriteData(&buf); err != nil {
-		return err
+	if inIsReader {
+		var stats DataStats
+		stats, err = c.ml.WriteData(inReader, h.Compression)
+		c.logger.Printf("sent octets: %v payload bytes, %v bytes on wire (compression %s)", stats.Payload, stats.Wire, h.Compression)
+		if err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err = json.NewEncoder(&buf).Encode(in); err != nil {
+			panic("cannot encode 'in' parameter")
+		}
+		if _, err = c.ml.WriteData(&buf, CompressionNone); err != nil {
+			return err
+		}
 	}
 
 	rh, err := c.recvResponse()
@@ -122,12 +259,17 @@ func (c *Client) Call(endpoint string, in, out interface{}) (err error) {
 	case DataTypeOctets:
 		c.logger.Printf("setting out to ML data reader")
 		outPtr := out.(*io.Reader) // we checked that above
-		*outPtr = rd
+		*outPtr = &callBodyReader{rd.(DataStatsReader), stop}
+		stopOnReturn = false
 	case DataTypeMarshaledJSON:
 		c.logger.Printf("decoding marshaled json")
-		if err = json.NewDecoder(c.ml.ReadData()).Decode(out); err != nil {
+		if err = json.NewDecoder(rd).Decode(out); err != nil {
 			return errors.Wrap(err, "cannot decode marshaled reply")
 		}
+		// Consume the rest of the reply, otherwise it is taken for the next response
+		if _, err = io.Copy(ioutil.Discard, rd); err != nil {
+			return err
+		}
 	default:
 		panic("implementation error") // accept is controlled by us
 	}
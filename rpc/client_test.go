@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallWithOctetRequestBody(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	server := NewServer(serverConn)
+	err := server.RegisterEndpoint("Upload", func(body io.Reader, n *int) error {
+		data, err := ioutil.ReadAll(body)
+		*n = len(data)
+		return err
+	})
+	assert.NoError(t, err)
+	err = server.RegisterEndpoint("Reject", func(body io.Reader, n *int) error {
+		return errors.New("rejected")
+	})
+	assert.NoError(t, err)
+	go server.Serve()
+
+	client := NewClient(clientConn)
+	client.SetCompression(CompressionGzip)
+	body := bytes.Repeat([]byte("zrepl"), MAX_PAYLOAD_LENGTH/3)
+
+	var n int
+	assert.NoError(t, client.Call(context.Background(), "Upload", bytes.NewReader(body), &n))
+	assert.Equal(t, len(body), n)
+
+	// the server discards the body the handler did not read
+	err = client.Call(context.Background(), "Reject", bytes.NewReader(body), &n)
+	var rpcErr *RPCError
+	assert.True(t, errors.As(err, &rpcErr), "%v", err)
+	err = client.Call(context.Background(), "Unknown", bytes.NewReader(body), &n)
+	assert.True(t, errors.As(err, &rpcErr), "%v", err)
+
+	assert.NoError(t, client.Call(context.Background(), "Upload", bytes.NewReader(body[:10]), &n))
+	assert.Equal(t, 10, n)
+}
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Compression of the frames of DataTypeOctets bodies.
+// Each frame is compressed on its own and sent with the codec's frame type
+// (e.g. FrameTypeDataGzip), frames that do not shrink are sent uncompressed.
+// Requires FeatureCompression on both sides of the connection.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("Compression(%d)", c)
+	}
+}
+
+func (c Compression) valid() bool {
+	return c <= CompressionGzip
+}
+
+// The byte counts of a message body
+type DataStats struct {
+	// Bytes of the body as read or written by the user of the MessageLayer
+	Payload uint64
+	// Bytes sent or received on the connection, including frame headers
+	Wire uint64
+}
+
+// Implemented by the io.Reader of DataTypeOctets responses
+type DataStatsReader interface {
+	io.Reader
+	DataStats() DataStats
+}
+
+// Type (1), NoMoreFrames (1) and PayloadLength (4) as written by writeFrame
+const frameHeaderLength = 6
+
+func (c Compression) frameType() FrameType {
+	switch c {
+	case CompressionGzip:
+		return FrameTypeDataGzip
+	default:
+		panic(fmt.Sprintf("no frame type for compression %s", c))
+	}
+}
+
+func compressFrame(c Compression, payload []byte) (compressed *bytes.Buffer, err error) {
+	switch c {
+	case CompressionGzip:
+		compressed = bytes.NewBuffer(make([]byte, 0, len(payload)))
+		w := gzip.NewWriter(compressed)
+		if _, err = w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		return compressed, nil
+	default:
+		return nil, errors.Errorf("unsupported compression %s", c)
+	}
+}
+
+// Whether frames of type t carry a compressed FrameTypeData payload
+func isCompressedDataFrame(t FrameType) bool {
+	return t == FrameTypeDataGzip
+}
+
+func decompressFrame(t FrameType, payload []byte) (data []byte, err error) {
+	if t != FrameTypeDataGzip {
+		return nil, errors.Errorf("unsupported compressed frame type %s", t)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decompress frame")
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(r, MAX_PAYLOAD_LENGTH+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decompress frame")
+	}
+	if len(data) > MAX_PAYLOAD_LENGTH {
+		return nil, errors.Errorf("decompressed frame exceeds max payload length")
+	}
+	return data, nil
+}
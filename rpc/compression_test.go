@@ -0,0 +1,60 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves the given body as the octet response of endpoint "Octets" and
+// returns the body and stats as received by a client using compression c
+func receiveOctets(t *testing.T, body []byte, c Compression) (received []byte, stats DataStats) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	server := NewServer(serverConn)
+	err := server.RegisterEndpoint("Octets", func(r *struct{}, out *io.Reader) error {
+		*out = bytes.NewReader(body)
+		return nil
+	})
+	assert.NoError(t, err)
+	go server.Serve()
+
+	client := NewClient(clientConn)
+	client.SetCompression(c)
+	var stream io.Reader
+	assert.NoError(t, client.Call(context.Background(), "Octets", &struct{}{}, &stream))
+	received, err = ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	return received, stream.(DataStatsReader).DataStats()
+}
+
+func TestCompressionOfOctets(t *testing.T) {
+	// spans multiple frames
+	body := bytes.Repeat([]byte("zrepl"), 2*MAX_PAYLOAD_LENGTH/5)
+
+	received, stats := receiveOctets(t, body, CompressionGzip)
+	assert.Equal(t, body, received)
+	assert.Equal(t, uint64(len(body)), stats.Payload)
+	assert.True(t, stats.Wire < stats.Payload/10, "wire %v payload %v", stats.Wire, stats.Payload)
+
+	received, stats = receiveOctets(t, body, CompressionNone)
+	assert.Equal(t, body, received)
+	assert.True(t, stats.Wire > stats.Payload)
+}
+
+func TestCompressionOfIncompressibleOctets(t *testing.T) {
+	body := make([]byte, MAX_PAYLOAD_LENGTH+1000)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	received, stats := receiveOctets(t, body, CompressionGzip)
+	assert.Equal(t, body, received)
+	// frames that do not shrink are sent uncompressed
+	assert.Equal(t, stats.Payload+2*frameHeaderLength, stats.Wire)
+}
@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -23,7 +26,13 @@ const (
 	FrameTypeHeader  FrameType = 0x01
 	FrameTypeData    FrameType = 0x02
 	FrameTypeTrailer FrameType = 0x03
-	FrameTypeRST     FrameType = 0xff
+	// Only the first frame on a connection, see Handshake
+	FrameTypeHandshake FrameType = 0x04
+	// A FrameTypeData payload compressed with CompressionGzip
+	FrameTypeDataGzip FrameType = 0x05
+	// Sent while idle if FeatureHeartbeat was negotiated, see Keepalive. Never has a payload.
+	FrameTypeHeartbeat FrameType = 0x06
+	FrameTypeRST       FrameType = 0xff
 )
 
 type Status uint64
@@ -39,6 +48,8 @@ const (
 type Header struct {
 	// Request-only
 	Endpoint string
+	// Request-only: compression of octet bodies, both of the request and the response
+	Compression Compression
 	// Data type of body (request & reply)
 	DataType DataType
 	// Request-only
@@ -76,10 +87,27 @@ type frameBridgingReader struct {
 	// < 0 means no limit
 	bytesLeftToLimit int
 	f                Frame
+	// The remainder of the most recent compressed frame
+	decompressed *bytes.Reader
+	stats        DataStats
 }
 
 func NewFrameBridgingReader(l *MessageLayer, frameType FrameType, totalLimit int) *frameBridgingReader {
-	return &frameBridgingReader{l, frameType, totalLimit, Frame{}}
+	return &frameBridgingReader{l: l, frameType: frameType, bytesLeftToLimit: totalLimit}
+}
+
+func (r *frameBridgingReader) DataStats() DataStats {
+	return r.stats
+}
+
+func (r *frameBridgingReader) readDecompressed(b []byte) (n int, err error) {
+	if r.bytesLeftToLimit > 0 && len(b) > r.bytesLeftToLimit {
+		b = b[:r.bytesLeftToLimit]
+	}
+	n, _ = r.decompressed.Read(b) // cannot fail, we checked Len() > 0
+	r.bytesLeftToLimit -= n
+	r.stats.Payload += uint64(n)
+	return n, nil
 }
 
 func (r *frameBridgingReader) Read(b []byte) (n int, err error) {
@@ -87,6 +115,9 @@ func (r *frameBridgingReader) Read(b []byte) (n int, err error) {
 		r.l.logger.Printf("limit reached, returning EOF")
 		return 0, io.EOF
 	}
+	if r.decompressed != nil && r.decompressed.Len() > 0 {
+		return r.readDecompressed(b)
+	}
 	log := r.l.logger
 	if r.f.PayloadLength == 0 {
 
@@ -103,8 +134,25 @@ func (r *frameBridgingReader) Read(b []byte) (n int, err error) {
 			return 0, err
 		}
 		log.Printf("read frame: %#v", r.f)
+		r.stats.Wire += frameHeaderLength + uint64(r.f.PayloadLength)
+		if r.frameType == FrameTypeData && isCompressedDataFrame(r.f.Type) {
+			payload := make([]byte, r.f.PayloadLength)
+			if _, err = io.ReadFull(r.l.rwc, payload); err != nil {
+				return 0, errors.WithStack(err)
+			}
+			r.f.PayloadLength = 0
+			data, err := decompressFrame(r.f.Type, payload)
+			if err != nil {
+				return 0, err
+			}
+			r.decompressed = bytes.NewReader(data)
+			if r.decompressed.Len() == 0 {
+				return 0, nil
+			}
+			return r.readDecompressed(b)
+		}
 		if r.f.Type != r.frameType {
-			err = errors.Wrapf(err, "expected frame of type %s", r.frameType)
+			err = errors.Errorf("expected frame of type %s, got %s", r.frameType, r.f.Type)
 			return 0, err
 		}
 	}
@@ -122,6 +170,7 @@ func (r *frameBridgingReader) Read(b []byte) (n int, err error) {
 	}
 	r.f.PayloadLength -= uint32(nb)
 	r.bytesLeftToLimit -= nb
+	r.stats.Payload += uint64(nb)
 	return nb, err // TODO io.EOF for maxread = r.f.PayloadLength ?
 }
 
@@ -132,10 +181,19 @@ type frameBridgingWriter struct {
 	bytesLeftToLimit int
 	payloadLength    int
 	buffer           *bytes.Buffer
+	// Only applied to FrameTypeData
+	compression Compression
+	stats       DataStats
 }
 
 func NewFrameBridgingWriter(l *MessageLayer, frameType FrameType, totalLimit int) *frameBridgingWriter {
-	return &frameBridgingWriter{l, frameType, totalLimit, MAX_PAYLOAD_LENGTH, bytes.NewBuffer(make([]byte, 0, MAX_PAYLOAD_LENGTH))}
+	return &frameBridgingWriter{
+		l:                l,
+		frameType:        frameType,
+		bytesLeftToLimit: totalLimit,
+		payloadLength:    MAX_PAYLOAD_LENGTH,
+		buffer:           bytes.NewBuffer(make([]byte, 0, MAX_PAYLOAD_LENGTH)),
+	}
 }
 
 func (w *frameBridgingWriter) Write(b []byte) (n int, err error) {
@@ -179,12 +237,31 @@ func (w *frameBridgingWriter) writeUntilFrameFull(b []byte) (n int, err error) {
 
 func (w *frameBridgingWriter) flush(nomore bool) (err error) {
 
-	f := Frame{w.frameType, nomore, uint32(w.buffer.Len())}
+	frameType, payload := w.frameType, w.buffer
+	w.stats.Payload += uint64(w.buffer.Len())
+	if w.compression != CompressionNone && w.frameType == FrameTypeData && w.buffer.Len() > 0 {
+		compressed, err := compressFrame(w.compression, w.buffer.Bytes())
+		if err != nil {
+			return err
+		}
+		if compressed.Len() < w.buffer.Len() {
+			frameType, payload = w.compression.frameType(), compressed
+		}
+	}
+
+	// Heartbeats must not be written in between the frame header and its payload
+	w.l.writeMtx.Lock()
+	defer w.l.writeMtx.Unlock()
+
+	f := Frame{frameType, nomore, uint32(payload.Len())}
 	err = w.l.writeFrame(f)
 	if err != nil {
-		errors.WithStack(err)
+		return errors.WithStack(err)
 	}
-	_, err = w.buffer.WriteTo(w.l.rwc)
+	w.stats.Wire += frameHeaderLength + uint64(payload.Len())
+	_, err = payload.WriteTo(w.l.rwc)
+	w.buffer.Reset()
+	w.l.lastWrite = time.Now()
 	return
 }
 
@@ -195,17 +272,26 @@ func (w *frameBridgingWriter) Close() (err error) {
 type MessageLayer struct {
 	rwc    io.ReadWriteCloser
 	logger Logger
+	// Serializes the frames of the user of the MessageLayer and the heartbeats
+	writeMtx sync.Mutex
+	// The time the most recent frame was written, protected by writeMtx
+	lastWrite time.Time
+	// nil if keepalive is disabled
+	keepalive *keepaliveState
 }
 
 func NewMessageLayer(rwc io.ReadWriteCloser) *MessageLayer {
-	return &MessageLayer{rwc, noLogger{}}
+	return &MessageLayer{rwc: rwc, logger: noLogger{}}
 }
 
 func (l *MessageLayer) Close() (err error) {
+	defer l.stopKeepalive()
 	f := Frame{
 		Type:         FrameTypeRST,
 		NoMoreFrames: true,
 	}
+	l.writeMtx.Lock()
+	defer l.writeMtx.Unlock()
 	if err = l.writeFrame(f); err != nil {
 		l.logger.Printf("error sending RST frame: %s", err)
 		return errors.WithStack(err)
@@ -215,7 +301,19 @@ func (l *MessageLayer) Close() (err error) {
 
 var RST error = fmt.Errorf("reset frame observed on connection")
 
+// Skips heartbeat frames
 func (l *MessageLayer) readFrame() (f Frame, err error) {
+	for {
+		if f, err = l.readFrameOrHeartbeat(); err != nil || f.Type != FrameTypeHeartbeat {
+			return
+		}
+		if f.PayloadLength != 0 {
+			return f, errors.Errorf("heartbeat frame with payload")
+		}
+	}
+}
+
+func (l *MessageLayer) readFrameOrHeartbeat() (f Frame, err error) {
 	err = binary.Read(l.rwc, binary.LittleEndian, &f.Type)
 	if err != nil {
 		err = errors.WithStack(err)
@@ -271,6 +369,10 @@ func (l *MessageLayer) ReadHeader() (h *Header, err error) {
 		l.logger.Printf("cannot decode marshaled header: %s", err)
 		return nil, err
 	}
+	// The decoder may stop before the trailing newline written by WriteHeader
+	if _, err = io.Copy(ioutil.Discard, r); err != nil {
+		return nil, err
+	}
 	return h, nil
 }
 
@@ -289,12 +391,13 @@ func (l *MessageLayer) ReadData() (reader io.Reader) {
 	return r
 }
 
-func (l *MessageLayer) WriteData(source io.Reader) (err error) {
+func (l *MessageLayer) WriteData(source io.Reader, compression Compression) (stats DataStats, err error) {
 	w := NewFrameBridgingWriter(l, FrameTypeData, -1)
+	w.compression = compression
 	_, err = io.Copy(w, source)
 	if err != nil {
-		return errors.WithStack(err)
+		return w.stats, errors.WithStack(err)
 	}
 	err = w.Close()
-	return
+	return w.stats, err
 }
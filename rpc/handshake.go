@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The version of the protocol spoken by this package.
+// Peers with a different version cannot talk to each other, additions that
+// older peers can do without are negotiated using Feature flags instead.
+const ProtocolVersion uint = 1
+
+// Optional capabilities of a peer, a set of flags
+type Feature uint64
+
+const (
+	FeatureCompression Feature = 1 << iota
+	FeatureResume
+	FeatureBookmarks
+	// FrameTypeHeartbeat, see Keepalive
+	FeatureHeartbeat
+)
+
+// The features this package's peers offer during the handshake
+var SupportedFeatures Feature = FeatureCompression | FeatureResume | FeatureBookmarks | FeatureHeartbeat
+
+var featureNames = []struct {
+	f    Feature
+	name string
+}{
+	{FeatureCompression, "compression"},
+	{FeatureResume, "resume"},
+	{FeatureBookmarks, "bookmarks"},
+	{FeatureHeartbeat, "heartbeat"},
+}
+
+func (f Feature) Has(o Feature) bool {
+	return f&o == o
+}
+
+func (f Feature) String() string {
+	names := make([]string, 0, len(featureNames))
+	for _, n := range featureNames {
+		if f.Has(n.f) {
+			names = append(names, n.name)
+			f &^= n.f
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint64(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// The first message on every connection, sent by the client, answered by the server
+type Handshake struct {
+	ProtocolVersion uint
+	Features        Feature
+}
+
+// The connection cannot be used because the handshake failed
+type HandshakeError struct {
+	Message string
+	// The handshake received from the peer, nil if there was none
+	Peer *Handshake
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake failed: %s", e.Message)
+}
+
+func localHandshake() *Handshake {
+	return &Handshake{ProtocolVersion, SupportedFeatures}
+}
+
+func checkPeerHandshake(peer *Handshake) error {
+	if peer.ProtocolVersion != ProtocolVersion {
+		return &HandshakeError{
+			fmt.Sprintf("incompatible protocol versions (local %d, peer %d), upgrade zrepl on both sides", ProtocolVersion, peer.ProtocolVersion),
+			peer,
+		}
+	}
+	return nil
+}
+
+func (l *MessageLayer) WriteHandshake(h *Handshake) (err error) {
+	w := NewFrameBridgingWriter(l, FrameTypeHandshake, MAX_HEADER_LENGTH)
+	if err = json.NewEncoder(w).Encode(h); err != nil {
+		return errors.Wrap(err, "cannot encode handshake")
+	}
+	return w.Close()
+}
+
+func (l *MessageLayer) ReadHandshake() (h *Handshake, err error) {
+	f, err := l.readFrame()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read handshake")
+	}
+	if f.Type != FrameTypeHandshake {
+		return nil, &HandshakeError{
+			fmt.Sprintf("peer sent frame of type %s instead of handshake, it likely runs an older version of zrepl", f.Type),
+			nil,
+		}
+	}
+	if f.PayloadLength > MAX_HEADER_LENGTH {
+		return nil, &HandshakeError{"handshake exceeds max length", nil}
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(l.rwc, int64(f.PayloadLength)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read handshake")
+	}
+	h = &Handshake{}
+	if err = json.Unmarshal(payload, h); err != nil {
+		return nil, &HandshakeError{fmt.Sprintf("cannot decode handshake: %s", err), nil}
+	}
+	return h, nil
+}
+
+// Performed by the client before its first request.
+// Returns the features supported by both sides.
+func (l *MessageLayer) HandshakeClient() (negotiated Feature, err error) {
+	if err = l.WriteHandshake(localHandshake()); err != nil {
+		return 0, err
+	}
+	peer, err := l.ReadHandshake()
+	if err != nil {
+		return 0, err
+	}
+	l.logger.Printf("peer handshake: %#v", peer)
+	if err = checkPeerHandshake(peer); err != nil {
+		return 0, err
+	}
+	return SupportedFeatures & peer.Features, nil
+}
+
+// Performed by the server before serving the first request.
+// The server answers with its own handshake even if the client's is incompatible,
+// so that the client can report the reason, too.
+// Returns the features supported by both sides.
+func (l *MessageLayer) HandshakeServer() (negotiated Feature, err error) {
+	peer, err := l.ReadHandshake()
+	if err != nil {
+		return 0, err
+	}
+	l.logger.Printf("peer handshake: %#v", peer)
+	if err = l.WriteHandshake(localHandshake()); err != nil {
+		return 0, err
+	}
+	if err = checkPeerHandshake(peer); err != nil {
+		return 0, err
+	}
+	return SupportedFeatures & peer.Features, nil
+}
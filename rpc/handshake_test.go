@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type echoRequest struct {
+	Message string
+}
+
+func TestHandshakeNegotiatesFeatures(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	server := NewServer(serverConn)
+	err := server.RegisterEndpoint("Echo", func(r *echoRequest, out *string) error {
+		*out = r.Message
+		return nil
+	})
+	assert.NoError(t, err)
+	go server.Serve()
+
+	client := NewClient(clientConn)
+	var out string
+	assert.NoError(t, client.Call(context.Background(), "Echo", &echoRequest{"hello"}, &out))
+	assert.Equal(t, "hello", out)
+
+	features, err := client.Features()
+	assert.NoError(t, err)
+	assert.Equal(t, SupportedFeatures, features)
+	assert.Equal(t, SupportedFeatures, server.Features())
+}
+
+func TestHandshakeIncompatibleVersion(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		peer := NewMessageLayer(peerConn)
+		if _, err := peer.ReadHandshake(); err != nil {
+			return
+		}
+		peer.WriteHandshake(&Handshake{ProtocolVersion + 1, SupportedFeatures})
+	}()
+
+	client := NewClient(clientConn)
+	var out string
+	err := client.Call(context.Background(), "Echo", &echoRequest{"hello"}, &out)
+	var handshakeErr *HandshakeError
+	assert.True(t, errors.As(err, &handshakeErr))
+	assert.Equal(t, ProtocolVersion+1, handshakeErr.Peer.ProtocolVersion)
+	assert.Equal(t, err, client.Close(), "the connection remains unusable")
+}
+
+func TestHandshakeMissing(t *testing.T) {
+	// net.Pipe is unbuffered, the server's RST would block
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+		// a client without handshake support starts with a request header
+		NewMessageLayer(clientConn).WriteHeader(&Header{Endpoint: "Echo", DataType: DataTypeMarshaledJSON})
+		ioutil.ReadAll(clientConn)
+	}()
+
+	serverConn, err := listener.Accept()
+	assert.NoError(t, err)
+	defer serverConn.Close()
+	err = NewServer(serverConn).Serve()
+	var handshakeErr *HandshakeError
+	assert.True(t, errors.As(err, &handshakeErr))
+	assert.Nil(t, handshakeErr.Peer)
+}
+
+func TestFeatureString(t *testing.T) {
+	assert.Equal(t, "none", Feature(0).String())
+	assert.Equal(t, "compression,bookmarks", (FeatureCompression | FeatureBookmarks).String())
+	assert.Equal(t, "resume,0x100", (FeatureResume | Feature(0x100)).String())
+}
@@ -0,0 +1,221 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Detection of peers that stopped responding, e.g. because of a stuck SSH session.
+// Both sides send a heartbeat frame if they have not written anything for HeartbeatInterval,
+// which the receiving MessageLayer skips. A side that waits for the peer for longer than
+// IdleTimeout without receiving anything (not even a heartbeat) tears the connection down,
+// the pending and all further operations fail with an *IdleTimeoutError.
+//
+// Heartbeats require FeatureHeartbeat on both sides. If the peer does not support it,
+// the idle timeout only applies to the handshake, because the peer might legitimately
+// stay silent during a long handler call.
+// The zero value disables keepalive.
+type Keepalive struct {
+	// 0 disables heartbeats
+	HeartbeatInterval time.Duration
+	// Should be several times the peer's HeartbeatInterval, 0 disables the timeout
+	IdleTimeout time.Duration
+}
+
+var DefaultKeepalive = Keepalive{
+	HeartbeatInterval: 10 * time.Second,
+	IdleTimeout:       1 * time.Minute,
+}
+
+type IdleTimeoutError struct {
+	Idle time.Duration
+}
+
+func (e *IdleTimeoutError) Error() string {
+	return fmt.Sprintf("connection torn down: peer did not send anything for %s (idle timeout)", e.Idle)
+}
+
+// Wraps the rwc of a MessageLayer to tear the connection down if an operation does not make progress
+type idleConn struct {
+	rwc     io.ReadWriteCloser
+	mtx     sync.Mutex
+	timeout time.Duration
+	// Reads and writes in progress
+	pending int
+	// The start or most recent progress of a read or write
+	lastActivity time.Time
+	timedOut     bool
+}
+
+func (c *idleConn) begin() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending++
+	c.lastActivity = time.Now()
+}
+
+func (c *idleConn) end(n int, err error) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending--
+	if n > 0 {
+		c.lastActivity = time.Now()
+	}
+	if err != nil && c.timedOut {
+		err = &IdleTimeoutError{c.timeout}
+	}
+	return n, err
+}
+
+func (c *idleConn) Read(p []byte) (n int, err error) {
+	c.begin()
+	return c.end(c.rwc.Read(p))
+}
+
+func (c *idleConn) Write(p []byte) (n int, err error) {
+	c.begin()
+	return c.end(c.rwc.Write(p))
+}
+
+func (c *idleConn) Close() error {
+	return c.rwc.Close()
+}
+
+func (c *idleConn) setTimeout(timeout time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.timeout = timeout
+}
+
+// Closes the underlying connection if an operation has been pending without progress for longer than the timeout
+func (c *idleConn) check(now time.Time) (timedOut bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.timedOut {
+		return true
+	}
+	if c.timeout == 0 || c.pending == 0 || now.Sub(c.lastActivity) <= c.timeout {
+		return false
+	}
+	c.timedOut = true
+	c.rwc.Close()
+	return true
+}
+
+// State of the keepalive goroutines of a MessageLayer
+type keepaliveState struct {
+	config   Keepalive
+	idle     *idleConn
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+var heartbeatFrame []byte
+
+func init() {
+	var buf bytes.Buffer
+	f := Frame{Type: FrameTypeHeartbeat}
+	binary.Write(&buf, binary.LittleEndian, &f.Type)
+	binary.Write(&buf, binary.LittleEndian, &f.NoMoreFrames)
+	binary.Write(&buf, binary.LittleEndian, &f.PayloadLength)
+	heartbeatFrame = buf.Bytes()
+}
+
+// Starts the idle timeout, heartbeats are started by keepaliveNegotiated.
+// Must be called before the first read or write on the MessageLayer.
+func (l *MessageLayer) startKeepalive(config Keepalive) {
+	if config.HeartbeatInterval == 0 && config.IdleTimeout == 0 {
+		return
+	}
+	k := &keepaliveState{
+		config: config,
+		stop:   make(chan struct{}),
+	}
+	l.keepalive = k
+	if config.IdleTimeout > 0 {
+		k.idle = &idleConn{rwc: l.rwc, timeout: config.IdleTimeout}
+		l.rwc = k.idle
+		go l.watchIdle(k)
+	}
+}
+
+// To be called after the handshake, with the negotiated features
+func (l *MessageLayer) keepaliveNegotiated(features Feature) {
+	k := l.keepalive
+	if k == nil {
+		return
+	}
+	if !features.Has(FeatureHeartbeat) {
+		if k.idle != nil {
+			l.logger.Printf("peer does not send heartbeats, disabling idle timeout")
+			k.idle.setTimeout(0)
+		}
+		return
+	}
+	if k.config.HeartbeatInterval > 0 {
+		go l.sendHeartbeats(k)
+	}
+}
+
+func (l *MessageLayer) stopKeepalive() {
+	if l.keepalive != nil {
+		l.keepalive.stopOnce.Do(func() { close(l.keepalive.stop) })
+	}
+}
+
+func (l *MessageLayer) watchIdle(k *keepaliveState) {
+	ticker := time.NewTicker(k.config.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case now := <-ticker.C:
+			if k.idle.check(now) {
+				l.logger.Printf("idle timeout exceeded, connection torn down")
+				return
+			}
+		}
+	}
+}
+
+// Heartbeats are sent on a separate goroutine because their write
+// blocks if the peer is stuck, which must not delay watchIdle.
+func (l *MessageLayer) sendHeartbeats(k *keepaliveState) {
+	ticker := time.NewTicker(k.config.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case now := <-ticker.C:
+			if err := l.sendHeartbeat(now, k); err != nil {
+				l.logger.Printf("error sending heartbeat: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// Sends a heartbeat frame if no frame has been written for the heartbeat interval.
+// Heartbeats do not count as activity of the idle timeout, otherwise they would mask a stuck peer.
+func (l *MessageLayer) sendHeartbeat(now time.Time, k *keepaliveState) (err error) {
+	l.writeMtx.Lock()
+	defer l.writeMtx.Unlock()
+	if now.Sub(l.lastWrite) < k.config.HeartbeatInterval {
+		return nil
+	}
+	w := l.rwc
+	if k.idle != nil {
+		w = k.idle.rwc
+	}
+	if _, err = w.Write(heartbeatFrame); err != nil {
+		return err
+	}
+	l.lastWrite = now
+	return nil
+}
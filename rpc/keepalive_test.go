@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKeepalive = Keepalive{HeartbeatInterval: 20 * time.Millisecond, IdleTimeout: 100 * time.Millisecond}
+
+func TestHeartbeatsKeepLongCallAlive(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	server := NewServer(serverConn)
+	server.SetKeepalive(testKeepalive)
+	err := server.RegisterEndpoint("Echo", func(r *echoRequest, out *string) error {
+		time.Sleep(3 * testKeepalive.IdleTimeout)
+		*out = r.Message
+		return nil
+	})
+	assert.NoError(t, err)
+	go server.Serve()
+
+	client := NewClient(clientConn)
+	client.SetKeepalive(testKeepalive)
+	var out string
+	assert.NoError(t, client.Call(context.Background(), "Echo", &echoRequest{"hello"}, &out))
+	assert.Equal(t, "hello", out)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer clientConn.Close()
+
+	// a stuck peer reads everything but never answers
+	go ioutil.ReadAll(peerConn)
+
+	client := NewClient(clientConn)
+	client.SetKeepalive(testKeepalive)
+	var out string
+	err := client.Call(context.Background(), "Echo", &echoRequest{"hello"}, &out)
+	var timeoutErr *IdleTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr), "%v", err)
+}
+
+func TestCallContextDone(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	server := NewServer(serverConn)
+	err := server.RegisterEndpoint("Echo", func(r *echoRequest, out *string) error {
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+	go server.Serve()
+
+	client := NewClient(clientConn)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var out string
+	assert.Equal(t, context.DeadlineExceeded, client.Call(ctx, "Echo", &echoRequest{"hello"}, &out))
+	assert.Equal(t, context.DeadlineExceeded, client.Call(ctx, "Echo", &echoRequest{"hello"}, &out))
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"context"
 	"github.com/pkg/errors"
 	"reflect"
 )
@@ -31,7 +32,11 @@ func (s *LocalRPC) Serve() (err error) {
 	return nil
 }
 
-func (c *LocalRPC) Call(endpoint string, in, out interface{}) (err error) {
+// ctx is only checked before calling the endpoint
+func (c *LocalRPC) Call(ctx context.Context, endpoint string, in, out interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	ep, ok := c.endpoints[endpoint]
 	if !ok {
 		panic("implementation error: implementation should not call local RPC without knowing which endpoints exist")
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"reflect"
 
 	"github.com/pkg/errors"
@@ -13,6 +14,9 @@ type Server struct {
 	ml        *MessageLayer
 	logger    Logger
 	endpoints map[string]endpointDescr
+	// Negotiated in the handshake at the start of Serve
+	features  Feature
+	keepalive Keepalive
 }
 
 type typeMap struct {
@@ -30,7 +34,7 @@ type MarshaledJSONEndpoint func(bodyJSON interface{})
 func NewServer(rwc io.ReadWriteCloser) *Server {
 	ml := NewMessageLayer(rwc)
 	return &Server{
-		ml, noLogger{}, make(map[string]endpointDescr),
+		ml: ml, logger: noLogger{}, endpoints: make(map[string]endpointDescr),
 	}
 }
 
@@ -43,6 +47,11 @@ func (s *Server) SetLogger(logger Logger, logMessageLayer bool) {
 	}
 }
 
+// Must be called before Serve, the zero value (default) disables keepalive
+func (s *Server) SetKeepalive(k Keepalive) {
+	s.keepalive = k
+}
+
 func (s *Server) RegisterEndpoint(name string, handler interface{}) (err error) {
 	_, ok := s.endpoints[name]
 	if ok {
@@ -90,8 +99,26 @@ var ProtocolError error = errors.New("protocol error, server should hang up")
 
 const ControlEndpointClose string = "Close"
 
+// The features supported by both client and server, valid once Serve has started
+func (s *Server) Features() Feature {
+	return s.features
+}
+
 // Serve the connection until failure or the client hangs up
 func (s *Server) Serve() (err error) {
+
+	s.logger.Printf("performing handshake")
+	s.ml.startKeepalive(s.keepalive)
+	if s.features, err = s.ml.HandshakeServer(); err != nil {
+		s.logger.Printf("handshake failed: %s", err)
+		if mlErr := s.ml.Close(); mlErr != nil {
+			s.logger.Printf("error closing MessageLayer: %+v", mlErr)
+		}
+		return err
+	}
+	s.logger.Printf("negotiated features: %s", s.features)
+	s.ml.keepaliveNegotiated(s.features)
+
 	for {
 
 		err = s.ServeRequest()
@@ -163,23 +190,37 @@ func (s *Server) ServeRequest() (err error) {
 		panic("implementation error")
 	}
 
+	dr := ml.ReadData()
+
+	// The request body must be consumed before the response is written,
+	// otherwise its frames are taken for the next request
+	writeEarlyResponse := func(r *Header) error {
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			return err
+		}
+		return s.writeResponse(r)
+	}
+
 	ep, ok := s.endpoints[h.Endpoint]
 	if !ok {
 		r := NewErrorHeader(StatusRequestError, "unregistered endpoint %s", h.Endpoint)
-		return s.writeResponse(r)
+		return writeEarlyResponse(r)
 	}
 
 	if ep.inType.proto != h.DataType {
 		r := NewErrorHeader(StatusRequestError, "wrong DataType for endpoint %s (has %s, you provided %s)", h.Endpoint, ep.inType.proto, h.DataType)
-		return s.writeResponse(r)
+		return writeEarlyResponse(r)
 	}
 
 	if ep.outType.proto != h.Accept {
 		r := NewErrorHeader(StatusRequestError, "wrong Accept for endpoint %s (has %s, you provided %s)", h.Endpoint, ep.outType.proto, h.Accept)
-		return s.writeResponse(r)
+		return writeEarlyResponse(r)
 	}
 
-	dr := ml.ReadData()
+	if !h.Compression.valid() || (h.Compression != CompressionNone && !s.features.Has(FeatureCompression)) {
+		r := NewErrorHeader(StatusRequestError, "unsupported compression %s", h.Compression)
+		return writeEarlyResponse(r)
+	}
 
 	// Determine inval
 	var inval reflect.Value
@@ -191,7 +232,7 @@ func (s *Server) ServeRequest() (err error) {
 		err = json.NewDecoder(dr).Decode(invalIface)
 		if err != nil {
 			r := NewErrorHeader(StatusRequestError, "cannot decode marshaled JSON: %s", err)
-			return s.writeResponse(r)
+			return writeEarlyResponse(r)
 		}
 	case DataTypeOctets:
 		// Take data as is
@@ -207,6 +248,11 @@ func (s *Server) ServeRequest() (err error) {
 	// Call the handler
 	errs := ep.handler.Call([]reflect.Value{inval, outval})
 
+	// Handlers may return before reading an octet body until EOF, e.g. on error
+	if _, err = io.Copy(ioutil.Discard, dr); err != nil {
+		return err
+	}
+
 	if !errs[0].IsNil() {
 		he := errs[0].Interface().(error) // we checked that before...
 		s.logger.Printf("handler returned error: %s", err)
@@ -234,22 +280,31 @@ func (s *Server) ServeRequest() (err error) {
 			return err
 		}
 
-		if err = ml.WriteData(&dataBuf); err != nil {
+		if _, err = ml.WriteData(&dataBuf, CompressionNone); err != nil {
 			return
 		}
 
 	case DataTypeOctets:
 
-		h := Header{
+		replyHeader := Header{
 			Error:    StatusOK,
 			DataType: DataTypeOctets,
 		}
-		if err = s.writeResponse(&h); err != nil {
+		if err = s.writeResponse(&replyHeader); err != nil {
 			return
 		}
 
 		reader := outval.Interface().(*io.Reader) // we checked that when adding the endpoint
-		err = ml.WriteData(*reader)
+		var stats DataStats
+		stats, err = ml.WriteData(*reader, h.Compression)
+		s.logger.Printf("sent octets: %v payload bytes, %v bytes on wire (compression %s)", stats.Payload, stats.Wire, h.Compression)
+		// Give the handler a chance to clean up, particularly if the stream
+		// was not read until EOF because writing to the client failed
+		if closer, ok := (*reader).(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				s.logger.Printf("error closing handler's reader: %s", closeErr)
+			}
+		}
 		if err != nil {
 			return err
 		}
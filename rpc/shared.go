@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
@@ -13,7 +14,7 @@ type RPCServer interface {
 }
 
 type RPCClient interface {
-	Call(endpoint string, in, out interface{}) (err error)
+	Call(ctx context.Context, endpoint string, in, out interface{}) (err error)
 	Close() (err error)
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/zrepl/zrepl/sshbytestream"
 	. "github.com/zrepl/zrepl/util"
@@ -48,7 +49,7 @@ func main() {
 
 	case *mode == "outgoing":
 
-		conn, err := sshbytestream.Outgoing(sshbytestream.SSHTransport{
+		conn, err := sshbytestream.Outgoing(context.Background(), sshbytestream.SSHTransport{
 			Host:         *outgoingHost,
 			User:         *outgoingUser,
 			IdentityFile: *outgoingIdentity,
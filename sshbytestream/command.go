@@ -0,0 +1,75 @@
+package sshbytestream
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"syscall"
+
+	"github.com/zrepl/zrepl/util"
+)
+
+// A byte stream to the stdin and stdout of a local process, e.g. ssh or a wrapper script.
+// Its stderr is included in the errors of Read and Close.
+type OutgoingCommandByteStream struct {
+	c *util.IOCommand
+}
+
+// Starts argv[0] with the arguments argv[1:].
+// If env is nil, the process inherits our environment.
+// The process is killed if ctx is done before the stream is closed.
+func OutgoingCommand(ctx context.Context, argv []string, env []string) (s OutgoingCommandByteStream, err error) {
+
+	if len(argv) == 0 {
+		return s, errors.New("command must not be empty")
+	}
+
+	if s.c, err = util.NewIOCommand(ctx, argv[0], argv[1:], util.IOCommandStderrBufSize); err != nil {
+		return
+	}
+	s.c.Cmd.Env = env
+
+	err = s.c.Start()
+	return
+}
+
+func (s OutgoingCommandByteStream) Read(p []byte) (n int, err error) {
+	return s.c.Read(p)
+}
+
+func (s OutgoingCommandByteStream) Write(p []byte) (n int, err error) {
+	return s.c.Write(p)
+}
+
+// Terminates the process with SIGTERM unless it exited already.
+// Processes that exit because of that SIGTERM, or with 128+SIGTERM as shells do, are not an error.
+func (s OutgoingCommandByteStream) Close() (err error) {
+	err = s.c.Close()
+	if err == nil || s.c.ExitResult == nil {
+		return
+	}
+	if s.c.ExitResult.WaitStatus.ExitStatus() == 128+int(syscall.SIGTERM) {
+		err = nil
+	}
+	return
+}
+
+// The exit status of the process if it exited on its own, -1 otherwise
+func (s OutgoingCommandByteStream) exitStatus() int {
+	if s.c.ExitResult == nil {
+		return -1
+	}
+	return s.c.ExitResult.WaitStatus.ExitStatus()
+}
+
+// Whether the exit status of a terminated ssh process means that it was terminated by us
+func sshTerminatedBySIGTERM(exitStatus int) bool {
+	switch runtime.GOOS {
+	case "linux": // OpenSSH_7.5p1, OpenSSL 1.1.0f  25 May 2017 Arch Linux
+		return exitStatus == 128+int(syscall.SIGTERM)
+	case "freebsd": // OpenSSH_7.2p2, OpenSSL 1.0.2k-freebsd  26 Jan 2017
+		return exitStatus == 255
+	default: // TODO
+		return false
+	}
+}
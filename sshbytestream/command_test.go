@@ -0,0 +1,93 @@
+package sshbytestream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/util"
+)
+
+func TestOutgoingCommandStream(t *testing.T) {
+	s, err := OutgoingCommand(context.Background(), []string{"cat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(s, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	assert.NoError(t, s.Close(), "termination by Close is not an error")
+}
+
+func TestOutgoingCommandStreamFailure(t *testing.T) {
+	s, err := OutgoingCommand(context.Background(), []string{"sh", "-c", "echo 'connection refused' >&2; exit 3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(s)
+	if assert.Error(t, err) {
+		assert.IsType(t, util.IOCommandError{}, err)
+		assert.Contains(t, err.Error(), "connection refused")
+	}
+	assert.Error(t, s.Close())
+
+	_, err = OutgoingCommand(context.Background(), []string{}, nil)
+	assert.Error(t, err)
+}
+
+func TestOutgoingCommandStreamShellExitOnSIGTERM(t *testing.T) {
+	// like a wrapper script that exits with 128+SIGTERM when terminated
+	s, err := OutgoingCommand(context.Background(), []string{"sh", "-c", "trap 'exit 143' TERM; echo ready; while :; do sleep 0.01; done"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(s, buf)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
+
+func TestOutgoingUsesSSHCommandAndTransportOpenCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zrepl-ssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// prints its command line and exits
+	stub := filepath.Join(dir, "ssh-stub")
+	if err := ioutil.WriteFile(stub, []byte("#!/bin/sh\necho \"$@\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Outgoing(context.Background(), SSHTransport{
+		Host:                 "prod1.example.com",
+		User:                 "root",
+		Port:                 2222,
+		IdentityFile:         "/etc/zrepl/ssh/prod1",
+		SSHCommand:           stub,
+		Options:              []string{"ProxyJump=bastion"},
+		TransportOpenCommand: []string{"zrepl", "stdinserver", "prod1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	_, err = io.Copy(&out, s)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	args := strings.Fields(out.String())
+	assert.Equal(t, []string{"-p", "2222"}, args[:2])
+	assert.Contains(t, args, "ProxyJump=bastion")
+	assert.Equal(t, []string{"root@prod1.example.com", "zrepl", "stdinserver", "prod1"}, args[len(args)-4:])
+}
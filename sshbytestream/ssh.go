@@ -1,13 +1,10 @@
 package sshbytestream
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"runtime"
-	"syscall"
-
-	"github.com/zrepl/zrepl/util"
 )
 
 type Error struct {
@@ -26,6 +23,8 @@ type SSHTransport struct {
 	IdentityFile string
 	SSHCommand   string
 	Options      []string
+	// The remote command, appended to the ssh command line
+	TransportOpenCommand []string
 }
 
 var SSHCommand string = "ssh"
@@ -57,13 +56,20 @@ func (f IncomingReadWriteCloser) Close() (err error) {
 }
 
 type OutgoingSSHByteStream struct {
-	c *util.IOCommand
+	OutgoingCommandByteStream
 }
 
-func Outgoing(remote SSHTransport) (s OutgoingSSHByteStream, err error) {
+// The ssh process is killed if ctx is done before the stream is closed.
+func Outgoing(ctx context.Context, remote SSHTransport) (s OutgoingSSHByteStream, err error) {
 
-	sshArgs := make([]string, 0, 2*len(remote.Options)+4)
-	sshArgs = append(sshArgs,
+	sshCommand := SSHCommand
+	if len(remote.SSHCommand) > 0 {
+		sshCommand = remote.SSHCommand
+	}
+
+	argv := make([]string, 0, 2*len(remote.Options)+len(remote.TransportOpenCommand)+10)
+	argv = append(argv,
+		sshCommand,
 		"-p", fmt.Sprintf("%d", remote.Port),
 		"-q",
 		"-i", remote.IdentityFile,
@@ -71,53 +77,22 @@ func Outgoing(remote SSHTransport) (s OutgoingSSHByteStream, err error) {
 		"-o", fmt.Sprintf("ServerAliveInterval=%d", SSHServerAliveInterval),
 	)
 	for _, option := range remote.Options {
-		sshArgs = append(sshArgs, "-o", option)
-	}
-	sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", remote.User, remote.Host))
-
-	var sshCommand = SSHCommand
-	if len(remote.SSHCommand) > 0 {
-		sshCommand = SSHCommand
-	}
-
-	if s.c, err = util.NewIOCommand(sshCommand, sshArgs, util.IOCommandStderrBufSize); err != nil {
-		return
+		argv = append(argv, "-o", option)
 	}
+	argv = append(argv, fmt.Sprintf("%s@%s", remote.User, remote.Host))
+	// Run on the remote host, usually overridden by the command of the authorized_keys entry
+	argv = append(argv, remote.TransportOpenCommand...)
 
 	// Clear environment of cmd, ssh shall not rely on SSH_AUTH_SOCK, etc.
-	s.c.Cmd.Env = []string{}
-
-	err = s.c.Start()
+	s.OutgoingCommandByteStream, err = OutgoingCommand(ctx, argv, []string{})
 	return
 }
 
-func (s OutgoingSSHByteStream) Read(p []byte) (n int, err error) {
-	return s.c.Read(p)
-}
-
-func (s OutgoingSSHByteStream) Write(p []byte) (n int, err error) {
-	return s.c.Write(p)
-}
-
 func (s OutgoingSSHByteStream) Close() (err error) {
-	err = s.c.Close()
-	if err == nil || s.c.ExitResult == nil {
-		return
-	}
-
-	// SSH catches SIGTERM and has different exit codes on different platforms
-	ws := s.c.ExitResult.WaitStatus
-	switch runtime.GOOS {
-	case "linux":
-		if ws.ExitStatus() == 128+int(syscall.SIGTERM) { // OpenSSH_7.5p1, OpenSSL 1.1.0f  25 May 2017 Arch Linux
-			err = nil
-		}
-	case "freebsd": // OpenSSH_7.2p2, OpenSSL 1.0.2k-freebsd  26 Jan 2017
-		if ws.ExitStatus() == 255 {
-			err = nil
-		}
-	default: // TODO
+	err = s.OutgoingCommandByteStream.Close()
+	if err != nil && sshTerminatedBySIGTERM(s.exitStatus()) {
+		// SSH catches SIGTERM and has different exit codes on different platforms
+		err = nil
 	}
-
 	return
 }
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Exponential backoff with jitter for retrying failed operations.
+// The delay doubles with every attempt, starting at Initial, up to Max.
+// A fraction of up to Jitter of each delay is subtracted at random,
+// so that clients failing at the same time do not retry in lockstep.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	// In [0, 1]
+	Jitter float64
+
+	attempt int
+	random  func() float64 // in [0, 1)
+}
+
+func NewBackoff(initial, max time.Duration, jitter float64) *Backoff {
+	return &Backoff{Initial: initial, Max: max, Jitter: jitter, random: rand.Float64}
+}
+
+// The delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := b.Max
+	if b.attempt < 62 && b.Initial<<uint(b.attempt) > 0 && b.Initial<<uint(b.attempt) < b.Max {
+		d = b.Initial << uint(b.attempt)
+	}
+	b.attempt++
+	return d - time.Duration(b.Jitter*b.random()*float64(d))
+}
+
+// The number of delays returned by Next since the last Reset
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Restarts at Initial, e.g. after a successful attempt
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
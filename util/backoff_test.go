@@ -0,0 +1,53 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second, 0)
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		delays = append(delays, b.Next())
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second,
+	}, delays)
+	assert.Equal(t, 6, b.Attempts())
+
+	b.Reset()
+	assert.Equal(t, time.Second, b.Next())
+}
+
+func TestBackoffDoesNotOverflow(t *testing.T) {
+	b := NewBackoff(time.Hour, 24*time.Hour, 0)
+	for i := 0; i < 100; i++ {
+		d := b.Next()
+		assert.True(t, d > 0 && d <= 24*time.Hour, "attempt %d: %s", i, d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := NewBackoff(time.Second, time.Minute, 0.5)
+
+	b.random = func() float64 { return 0 }
+	assert.Equal(t, time.Second, b.Next())
+	b.random = func() float64 { return 0.5 }
+	assert.Equal(t, 1500*time.Millisecond, b.Next(), "a quarter of 2s is subtracted")
+
+	b = NewBackoff(time.Second, time.Minute, 0.5)
+	for i := 0; i < 100; i++ {
+		nominal := b.Initial << uint(b.Attempts())
+		if nominal > b.Max {
+			nominal = b.Max
+		}
+		d := b.Next()
+		assert.True(t, d > nominal/2 && d <= nominal, "attempt %d: %s not in (%s, %s]", i, d, nominal/2, nominal)
+		if b.Attempts() > 10 {
+			b.Reset()
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package util
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -104,45 +108,107 @@ type IOProgress struct {
 
 type IOProgressCallback func(progress IOProgress)
 
+// Reports the bytes read through it to a callback, periodically and once reading ended.
+// Call Finish once the reader is not read anymore.
 type IOProgressWatcher struct {
-	Reader         io.Reader
-	callback       IOProgressCallback
-	callbackTicker *time.Ticker
-	progress       IOProgress
-	updateChannel  chan int
+	// Accessed atomically, first for 64-bit alignment
+	totalRX uint64
+
+	Reader io.Reader
+	// Closed on the first read error or by Finish
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Closed once the final callback returned
+	done chan struct{}
 }
 
 func (w *IOProgressWatcher) KickOff(callbackInterval time.Duration, callback IOProgressCallback) {
-	w.callback = callback
-	w.callbackTicker = time.NewTicker(callbackInterval)
-	w.updateChannel = make(chan int)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
 	go func() {
-	outer:
+		defer close(w.done)
+		ticker := time.NewTicker(callbackInterval)
+		defer ticker.Stop()
 		for {
 			select {
-			case newBytes, more := <-w.updateChannel:
-				w.progress.TotalRX += uint64(newBytes)
-				if !more {
-					w.callbackTicker.Stop()
-					break outer
-				}
-			case <-w.callbackTicker.C:
-				w.callback(w.progress)
+			case <-ticker.C:
+				callback(w.Progress())
+			case <-w.stop:
+				callback(w.Progress())
+				return
 			}
 		}
-		w.callback(w.progress)
 	}()
 }
 
+// The progress so far, safe for concurrent use
 func (w *IOProgressWatcher) Progress() IOProgress {
-	return w.progress
+	return IOProgress{TotalRX: atomic.LoadUint64(&w.totalRX)}
+}
+
+// Stops the callbacks and returns the final progress once the last callback returned.
+// Reads after Finish are not reported.
+func (w *IOProgressWatcher) Finish() IOProgress {
+	if w.done != nil {
+		w.stopOnce.Do(func() { close(w.stop) })
+		<-w.done
+	}
+	return w.Progress()
 }
 
 func (w *IOProgressWatcher) Read(p []byte) (n int, err error) {
 	n, err = w.Reader.Read(p)
-	w.updateChannel <- n
-	if err != nil {
-		close(w.updateChannel)
+	atomic.AddUint64(&w.totalRX, uint64(n))
+	if err != nil && w.stop != nil {
+		w.stopOnce.Do(func() { close(w.stop) })
 	}
 	return
 }
+
+// Formats progress reports for a transfer of an estimated size
+type TransferProgress struct {
+	// Estimated size of the transfer in bytes, 0 if unknown
+	Expected uint64
+	Start    time.Time
+}
+
+// Reports rx transferred bytes, e.g. "3.0 MiB of 12.0 MiB (25%), 1.0 MiB/s, ETA 9s"
+func (p TransferProgress) Format(rx uint64, now time.Time) string {
+	var b bytes.Buffer
+
+	b.WriteString(FormatBytes(rx))
+	if p.Expected > 0 {
+		percent := rx * 100 / p.Expected
+		if percent > 100 { // the estimate is not exact
+			percent = 100
+		}
+		fmt.Fprintf(&b, " of %s (%d%%)", FormatBytes(p.Expected), percent)
+	}
+
+	elapsed := now.Sub(p.Start).Seconds()
+	if elapsed <= 0 {
+		return b.String()
+	}
+	rate := float64(rx) / elapsed
+	fmt.Fprintf(&b, ", %s/s", FormatBytes(uint64(rate)))
+	if p.Expected > rx && rate > 0 {
+		eta := time.Duration(float64(p.Expected-rx) / rate * float64(time.Second))
+		fmt.Fprintf(&b, ", ETA %s", eta.Round(time.Second))
+	}
+
+	return b.String()
+}
+
+// Formats a number of bytes with binary prefixes, e.g. "1.5 KiB"
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
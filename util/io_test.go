@@ -0,0 +1,57 @@
+package util
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", FormatBytes(0))
+	assert.Equal(t, "1023 B", FormatBytes(1023))
+	assert.Equal(t, "1.5 KiB", FormatBytes(1536))
+	assert.Equal(t, "3.0 MiB", FormatBytes(3*1024*1024))
+	assert.Equal(t, "2.0 GiB", FormatBytes(2*1024*1024*1024))
+}
+
+func TestTransferProgressFormat(t *testing.T) {
+	start := time.Date(2017, 9, 20, 14, 0, 0, 0, time.UTC)
+	mib := uint64(1024 * 1024)
+
+	p := TransferProgress{Expected: 12 * mib, Start: start}
+	assert.Equal(t, "3.0 MiB of 12.0 MiB (25%), 1.0 MiB/s, ETA 9s", p.Format(3*mib, start.Add(3*time.Second)))
+	assert.Equal(t, "13.0 MiB of 12.0 MiB (100%), 1.0 MiB/s", p.Format(13*mib, start.Add(13*time.Second)))
+	assert.Equal(t, "0 B of 12.0 MiB (0%)", p.Format(0, start))
+
+	p = TransferProgress{Start: start}
+	assert.Equal(t, "3.0 MiB, 1.0 MiB/s", p.Format(3*mib, start.Add(3*time.Second)))
+}
+
+func TestIOProgressWatcherFinish(t *testing.T) {
+	var reports []uint64
+	w := &IOProgressWatcher{Reader: bytes.NewReader(make([]byte, 3000))}
+	w.KickOff(time.Hour, func(p IOProgress) {
+		reports = append(reports, p.TotalRX)
+	})
+	n, err := io.Copy(ioutil.Discard, w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3000), n)
+	assert.Equal(t, uint64(3000), w.Finish().TotalRX)
+	// the final callback returned before Finish
+	assert.Equal(t, []uint64{3000}, reports)
+	assert.Equal(t, uint64(3000), w.Finish().TotalRX)
+
+	// the reader is abandoned before it is exhausted
+	reports = nil
+	w = &IOProgressWatcher{Reader: bytes.NewReader(make([]byte, 3000))}
+	w.KickOff(time.Hour, func(p IOProgress) {
+		reports = append(reports, p.TotalRX)
+	})
+	_, err = w.Read(make([]byte, 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), w.Finish().TotalRX)
+	assert.Equal(t, []uint64{1000}, reports)
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// A bandwidth limit in bytes/s that may vary by the time of day
+type BandwidthLimit struct {
+	// Applies outside of all Schedule entries, 0 means unlimited
+	Default uint64
+	// The first entry that contains the current time of day applies
+	Schedule []BandwidthScheduleEntry
+}
+
+type BandwidthScheduleEntry struct {
+	// Time of day (local time) as offset from midnight.
+	// From > To wraps around midnight, From == To is the whole day.
+	From, To time.Duration
+	// 0 means unlimited
+	Limit uint64
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second +
+		time.Duration(t.Nanosecond())
+}
+
+func (e BandwidthScheduleEntry) Contains(t time.Time) bool {
+	d := timeOfDay(t)
+	switch {
+	case e.From < e.To:
+		return e.From <= d && d < e.To
+	case e.From > e.To:
+		return e.From <= d || d < e.To
+	default:
+		return true
+	}
+}
+
+// The limit in bytes/s at t, 0 means unlimited
+func (l BandwidthLimit) At(t time.Time) uint64 {
+	for _, e := range l.Schedule {
+		if e.Contains(t) {
+			return e.Limit
+		}
+	}
+	return l.Default
+}
+
+func (l BandwidthLimit) Unlimited() bool {
+	if l.Default != 0 {
+		return false
+	}
+	for _, e := range l.Schedule {
+		if e.Limit != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A token bucket limiting the rate at which its Reader can be read.
+// The bucket holds at most one second worth of bytes at the current limit.
+type RateLimitedReader struct {
+	ctx    context.Context
+	reader io.Reader
+	limit  BandwidthLimit
+	// Available bytes, negative while the reader is in debt
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+// Returns r itself if limit is unlimited.
+// Waiting for tokens is interrupted if ctx is done.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limit BandwidthLimit) io.Reader {
+	if limit.Unlimited() {
+		return r
+	}
+	return &RateLimitedReader{
+		ctx:    ctx,
+		reader: r,
+		limit:  limit,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *RateLimitedReader) Read(p []byte) (n int, err error) {
+
+	now := r.now()
+	rate := r.limit.At(now)
+	if rate == 0 {
+		r.tokens, r.last = 0, now
+		return r.reader.Read(p)
+	}
+
+	r.tokens += now.Sub(r.last).Seconds() * float64(rate)
+	if r.tokens > float64(rate) {
+		r.tokens = float64(rate)
+	}
+	r.last = now
+
+	if uint64(len(p)) > rate {
+		p = p[:rate]
+	}
+	n, err = r.reader.Read(p)
+	r.tokens -= float64(n)
+
+	if r.tokens < 0 {
+		wait := time.Duration(-r.tokens / float64(rate) * float64(time.Second))
+		if sleepErr := r.sleep(r.ctx, wait); sleepErr != nil && err == nil {
+			err = sleepErr
+		}
+	}
+	return n, err
+}
+
+// Closes the limited reader if it is an io.Closer
+func (r *RateLimitedReader) Close() error {
+	if c, ok := r.reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
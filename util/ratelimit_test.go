@@ -0,0 +1,77 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthLimitAt(t *testing.T) {
+	l := BandwidthLimit{
+		Default: 100,
+		Schedule: []BandwidthScheduleEntry{
+			{From: 8 * time.Hour, To: 18 * time.Hour, Limit: 10},
+			{From: 22 * time.Hour, To: 6 * time.Hour, Limit: 0},
+		},
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2017, 9, 20, h, m, 0, 0, time.Local)
+	}
+	assert.Equal(t, uint64(100), l.At(at(7, 59)))
+	assert.Equal(t, uint64(10), l.At(at(8, 0)))
+	assert.Equal(t, uint64(10), l.At(at(17, 59)))
+	assert.Equal(t, uint64(100), l.At(at(18, 0)))
+	assert.Equal(t, uint64(0), l.At(at(23, 0)))
+	assert.Equal(t, uint64(0), l.At(at(5, 0)))
+	assert.False(t, l.Unlimited())
+	assert.True(t, BandwidthLimit{}.Unlimited())
+}
+
+func TestRateLimitedReader(t *testing.T) {
+
+	clock := time.Date(2017, 9, 20, 12, 0, 0, 0, time.Local)
+
+	newReader := func(data []byte, limit BandwidthLimit) *RateLimitedReader {
+		r := NewRateLimitedReader(context.Background(), bytes.NewReader(data), limit).(*RateLimitedReader)
+		r.last = clock
+		r.now = func() time.Time { return clock }
+		r.sleep = func(ctx context.Context, d time.Duration) error {
+			clock = clock.Add(d)
+			return nil
+		}
+		return r
+	}
+
+	data := make([]byte, 10*1024)
+	start := clock
+	out, err := ioutil.ReadAll(newReader(data, BandwidthLimit{Default: 1024}))
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.Equal(t, 10*time.Second, clock.Sub(start))
+
+	// the schedule applies from 12:00 on
+	start = clock
+	limit := BandwidthLimit{
+		Default:  1024,
+		Schedule: []BandwidthScheduleEntry{{From: 12 * time.Hour, To: 13 * time.Hour, Limit: 2048}},
+	}
+	_, err = ioutil.ReadAll(newReader(data, limit))
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, clock.Sub(start))
+
+	r := NewRateLimitedReader(context.Background(), bytes.NewReader(data), BandwidthLimit{})
+	_, limited := r.(*RateLimitedReader)
+	assert.False(t, limited)
+}
+
+func TestRateLimitedReaderCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := NewRateLimitedReader(ctx, bytes.NewReader(make([]byte, 4096)), BandwidthLimit{Default: 1024})
+	_, err := ioutil.ReadAll(r)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,47 @@
+package zfs
+
+import (
+	"context"
+	"io"
+)
+
+// A Backend performs the operations on ZFS datasets that this package builds upon.
+//
+// The package-level ZFS* functions delegate to the current backend, which
+// forks ZFS_BINARY by default (ExecBackend). Tests may replace it with an
+// in-memory implementation (see package zfstest) using SetBackend.
+type Backend interface {
+	// Corresponds to `zfs list -H -p -o properties zfsArgs...`, one []string per output line
+	List(ctx context.Context, properties []string, zfsArgs ...string) (res [][]string, err error)
+	// A full stream of from if to is nil, an incremental stream from -> to otherwise
+	Send(ctx context.Context, fs *DatasetPath, from, to *FilesystemVersion, flags SendFlags) (stream io.Reader, err error)
+	// The estimated size of the stream Send would produce, corresponds to `zfs send -nvP`
+	SendDry(ctx context.Context, fs *DatasetPath, from, to *FilesystemVersion, flags SendFlags) (size uint64, err error)
+	SendResume(ctx context.Context, token string) (stream io.Reader, err error)
+	ParseResumeToken(ctx context.Context, token string) (t *ResumeToken, err error)
+	Recv(ctx context.Context, fs *DatasetPath, stream io.Reader, additionalArgs ...string) (err error)
+	RecvAbortResumable(ctx context.Context, fs *DatasetPath) (err error)
+	Set(ctx context.Context, fs *DatasetPath, prop, val string) (err error)
+	// dataset is a filesystem, volume, snapshot or bookmark name
+	Destroy(ctx context.Context, dataset string) (err error)
+	// Corresponds to `zfs rollback [-r]`
+	Rollback(ctx context.Context, fs *DatasetPath, v FilesystemVersion, destroyMoreRecent bool) (err error)
+	// Renames from and all its children
+	Rename(ctx context.Context, from, to *DatasetPath) (err error)
+	Snapshot(ctx context.Context, fs *DatasetPath, name string, recursive bool) (err error)
+	Bookmark(ctx context.Context, fs *DatasetPath, v FilesystemVersion, bookmark string) (err error)
+	CreatePlaceholderFilesystem(ctx context.Context, p *DatasetPath) (err error)
+	// Holding an already held tag and releasing a tag that is not held is not an error
+	Hold(ctx context.Context, fs *DatasetPath, v FilesystemVersion, tag string) (err error)
+	Release(ctx context.Context, fs *DatasetPath, v FilesystemVersion, tag string) (err error)
+	Holds(ctx context.Context, fs *DatasetPath, v FilesystemVersion) (tags []string, err error)
+}
+
+var backend Backend = ExecBackend{}
+
+// Replace the backend used by this package, returns the previous backend.
+// Not safe to call while any zfs operation is in progress.
+func SetBackend(b Backend) (previous Backend) {
+	previous, backend = backend, b
+	return
+}
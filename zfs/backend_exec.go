@@ -0,0 +1,431 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/zrepl/zrepl/util"
+)
+
+// The default Backend: forks ZFS_BINARY for every operation
+type ExecBackend struct{}
+
+func (b ExecBackend) List(ctx context.Context, properties []string, zfsArgs ...string) (res [][]string, err error) {
+
+	args := make([]string, 0, 4+len(zfsArgs))
+	args = append(args,
+		"list", "-H", "-p",
+		"-o", strings.Join(properties, ","))
+	args = append(args, zfsArgs...)
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, args...)
+
+	var stdout io.Reader
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	s := bufio.NewScanner(stdout)
+	buf := make([]byte, 1024)
+	s.Buffer(buf, 0)
+
+	res = make([][]string, 0)
+
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), "\t", len(properties))
+
+		if len(fields) != len(properties) {
+			err = errors.New("unexpected output")
+			return
+		}
+
+		res = append(res, fields)
+	}
+
+	if waitErr := cmd.Wait(); waitErr != nil {
+		err := ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: waitErr,
+		}
+		return nil, err
+	}
+	return
+}
+
+func (b ExecBackend) Send(ctx context.Context, fs *DatasetPath, from, to *FilesystemVersion, flags SendFlags) (stream io.Reader, err error) {
+
+	args := make([]string, 0)
+	args = append(args, "send")
+	args = append(args, flags.args()...)
+
+	if to == nil { // Initial
+		args = append(args, from.ToAbsPath(fs))
+	} else {
+		args = append(args, "-i", from.ToAbsPath(fs), to.ToAbsPath(fs))
+	}
+
+	stream, err = util.RunIOCommand(ctx, ZFS_BINARY, args...)
+
+	return
+}
+
+func (b ExecBackend) SendDry(ctx context.Context, fs *DatasetPath, from, to *FilesystemVersion, flags SendFlags) (size uint64, err error) {
+
+	args := make([]string, 0)
+	args = append(args, "send", "-n", "-v", "-P")
+	args = append(args, flags.args()...)
+
+	if to == nil { // Initial
+		args = append(args, from.ToAbsPath(fs))
+	} else {
+		args = append(args, "-i", from.ToAbsPath(fs), to.ToAbsPath(fs))
+	}
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, args...)
+
+	stdout := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stdout = stdout
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+		return 0, err
+	}
+
+	// Older ZFS versions write the dry run output to stderr
+	if size, err = parseSendDryOutput(stdout.Bytes()); err != nil {
+		return parseSendDryOutput(stderr.Bytes())
+	}
+	return size, nil
+}
+
+func (b ExecBackend) SendResume(ctx context.Context, token string) (stream io.Reader, err error) {
+	stream, err = util.RunIOCommand(ctx, ZFS_BINARY, "send", "-t", token)
+	return
+}
+
+func (b ExecBackend) Recv(ctx context.Context, fs *DatasetPath, stream io.Reader, additionalArgs ...string) (err error) {
+
+	args := make([]string, 0)
+	args = append(args, "recv")
+	if len(args) > 0 {
+		args = append(args, additionalArgs...)
+	}
+	args = append(args, fs.ToString())
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, args...)
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	// TODO report bug upstream
+	// Setup an unused stdout buffer.
+	// Otherwise, ZoL v0.6.5.9-1 3.16.0-4-amd64 writes the following error to stderr and exits with code 1
+	//   cannot receive new filesystem stream: invalid backup stream
+	stdout := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stdout = stdout
+
+	cmd.Stdin = stream
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+		return
+	}
+
+	return nil
+}
+
+func (b ExecBackend) RecvAbortResumable(ctx context.Context, fs *DatasetPath) (err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "recv", "-A", fs.ToString())
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Set(ctx context.Context, fs *DatasetPath, prop, val string) (err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "set", fmt.Sprintf("%s=%s", prop, val), fs.ToString())
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Destroy(ctx context.Context, dataset string) (err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "destroy", dataset)
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+
+}
+
+func (b ExecBackend) Rollback(ctx context.Context, fs *DatasetPath, v FilesystemVersion, destroyMoreRecent bool) (err error) {
+
+	args := []string{"rollback"}
+	if destroyMoreRecent {
+		args = append(args, "-r")
+	}
+	args = append(args, v.ToAbsPath(fs))
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, args...)
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Rename(ctx context.Context, from, to *DatasetPath) (err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "rename", from.ToString(), to.ToString())
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Snapshot(ctx context.Context, fs *DatasetPath, name string, recursive bool) (err error) {
+
+	snapname := fmt.Sprintf("%s@%s", fs.ToString(), name)
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "snapshot", snapname)
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+
+}
+
+func (b ExecBackend) Bookmark(ctx context.Context, fs *DatasetPath, v FilesystemVersion, bookmark string) (err error) {
+
+	bookmarkname := fmt.Sprintf("%s#%s", fs.ToString(), bookmark)
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "bookmark", v.ToAbsPath(fs), bookmarkname)
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+
+}
+
+func (b ExecBackend) CreatePlaceholderFilesystem(ctx context.Context, p *DatasetPath) (err error) {
+	v := PlaceholderPropertyValue(p)
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "create",
+		"-o", fmt.Sprintf("%s=%s", ZREPL_PLACEHOLDER_PROPERTY_NAME, v),
+		"-o", "mountpoint=none",
+		p.ToString())
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Hold(ctx context.Context, fs *DatasetPath, v FilesystemVersion, tag string) (err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "hold", tag, v.ToAbsPath(fs))
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		if bytes.Contains(stderr.Bytes(), []byte("tag already exists")) {
+			return nil
+		}
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Release(ctx context.Context, fs *DatasetPath, v FilesystemVersion, tag string) (err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "release", tag, v.ToAbsPath(fs))
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		if bytes.Contains(stderr.Bytes(), []byte("no such tag")) {
+			return nil
+		}
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+	}
+
+	return
+}
+
+func (b ExecBackend) Holds(ctx context.Context, fs *DatasetPath, v FilesystemVersion) (tags []string, err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "holds", "-H", v.ToAbsPath(fs))
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	var stdout []byte
+	if stdout, err = cmd.Output(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+		return
+	}
+
+	return parseHoldsOutput(stdout)
+}
+
+func (b ExecBackend) ParseResumeToken(ctx context.Context, token string) (t *ResumeToken, err error) {
+
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, "send", "-nvt", token)
+
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+	cmd.Stderr = stderr
+
+	var stdout []byte
+	if stdout, err = cmd.Output(); err != nil {
+		err = ZFSError{
+			Stderr:  stderr.Bytes(),
+			WaitErr: err,
+		}
+		return
+	}
+
+	return parseResumeTokenContents(stdout)
+}
@@ -2,10 +2,10 @@ package zfs
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
-	"os/exec"
 	"sort"
 )
 
@@ -189,15 +189,18 @@ const ZREPL_PLACEHOLDER_PROPERTY_NAME string = "zrepl:placeholder"
 
 type FilesystemState struct {
 	Placeholder bool
-	// TODO extend with resume token when that feature is finally added
+	// The receive_resume_token of the filesystem.
+	// Empty if there is no interrupted `zfs recv -s` that could be resumed.
+	ResumeToken string
 }
 
 // A somewhat efficient way to determine if a filesystem exists on this host.
 // Particularly useful if exists is called more than once (will only fork exec once and cache the result)
-func ZFSListFilesystemState() (localState map[string]FilesystemState, err error) {
+func ZFSListFilesystemState(ctx context.Context) (localState map[string]FilesystemState, err error) {
 
 	var actual [][]string
-	if actual, err = ZFSList([]string{"name", ZREPL_PLACEHOLDER_PROPERTY_NAME}, "-t", "filesystem,volume"); err != nil {
+	if actual, err = ZFSList(ctx, []string{"name", ZREPL_PLACEHOLDER_PROPERTY_NAME, "receive_resume_token"},
+		"-t", "filesystem,volume"); err != nil {
 		return
 	}
 
@@ -208,8 +211,13 @@ func ZFSListFilesystemState() (localState map[string]FilesystemState, err error)
 			fmt.Errorf("ZFS does not return parseable dataset path: %s", e[0])
 		}
 		placeholder, _ := IsPlaceholder(dp, e[1])
+		resumeToken := e[2]
+		if resumeToken == "-" {
+			resumeToken = ""
+		}
 		localState[e[0]] = FilesystemState{
 			placeholder,
+			resumeToken,
 		}
 	}
 	return
@@ -245,26 +253,6 @@ func IsPlaceholder(p *DatasetPath, placeholderPropertyValue string) (isPlacehold
 	return
 }
 
-func ZFSCreatePlaceholderFilesystem(p *DatasetPath) (err error) {
-	v := PlaceholderPropertyValue(p)
-	cmd := exec.Command(ZFS_BINARY, "create",
-		"-o", fmt.Sprintf("%s=%s", ZREPL_PLACEHOLDER_PROPERTY_NAME, v),
-		"-o", "mountpoint=none",
-		p.ToString())
-
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
-
-	if err = cmd.Start(); err != nil {
-		return err
-	}
-
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
-	}
-
-	return
+func ZFSCreatePlaceholderFilesystem(ctx context.Context, p *DatasetPath) (err error) {
+	return classifyError(backend.CreatePlaceholderFilesystem(ctx, p), p.ToString())
 }
@@ -0,0 +1,122 @@
+package zfs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The package-level ZFS* functions classify the stderr of a failed zfs
+// command into the error types below, callers test for them using errors.As.
+// Every type wraps the original ZFSError, errors.As(err, &ZFSError{}) succeeds
+// for classified errors, too. Unclassified failures are returned as ZFSError.
+// A zfs send that fails after it started fails the reads of its stream with a
+// util.IOCommandError, which is not classified.
+type classifiedError struct {
+	// The dataset the failed operation was performed on.
+	// If the operation did not name a single dataset, the first dataset name quoted in stderr, if any.
+	Path     string
+	ZFSError ZFSError
+}
+
+func (e classifiedError) Unwrap() error {
+	return e.ZFSError
+}
+
+func (e classifiedError) stderr() string {
+	return strings.TrimSpace(string(e.ZFSError.Stderr))
+}
+
+type DatasetDoesNotExistError struct{ classifiedError }
+
+func (e *DatasetDoesNotExistError) Error() string {
+	return fmt.Sprintf("%s does not exist: %s", e.Path, e.stderr())
+}
+
+// The dataset is held (zfs hold) or otherwise in use
+type DatasetBusyError struct{ classifiedError }
+
+func (e *DatasetBusyError) Error() string {
+	return fmt.Sprintf("%s is busy: %s", e.Path, e.stderr())
+}
+
+// The snapshot cannot be destroyed because clones were created from it
+type HasClonesError struct{ classifiedError }
+
+func (e *HasClonesError) Error() string {
+	return fmt.Sprintf("%s has dependent clones: %s", e.Path, e.stderr())
+}
+
+// The pool is full or a quota would be exceeded
+type OutOfSpaceError struct{ classifiedError }
+
+func (e *OutOfSpaceError) Error() string {
+	return fmt.Sprintf("out of space on %s: %s", e.Path, e.stderr())
+}
+
+type PermissionDeniedError struct{ classifiedError }
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied on %s: %s", e.Path, e.stderr())
+}
+
+// zfs recv rejected the stream because it is corrupt or truncated
+type StreamInvalidError struct{ classifiedError }
+
+func (e *StreamInvalidError) Error() string {
+	return fmt.Sprintf("invalid stream for %s: %s", e.Path, e.stderr())
+}
+
+// An incremental zfs recv failed because the destination was modified since its most recent snapshot
+type DestinationModifiedError struct{ classifiedError }
+
+func (e *DestinationModifiedError) Error() string {
+	return fmt.Sprintf("%s was modified since its most recent snapshot: %s", e.Path, e.stderr())
+}
+
+// Checked in order, the first class with a matching (lowercase) stderr substring wins
+var errorClasses = []struct {
+	substrings []string
+	make       func(c classifiedError) error
+}{
+	{[]string{"has been modified"},
+		func(c classifiedError) error { return &DestinationModifiedError{c} }},
+	{[]string{"invalid stream", "invalid backup stream", "checksum mismatch", "incomplete stream"},
+		func(c classifiedError) error { return &StreamInvalidError{c} }},
+	{[]string{"permission denied"},
+		func(c classifiedError) error { return &PermissionDeniedError{c} }},
+	{[]string{"out of space", "no space left", "quota exceeded"},
+		func(c classifiedError) error { return &OutOfSpaceError{c} }},
+	{[]string{"has dependent clones"},
+		func(c classifiedError) error { return &HasClonesError{c} }},
+	{[]string{"is busy"},
+		func(c classifiedError) error { return &DatasetBusyError{c} }},
+	{[]string{"does not exist", "no longer exists", "could not find any snapshots"},
+		func(c classifiedError) error { return &DatasetDoesNotExistError{c} }},
+}
+
+var quotedDatasetRegexp = regexp.MustCompile(`'([^'\s]+)'`)
+
+// Returns err unchanged if it is not a ZFSError or its stderr is not recognized.
+// path is the dataset the operation was performed on, empty if there is no single one.
+func classifyError(err error, path string) error {
+	zfsErr, ok := err.(ZFSError)
+	if !ok {
+		return err
+	}
+	stderr := strings.ToLower(string(zfsErr.Stderr))
+	for _, class := range errorClasses {
+		for _, s := range class.substrings {
+			if !strings.Contains(stderr, s) {
+				continue
+			}
+			if path == "" {
+				if m := quotedDatasetRegexp.FindSubmatch(zfsErr.Stderr); m != nil {
+					path = string(m[1])
+				}
+			}
+			return class.make(classifiedError{path, zfsErr})
+		}
+	}
+	return err
+}
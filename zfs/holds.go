@@ -0,0 +1,51 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Place a user hold with the given tag on snapshot v of fs.
+// Holding a snapshot that already carries the tag is not an error.
+func ZFSHold(ctx context.Context, fs *DatasetPath, v FilesystemVersion, tag string) (err error) {
+	if v.Type != Snapshot {
+		return fmt.Errorf("can only hold snapshots, not %s", v)
+	}
+	return classifyError(backend.Hold(ctx, fs, v, tag), v.ToAbsPath(fs))
+}
+
+// Release the user hold with the given tag from snapshot v of fs.
+// Releasing a tag that is not held is not an error.
+func ZFSRelease(ctx context.Context, fs *DatasetPath, v FilesystemVersion, tag string) (err error) {
+	if v.Type != Snapshot {
+		return fmt.Errorf("can only release snapshots, not %s", v)
+	}
+	return classifyError(backend.Release(ctx, fs, v, tag), v.ToAbsPath(fs))
+}
+
+// List the tags of all user holds on snapshot v of fs.
+// Cheaper alternative if only the number of holds is required: FilesystemVersion.UserRefs
+func ZFSHolds(ctx context.Context, fs *DatasetPath, v FilesystemVersion) (tags []string, err error) {
+	if v.Type != Snapshot {
+		return nil, nil // bookmarks cannot be held
+	}
+	tags, err = backend.Holds(ctx, fs, v)
+	return tags, classifyError(err, v.ToAbsPath(fs))
+}
+
+// Parses the output of `zfs holds -H`: NAME \t TAG \t TIMESTAMP
+func parseHoldsOutput(output []byte) (tags []string, err error) {
+	tags = make([]string, 0)
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output of zfs holds: %q", s.Text())
+		}
+		tags = append(tags, fields[1])
+	}
+	return tags, nil
+}
@@ -1,19 +1,22 @@
 package zfs
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 type DatasetFilter interface {
 	Filter(p *DatasetPath) (pass bool, err error)
 }
 
-func ZFSListMapping(filter DatasetFilter) (datasets []*DatasetPath, err error) {
+func ZFSListMapping(ctx context.Context, filter DatasetFilter) (datasets []*DatasetPath, err error) {
 
 	if filter == nil {
 		panic("filter must not be nil")
 	}
 
 	var lines [][]string
-	lines, err = ZFSList([]string{"name"}, "-r", "-t", "filesystem,volume")
+	lines, err = ZFSList(ctx, []string{"name"}, "-r", "-t", "filesystem,volume")
 
 	datasets = make([]*DatasetPath, 0, len(lines))
 
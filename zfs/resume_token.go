@@ -0,0 +1,86 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The contents of a receive_resume_token as decoded by `zfs send -nvt`
+type ResumeToken struct {
+	// The dataset path of the snapshot the interrupted stream was sending, e.g. pool/fs@snap
+	ToName string
+	ToGUID uint64
+	// Zero if the interrupted stream was a full stream
+	FromGUID uint64
+	// The interrupted stream was a raw send (zfs send -w)
+	Raw bool
+}
+
+// Split ToName into the filesystem and the snapshot name
+func (t *ResumeToken) ToVersion() (fs *DatasetPath, snapName string, err error) {
+	split := strings.SplitN(t.ToName, "@", 2)
+	if len(split) != 2 {
+		err = fmt.Errorf("resume token toname is not a snapshot: %s", t.ToName)
+		return
+	}
+	if fs, err = NewDatasetPath(split[0]); err != nil {
+		return
+	}
+	return fs, split[1], nil
+}
+
+func ZFSParseResumeToken(ctx context.Context, token string) (t *ResumeToken, err error) {
+	t, err = backend.ParseResumeToken(ctx, token)
+	return t, classifyError(err, "")
+}
+
+// Parses the output of `zfs send -nvt`, which looks like
+//
+//	resume token contents:
+//	nvlist version: 0
+//		fromguid = 0x7ab2a1c4a3f5b6e1
+//		object = 0x6
+//		offset = 0x0
+//		bytes = 0x9f4f30
+//		toguid = 0x18e01da4a9b6c1d3
+//		toname = pool/fs@snap
+//		rawok = 1
+func parseResumeTokenContents(output []byte) (t *ResumeToken, err error) {
+
+	t = &ResumeToken{}
+	var hasToName, hasToGUID bool
+
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "toname":
+			t.ToName = value
+			hasToName = true
+		case "toguid":
+			if t.ToGUID, err = strconv.ParseUint(value, 0, 64); err != nil {
+				return nil, fmt.Errorf("cannot parse toguid: %s", err)
+			}
+			hasToGUID = true
+		case "fromguid":
+			if t.FromGUID, err = strconv.ParseUint(value, 0, 64); err != nil {
+				return nil, fmt.Errorf("cannot parse fromguid: %s", err)
+			}
+		case "rawok":
+			t.Raw = value == "1"
+		}
+	}
+
+	if !hasToName || !hasToGUID {
+		return nil, fmt.Errorf("resume token contents are missing toname or toguid")
+	}
+	return t, nil
+}
@@ -0,0 +1,48 @@
+package zfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseResumeTokenContents(t *testing.T) {
+
+	incremental := `resume token contents:
+nvlist version: 0
+	fromguid = 0x7ab2a1c4a3f5b6e1
+	object = 0x6
+	offset = 0x0
+	bytes = 0x9f4f30
+	toguid = 0x18e01da4a9b6c1d3
+	toname = pool/fs@zrepl_20170922_120000_000
+`
+	tok, err := parseResumeTokenContents([]byte(incremental))
+	assert.NoError(t, err)
+	assert.Equal(t, "pool/fs@zrepl_20170922_120000_000", tok.ToName)
+	assert.EqualValues(t, 0x18e01da4a9b6c1d3, tok.ToGUID)
+	assert.EqualValues(t, 0x7ab2a1c4a3f5b6e1, tok.FromGUID)
+	assert.False(t, tok.Raw)
+
+	fs, snap, err := tok.ToVersion()
+	assert.NoError(t, err)
+	assert.True(t, fs.Equal(toDatasetPath("pool/fs")))
+	assert.Equal(t, "zrepl_20170922_120000_000", snap)
+
+	full := `resume token contents:
+nvlist version: 0
+	object = 0x1
+	offset = 0x0
+	bytes = 0x0
+	toguid = 0x18e01da4a9b6c1d3
+	toname = pool/fs@a
+	rawok = 1
+`
+	tok, err = parseResumeTokenContents([]byte(full))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, tok.FromGUID)
+	assert.True(t, tok.Raw)
+
+	_, err = parseResumeTokenContents([]byte("resume token contents:\nnvlist version: 0\n"))
+	assert.Error(t, err)
+
+}
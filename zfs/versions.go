@@ -2,6 +2,7 @@ package zfs
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -43,6 +44,9 @@ type FilesystemVersion struct {
 
 	// The time the dataset was created
 	Creation time.Time
+
+	// The number of user holds on a snapshot (zfs hold). Always 0 for bookmarks.
+	UserRefs uint64
 }
 
 func (v FilesystemVersion) String() string {
@@ -61,10 +65,10 @@ type FilesystemVersionFilter interface {
 	Filter(fsv FilesystemVersion) (accept bool, err error)
 }
 
-func ZFSListFilesystemVersions(fs *DatasetPath, filter FilesystemVersionFilter) (res []FilesystemVersion, err error) {
+func ZFSListFilesystemVersions(ctx context.Context, fs *DatasetPath, filter FilesystemVersionFilter) (res []FilesystemVersion, err error) {
 	var fieldLines [][]string
-	fieldLines, err = ZFSList(
-		[]string{"name", "guid", "createtxg", "creation"},
+	fieldLines, err = ZFSList(ctx,
+		[]string{"name", "guid", "createtxg", "creation", "userrefs"},
 		"-r", "-d", "1",
 		"-t", "bookmark,snapshot",
 		"-s", "createtxg", fs.ToString())
@@ -113,6 +117,13 @@ func ZFSListFilesystemVersions(fs *DatasetPath, filter FilesystemVersionFilter)
 			v.Creation = time.Unix(creationUnix, 0)
 		}
 
+		if line[4] != "-" { // bookmarks have no userrefs
+			if v.UserRefs, err = strconv.ParseUint(line[4], 10, 64); err != nil {
+				err = fmt.Errorf("cannot parse userrefs: %s", err)
+				return nil, err
+			}
+		}
+
 		accept := true
 		if filter != nil {
 			accept, err = filter.Filter(v)
@@ -129,7 +140,9 @@ func ZFSListFilesystemVersions(fs *DatasetPath, filter FilesystemVersionFilter)
 	return
 }
 
-func ZFSDestroyFilesystemVersion(filesystem *DatasetPath, version FilesystemVersion) (err error) {
+// Returns a *DatasetBusyError if the version is held (zfs hold) or otherwise in use,
+// a *HasClonesError if clones were created from it.
+func ZFSDestroyFilesystemVersion(ctx context.Context, filesystem *DatasetPath, version FilesystemVersion) (err error) {
 
 	datasetPath := version.ToAbsPath(filesystem)
 
@@ -138,12 +151,6 @@ func ZFSDestroyFilesystemVersion(filesystem *DatasetPath, version FilesystemVers
 		return fmt.Errorf("sanity check failed: no @ character found in dataset path: %s", datasetPath)
 	}
 
-	err = ZFSDestroy(datasetPath)
-	if err == nil {
-		return
-	}
-
-	// Check for EBUSY, special meaning to us
-	return
+	return ZFSDestroy(ctx, datasetPath)
 
 }
@@ -1,16 +1,14 @@
 package zfs
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/zrepl/zrepl/util"
 )
 
 type DatasetPath struct {
@@ -136,175 +134,211 @@ func (e ZFSError) Error() string {
 
 var ZFS_BINARY string = "zfs"
 
-func ZFSList(properties []string, zfsArgs ...string) (res [][]string, err error) {
-
-	args := make([]string, 0, 4+len(zfsArgs))
-	args = append(args,
-		"list", "-H", "-p",
-		"-o", strings.Join(properties, ","))
-	args = append(args, zfsArgs...)
-
-	cmd := exec.Command(ZFS_BINARY, args...)
+func ZFSList(ctx context.Context, properties []string, zfsArgs ...string) (res [][]string, err error) {
+	res, err = backend.List(ctx, properties, zfsArgs...)
+	return res, classifyError(err, "")
+}
 
-	var stdout io.Reader
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+// Flags of zfs send, see zfs(8)
+type SendFlags struct {
+	Compressed  bool // -c
+	LargeBlocks bool // -L
+	Embedded    bool // -e
+	Raw         bool // -w
+	Properties  bool // -p
+}
 
-	if stdout, err = cmd.StdoutPipe(); err != nil {
-		return
+func (f SendFlags) args() (args []string) {
+	args = make([]string, 0, 5)
+	if f.Compressed {
+		args = append(args, "-c")
 	}
-
-	if err = cmd.Start(); err != nil {
-		return
+	if f.LargeBlocks {
+		args = append(args, "-L")
 	}
-
-	s := bufio.NewScanner(stdout)
-	buf := make([]byte, 1024)
-	s.Buffer(buf, 0)
-
-	res = make([][]string, 0)
-
-	for s.Scan() {
-		fields := strings.SplitN(s.Text(), "\t", len(properties))
-
-		if len(fields) != len(properties) {
-			err = errors.New("unexpected output")
-			return
-		}
-
-		res = append(res, fields)
+	if f.Embedded {
+		args = append(args, "-e")
 	}
-
-	if waitErr := cmd.Wait(); waitErr != nil {
-		err := ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: waitErr,
-		}
-		return nil, err
+	if f.Raw {
+		args = append(args, "-w")
 	}
-	return
+	if f.Properties {
+		args = append(args, "-p")
+	}
+	return args
 }
 
-func ZFSSend(fs *DatasetPath, from, to *FilesystemVersion) (stream io.Reader, err error) {
-
-	args := make([]string, 0)
-	args = append(args, "send")
-
-	if to == nil { // Initial
-		args = append(args, from.ToAbsPath(fs))
-	} else {
-		args = append(args, "-i", from.ToAbsPath(fs), to.ToAbsPath(fs))
+// The flags set in either f or o
+func (f SendFlags) Union(o SendFlags) SendFlags {
+	return SendFlags{
+		Compressed:  f.Compressed || o.Compressed,
+		LargeBlocks: f.LargeBlocks || o.LargeBlocks,
+		Embedded:    f.Embedded || o.Embedded,
+		Raw:         f.Raw || o.Raw,
+		Properties:  f.Properties || o.Properties,
 	}
+}
 
-	stream, err = util.RunIOCommand(ZFS_BINARY, args...)
-
-	return
+func ZFSSend(ctx context.Context, fs *DatasetPath, from, to *FilesystemVersion, flags SendFlags) (stream io.Reader, err error) {
+	stream, err = backend.Send(ctx, fs, from, to, flags)
+	return stream, classifyError(err, fs.ToString())
 }
 
-func ZFSRecv(fs *DatasetPath, stream io.Reader, additionalArgs ...string) (err error) {
+// Estimate the size of the stream ZFSSend would produce with the same arguments
+func ZFSSendDry(ctx context.Context, fs *DatasetPath, from, to *FilesystemVersion, flags SendFlags) (size uint64, err error) {
+	size, err = backend.SendDry(ctx, fs, from, to, flags)
+	return size, classifyError(err, fs.ToString())
+}
 
-	args := make([]string, 0)
-	args = append(args, "recv")
-	if len(args) > 0 {
-		args = append(args, additionalArgs...)
+// Parses the output of `zfs send -nvP`, which ends with the estimated size
+//
+//	incremental	zrepl_1	pool/fs@zrepl_2	1243528
+//	size	1243528
+func parseSendDryOutput(output []byte) (size uint64, err error) {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		fields := strings.Fields(lines[i])
+		if len(fields) == 2 && fields[0] == "size" {
+			if size, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return 0, fmt.Errorf("cannot parse size in output of zfs send -nvP: %s", err)
+			}
+			return size, nil
+		}
 	}
-	args = append(args, fs.ToString())
-
-	cmd := exec.Command(ZFS_BINARY, args...)
-
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
-
-	// TODO report bug upstream
-	// Setup an unused stdout buffer.
-	// Otherwise, ZoL v0.6.5.9-1 3.16.0-4-amd64 writes the following error to stderr and exits with code 1
-	//   cannot receive new filesystem stream: invalid backup stream
-	stdout := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stdout = stdout
+	return 0, fmt.Errorf("output of zfs send -nvP does not contain size: %q", output)
+}
 
-	cmd.Stdin = stream
+// Resume an interrupted send using the receive_resume_token of the receiving side
+func ZFSSendResume(ctx context.Context, token string) (stream io.Reader, err error) {
+	stream, err = backend.SendResume(ctx, token)
+	return stream, classifyError(err, "")
+}
 
-	if err = cmd.Start(); err != nil {
-		return
-	}
+// Properties of a received filesystem that differ from those in the stream
+type RecvProperties struct {
+	// zfs recv -o property=value
+	Override map[string]string
+	// zfs recv -x property
+	Exclude []string
+}
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
-		return
+func validRecvPropertyName(prop string) error {
+	if prop == "" || strings.ContainsAny(prop, "= \t\n") {
+		return fmt.Errorf("invalid property name %q", prop)
 	}
-
 	return nil
 }
 
-func ZFSSet(fs *DatasetPath, prop, val string) (err error) {
-
-	if strings.ContainsRune(prop, '=') {
-		panic("prop contains rune '=' which is the delimiter between property name and value")
+func (p RecvProperties) args() (args []string, err error) {
+	names := make([]string, 0, len(p.Override))
+	for prop := range p.Override {
+		names = append(names, prop)
 	}
+	sort.Strings(names)
 
-	cmd := exec.Command(ZFS_BINARY, "set", fmt.Sprintf("%s=%s", prop, val), fs.ToString())
-
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
-
-	if err = cmd.Start(); err != nil {
-		return err
+	args = make([]string, 0, 2*(len(names)+len(p.Exclude)))
+	for _, prop := range names {
+		if err = validRecvPropertyName(prop); err != nil {
+			return nil, err
+		}
+		args = append(args, "-o", fmt.Sprintf("%s=%s", prop, p.Override[prop]))
 	}
-
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
+	for _, prop := range p.Exclude {
+		if err = validRecvPropertyName(prop); err != nil {
+			return nil, err
 		}
+		args = append(args, "-x", prop)
 	}
+	return args, nil
+}
 
-	return
+// Whether prop is overridden or excluded
+func (p RecvProperties) Contains(prop string) bool {
+	if _, ok := p.Override[prop]; ok {
+		return true
+	}
+	for _, e := range p.Exclude {
+		if e == prop {
+			return true
+		}
+	}
+	return false
 }
 
-func ZFSDestroy(dataset string) (err error) {
+func ZFSRecv(ctx context.Context, fs *DatasetPath, stream io.Reader, props RecvProperties, additionalArgs ...string) (err error) {
+	args, err := props.args()
+	if err != nil {
+		return err
+	}
+	err = backend.Recv(ctx, fs, stream, append(args, additionalArgs...)...)
+	return classifyError(err, fs.ToString())
+}
 
-	cmd := exec.Command(ZFS_BINARY, "destroy", dataset)
+// Discard the partially received state of an interrupted `zfs recv -s`
+func ZFSRecvAbortResumable(ctx context.Context, fs *DatasetPath) (err error) {
+	return classifyError(backend.RecvAbortResumable(ctx, fs), fs.ToString())
+}
 
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+func ZFSSet(ctx context.Context, fs *DatasetPath, prop, val string) (err error) {
 
-	if err = cmd.Start(); err != nil {
-		return err
+	if strings.ContainsRune(prop, '=') {
+		panic("prop contains rune '=' which is the delimiter between property name and value")
 	}
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
+	return classifyError(backend.Set(ctx, fs, prop, val), fs.ToString())
+}
+
+// Whether fs uses native encryption.
+// ZFS versions without native encryption do not know the encryption property,
+// fs is reported as unencrypted by them.
+func ZFSGetEncryptionEnabled(ctx context.Context, fs *DatasetPath) (enabled bool, err error) {
+	lines, err := ZFSList(ctx, []string{"encryption"}, fs.ToString())
+	if err != nil {
+		var zfsErr ZFSError
+		if errors.As(err, &zfsErr) && strings.Contains(string(zfsErr.Stderr), "invalid property") {
+			return false, nil
 		}
+		return false, err
 	}
+	if len(lines) != 1 {
+		return false, fmt.Errorf("unexpected output of zfs list for %s: %v", fs.ToString(), lines)
+	}
+	switch lines[0][0] {
+	case "off", "-":
+		return false, nil
+	default:
+		return true, nil
+	}
+}
 
-	return
-
+func ZFSDestroy(ctx context.Context, dataset string) (err error) {
+	return classifyError(backend.Destroy(ctx, dataset), dataset)
 }
 
-func ZFSSnapshot(fs *DatasetPath, name string, recursive bool) (err error) {
+// Roll fs back to snapshot v.
+// If destroyMoreRecent is set, snapshots and bookmarks more recent than v are destroyed (zfs rollback -r),
+// otherwise v must be the most recent snapshot of fs.
+func ZFSRollback(ctx context.Context, fs *DatasetPath, v FilesystemVersion, destroyMoreRecent bool) (err error) {
+	if v.Type != Snapshot {
+		return fmt.Errorf("can only roll back to snapshots, not %s", v)
+	}
+	return classifyError(backend.Rollback(ctx, fs, v, destroyMoreRecent), fs.ToString())
+}
 
-	snapname := fmt.Sprintf("%s@%s", fs.ToString(), name)
-	cmd := exec.Command(ZFS_BINARY, "snapshot", snapname)
+// Rename from and all its children to to, the parent of to must exist.
+func ZFSRename(ctx context.Context, from, to *DatasetPath) (err error) {
+	return classifyError(backend.Rename(ctx, from, to), from.ToString())
+}
 
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+func ZFSSnapshot(ctx context.Context, fs *DatasetPath, name string, recursive bool) (err error) {
+	return classifyError(backend.Snapshot(ctx, fs, name, recursive), fs.ToString())
+}
 
-	if err = cmd.Start(); err != nil {
-		return err
-	}
+func ZFSBookmark(ctx context.Context, fs *DatasetPath, v FilesystemVersion, bookmark string) (err error) {
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
+	if v.Type != Snapshot {
+		panic("can only create bookmarks of snapshots")
 	}
 
-	return
-
+	return classifyError(backend.Bookmark(ctx, fs, v, bookmark), v.ToAbsPath(fs))
 }
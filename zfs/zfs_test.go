@@ -1,6 +1,8 @@
 package zfs
 
 import (
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -10,7 +12,7 @@ func TestZFSListHandlesProducesZFSErrorOnNonZeroExit(t *testing.T) {
 
 	ZFS_BINARY = "./test_helpers/zfs_failer.sh"
 
-	_, err = ZFSList([]string{"fictionalprop"}, "nonexistent/dataset")
+	_, err = ZFSList(context.Background(), []string{"fictionalprop"}, "nonexistent/dataset")
 
 	assert.Error(t, err)
 	zfsError, ok := err.(ZFSError)
@@ -28,3 +30,80 @@ func TestDatasetPathTrimNPrefixComps(t *testing.T) {
 	p.TrimNPrefixComps((1))
 	assert.True(t, p.Empty(), "empty trimming shouldn't do harm")
 }
+
+func TestParseHoldsOutput(t *testing.T) {
+	out := "pool/fs@a\tzrepl_last_backuphost\tWed Sep 20 14:19 2017\npool/fs@a\tkeep\tWed Sep 20 14:20 2017\n"
+	tags, err := parseHoldsOutput([]byte(out))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zrepl_last_backuphost", "keep"}, tags)
+
+	tags, err = parseHoldsOutput([]byte{})
+	assert.NoError(t, err)
+	assert.Len(t, tags, 0)
+
+	_, err = parseHoldsOutput([]byte("garbage\n"))
+	assert.Error(t, err)
+}
+
+func TestRecvPropertiesArgs(t *testing.T) {
+	p := RecvProperties{
+		Override: map[string]string{"readonly": "on", "mountpoint": "none"},
+		Exclude:  []string{"sharenfs"},
+	}
+	args, err := p.args()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-o", "mountpoint=none", "-o", "readonly=on", "-x", "sharenfs"}, args)
+	assert.True(t, p.Contains("sharenfs"))
+	assert.False(t, p.Contains("compression"))
+
+	_, err = RecvProperties{Exclude: []string{"a=b"}}.args()
+	assert.Error(t, err)
+}
+
+func TestParseSendDryOutput(t *testing.T) {
+	size, err := parseSendDryOutput([]byte("incremental\tzrepl_1\tpool/fs@zrepl_2\t1243528\nsize\t1243528\n"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1243528, size)
+
+	size, err = parseSendDryOutput([]byte("full\tpool/fs@zrepl_1\t4096\nsize\t4096\n"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4096, size)
+
+	_, err = parseSendDryOutput([]byte{})
+	assert.Error(t, err)
+}
+
+func TestClassifyError(t *testing.T) {
+	zfsErr := func(stderr string) ZFSError {
+		return ZFSError{Stderr: []byte(stderr), WaitErr: errors.New("exit status 1")}
+	}
+
+	err := classifyError(zfsErr("cannot destroy snapshot pool/fs@a: dataset is busy\n"), "pool/fs@a")
+	var busy *DatasetBusyError
+	assert.True(t, errors.As(err, &busy))
+	assert.Equal(t, "pool/fs@a", busy.Path)
+	var unwrapped ZFSError
+	assert.True(t, errors.As(err, &unwrapped), "classified errors wrap the ZFSError")
+
+	err = classifyError(zfsErr("cannot open 'pool/gone': dataset does not exist\n"), "")
+	var notExist *DatasetDoesNotExistError
+	assert.True(t, errors.As(err, &notExist))
+	assert.Equal(t, "pool/gone", notExist.Path, "path is taken from stderr if not known")
+
+	var clones *HasClonesError
+	assert.True(t, errors.As(classifyError(zfsErr("cannot destroy 'pool/fs@a': snapshot has dependent clones\n"), ""), &clones))
+	var space *OutOfSpaceError
+	assert.True(t, errors.As(classifyError(zfsErr("cannot receive new filesystem stream: out of space\n"), "pool/fs"), &space))
+	var denied *PermissionDeniedError
+	assert.True(t, errors.As(classifyError(zfsErr("cannot create snapshot 'pool/fs@a': permission denied\n"), ""), &denied))
+	var invalid *StreamInvalidError
+	assert.True(t, errors.As(classifyError(zfsErr("cannot receive incremental stream: checksum mismatch or incomplete stream\n"), "pool/fs"), &invalid))
+	var modified *DestinationModifiedError
+	assert.True(t, errors.As(classifyError(zfsErr("cannot receive incremental stream: destination pool/fs has been modified\nsince most recent snapshot\n"), "pool/fs"), &modified))
+
+	unknown := zfsErr("error: this is a mock\n")
+	assert.Equal(t, unknown, classifyError(unknown, "pool/fs"))
+	other := errors.New("not a zfs error")
+	assert.Equal(t, other, classifyError(other, "pool/fs"))
+	assert.NoError(t, classifyError(nil, "pool/fs"))
+}
@@ -0,0 +1,1006 @@
+// Package zfstest provides an in-memory zfs.Backend for tests of code that
+// builds on package zfs.
+//
+// It models filesystems, snapshots, bookmarks, user holds, GUIDs, createtxg
+// and resumable receives. Send streams are opaque to the user of this package,
+// but they carry the identity (name, GUID, creation) of the sent snapshot.
+// Only the subset of zfs behavior and arguments that zrepl relies upon is implemented.
+// Operations fail with ctx.Err() once their context is done, and so do reads
+// from send streams.
+package zfstest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zrepl/zrepl/zfs"
+)
+
+type Backend struct {
+	// Length of the payload of every send stream
+	StreamSize int
+	// If > 0, the next send stream is cut off after that many bytes,
+	// simulating an interrupted transfer.
+	InterruptNextSendAfter int
+	// Source of the creation time of snapshots
+	Now func() time.Time
+
+	mtx      sync.Mutex
+	txg      uint64
+	guid     uint64
+	datasets map[string]*dataset
+}
+
+type dataset struct {
+	name      string
+	guid      uint64
+	createtxg uint64
+	props     map[string]string
+	versions  []*version // ordered by createtxg
+	partial   *partialRecv
+}
+
+type version struct {
+	typ       zfs.VersionType
+	name      string
+	guid      uint64
+	createtxg uint64
+	creation  time.Time
+	holds     map[string]bool
+}
+
+// The state of an interrupted `zfs recv -s`
+type partialRecv struct {
+	header   streamHeader
+	received int
+	// The interrupted receive created the dataset
+	createdDataset bool
+}
+
+type streamHeader struct {
+	// Full name of the sent snapshot, e.g. pool/fs@snap
+	ToName   string
+	ToGUID   uint64
+	FromGUID uint64
+	Creation time.Time
+	Size     int
+	// Number of payload bytes the receiver already has, > 0 for resumed streams
+	Offset int
+	Flags  zfs.SendFlags
+	// Encryption of the sent dataset, only set for raw streams
+	Encryption string
+	// Local properties of the sent dataset, only set if Flags.Properties
+	Props map[string]string
+}
+
+var errExit = errors.New("exit status 1")
+
+func zfsError(format string, args ...interface{}) error {
+	return zfs.ZFSError{
+		Stderr:  []byte(fmt.Sprintf(format, args...) + "\n"),
+		WaitErr: errExit,
+	}
+}
+
+// Create a backend with the given pools, i.e. empty root filesystems
+func NewBackend(pools ...string) *Backend {
+	b := &Backend{
+		StreamSize: 4096,
+		Now:        time.Now,
+		guid:       0x1c9f6d02b5e3a4f0,
+		datasets:   make(map[string]*dataset),
+	}
+	for _, p := range pools {
+		b.datasets[p] = b.newDataset(p)
+	}
+	return b
+}
+
+// Like `zfs create`
+func (b *Backend) CreateFilesystem(name string) (err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if err = b.checkCreate(name); err != nil {
+		return
+	}
+	b.datasets[name] = b.newDataset(name)
+	return nil
+}
+
+func (b *Backend) newDataset(name string) *dataset {
+	b.txg++
+	b.guid++
+	return &dataset{
+		name:      name,
+		guid:      b.guid,
+		createtxg: b.txg,
+		props:     make(map[string]string),
+		versions:  make([]*version, 0),
+	}
+}
+
+func parentName(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i == -1 {
+		return ""
+	}
+	return name[:i]
+}
+
+func (b *Backend) checkCreate(name string) error {
+	if _, exists := b.datasets[name]; exists {
+		return zfsError("cannot create '%s': dataset already exists", name)
+	}
+	parent := parentName(name)
+	if parent == "" {
+		return zfsError("cannot create '%s': missing dataset name", name)
+	}
+	if _, exists := b.datasets[parent]; !exists {
+		return zfsError("cannot create '%s': parent does not exist", name)
+	}
+	return nil
+}
+
+func (b *Backend) lookupDataset(name string) (ds *dataset, err error) {
+	ds, ok := b.datasets[name]
+	if !ok {
+		return nil, zfsError("cannot open '%s': dataset does not exist", name)
+	}
+	return ds, nil
+}
+
+func (d *dataset) lookupVersion(t zfs.VersionType, name string) *version {
+	for _, v := range d.versions {
+		if v.typ == t && v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (d *dataset) lookupVersionByGUID(guid uint64) *version {
+	for _, v := range d.versions {
+		if v.guid == guid {
+			return v
+		}
+	}
+	return nil
+}
+
+func (d *dataset) latestSnapshot() *version {
+	for i := len(d.versions) - 1; i >= 0; i-- {
+		if d.versions[i].typ == zfs.Snapshot {
+			return d.versions[i]
+		}
+	}
+	return nil
+}
+
+func (d *dataset) addVersion(v *version) {
+	d.versions = append(d.versions, v)
+	sort.SliceStable(d.versions, func(i, j int) bool {
+		return d.versions[i].createtxg < d.versions[j].createtxg
+	})
+}
+
+func (b *Backend) lookupSnapshot(fs *zfs.DatasetPath, v zfs.FilesystemVersion) (*version, error) {
+	ds, err := b.lookupDataset(fs.ToString())
+	if err != nil {
+		return nil, err
+	}
+	snap := ds.lookupVersion(v.Type, v.Name)
+	if snap == nil {
+		return nil, zfsError("cannot open '%s': dataset does not exist", v.ToAbsPath(fs))
+	}
+	return snap, nil
+}
+
+type listEntry struct {
+	ds *dataset
+	v  *version // nil for filesystems
+}
+
+func (e listEntry) name() string {
+	if e.v == nil {
+		return e.ds.name
+	}
+	return e.ds.name + e.v.typ.DelimiterChar() + e.v.name
+}
+
+func depth(name string) int {
+	return strings.Count(name, "/")
+}
+
+func (b *Backend) List(ctx context.Context, properties []string, zfsArgs ...string) (res [][]string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	recursive := false
+	maxDepth := -1
+	types := map[string]bool{"filesystem": true, "volume": true}
+	sortBy := ""
+	roots := make([]string, 0)
+
+	for i := 0; i < len(zfsArgs); i++ {
+		arg := zfsArgs[i]
+		var val string
+		if arg == "-d" || arg == "-t" || arg == "-s" {
+			if i+1 >= len(zfsArgs) {
+				return nil, zfsError("missing argument for '%s' option", arg)
+			}
+			i++
+			val = zfsArgs[i]
+		}
+		switch arg {
+		case "-r":
+			recursive = true
+		case "-d":
+			recursive = true
+			if maxDepth, err = strconv.Atoi(val); err != nil {
+				return nil, zfsError("invalid depth '%s'", val)
+			}
+		case "-t":
+			types = make(map[string]bool)
+			for _, t := range strings.Split(val, ",") {
+				types[t] = true
+			}
+		case "-s":
+			sortBy = val
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return nil, zfsError("unsupported option '%s'", arg)
+			}
+			roots = append(roots, arg)
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if len(roots) == 0 {
+		recursive, maxDepth = true, -1
+		for name := range b.datasets {
+			if parentName(name) == "" {
+				roots = append(roots, name)
+			}
+		}
+	}
+
+	entries := make([]listEntry, 0)
+	for _, root := range roots {
+
+		if i := strings.IndexAny(root, "@#"); i != -1 {
+			ds, err := b.lookupDataset(root[:i])
+			if err != nil {
+				return nil, err
+			}
+			t := zfs.VersionType(zfs.Snapshot)
+			if root[i] == '#' {
+				t = zfs.Bookmark
+			}
+			v := ds.lookupVersion(t, root[i+1:])
+			if v == nil {
+				return nil, zfsError("cannot open '%s': dataset does not exist", root)
+			}
+			entries = append(entries, listEntry{ds, v})
+			continue
+		}
+
+		if _, err := b.lookupDataset(root); err != nil {
+			return nil, err
+		}
+		for name, ds := range b.datasets {
+			if name != root && !strings.HasPrefix(name, root+"/") {
+				continue
+			}
+			d := depth(name) - depth(root)
+			if d > 0 && !recursive || maxDepth >= 0 && d > maxDepth {
+				continue
+			}
+			if types["filesystem"] {
+				entries = append(entries, listEntry{ds, nil})
+			}
+			if !recursive || maxDepth >= 0 && d+1 > maxDepth {
+				continue
+			}
+			for _, v := range ds.versions {
+				if types[string(v.typ)] {
+					entries = append(entries, listEntry{ds, v})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].name() < entries[j].name()
+	})
+	if sortBy != "" {
+		sort.SliceStable(entries, func(i, j int) bool {
+			vi, vj := b.property(entries[i], sortBy), b.property(entries[j], sortBy)
+			ni, erri := strconv.ParseUint(vi, 10, 64)
+			nj, errj := strconv.ParseUint(vj, 10, 64)
+			if erri == nil && errj == nil {
+				return ni < nj
+			}
+			return vi < vj
+		})
+	}
+
+	res = make([][]string, len(entries))
+	for i, e := range entries {
+		res[i] = make([]string, len(properties))
+		for j, p := range properties {
+			res[i][j] = b.property(e, p)
+		}
+	}
+	return res, nil
+}
+
+func (b *Backend) property(e listEntry, prop string) string {
+	v := e.v
+	switch prop {
+	case "name":
+		return e.name()
+	case "type":
+		if v == nil {
+			return "filesystem"
+		}
+		return string(v.typ)
+	case "guid":
+		if v == nil {
+			return fmt.Sprintf("%d", e.ds.guid)
+		}
+		return fmt.Sprintf("%d", v.guid)
+	case "createtxg":
+		if v == nil {
+			return fmt.Sprintf("%d", e.ds.createtxg)
+		}
+		return fmt.Sprintf("%d", v.createtxg)
+	case "creation":
+		if v == nil {
+			return "0"
+		}
+		return fmt.Sprintf("%d", v.creation.Unix())
+	case "userrefs":
+		if v == nil || v.typ != zfs.Snapshot {
+			return "-"
+		}
+		return fmt.Sprintf("%d", len(v.holds))
+	case "receive_resume_token":
+		if v != nil || e.ds.partial == nil {
+			return "-"
+		}
+		return encodeToken(e.ds.partial.header, e.ds.partial.received)
+	}
+	if v != nil {
+		return "-"
+	}
+	if val, ok := e.ds.props[prop]; ok {
+		return val
+	}
+	if strings.Contains(prop, ":") || prop == "encryption" { // inherited properties
+		for p := parentName(e.ds.name); p != ""; p = parentName(p) {
+			if val, ok := b.datasets[p].props[prop]; ok {
+				return val
+			}
+		}
+	}
+	return "-"
+}
+
+func encodeToken(h streamHeader, received int) string {
+	h.Offset = received
+	j, err := json.Marshal(h)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(j)
+}
+
+func decodeToken(token string) (h streamHeader, err error) {
+	j, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return h, zfsError("cannot resume send: malformed token")
+	}
+	if err = json.Unmarshal(j, &h); err != nil {
+		return h, zfsError("cannot resume send: malformed token")
+	}
+	return h, nil
+}
+
+func (b *Backend) newStream(h streamHeader) io.Reader {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(h); err != nil {
+		panic(err)
+	}
+	buf.Write(bytes.Repeat([]byte{byte(h.ToGUID)}, h.Size-h.Offset))
+	stream := buf.Bytes()
+	if b.InterruptNextSendAfter > 0 && b.InterruptNextSendAfter < len(stream) {
+		stream = stream[:b.InterruptNextSendAfter]
+		b.InterruptNextSendAfter = 0
+	}
+	return bytes.NewReader(stream)
+}
+
+// Fails reads once ctx is done, like a stream whose zfs send process was killed
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (b *Backend) Send(ctx context.Context, fs *zfs.DatasetPath, from, to *zfs.FilesystemVersion, flags zfs.SendFlags) (stream io.Reader, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	h, err := b.sendHeader(fs, from, to, flags)
+	if err != nil {
+		return nil, err
+	}
+	return ctxReader{ctx, b.newStream(h)}, nil
+}
+
+func (b *Backend) SendDry(ctx context.Context, fs *zfs.DatasetPath, from, to *zfs.FilesystemVersion, flags zfs.SendFlags) (size uint64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	h, err := b.sendHeader(fs, from, to, flags)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(h.Size), nil
+}
+
+func (b *Backend) sendHeader(fs *zfs.DatasetPath, from, to *zfs.FilesystemVersion, flags zfs.SendFlags) (h streamHeader, err error) {
+
+	h = streamHeader{Size: b.StreamSize, Flags: flags}
+	if ds, ok := b.datasets[fs.ToString()]; ok {
+		if flags.Raw {
+			h.Encryption = b.property(listEntry{ds, nil}, "encryption")
+		}
+		if flags.Properties {
+			h.Props = make(map[string]string, len(ds.props))
+			for k, v := range ds.props {
+				h.Props[k] = v
+			}
+		}
+	}
+
+	if to == nil {
+		snap, err := b.lookupSnapshot(fs, *from)
+		if err != nil {
+			return h, err
+		}
+		if snap.typ != zfs.Snapshot {
+			return h, zfsError("cannot send '%s': full stream of bookmark", from.ToAbsPath(fs))
+		}
+		h.ToName, h.ToGUID, h.Creation = from.ToAbsPath(fs), snap.guid, snap.creation
+		return h, nil
+	}
+
+	fromV, err := b.lookupSnapshot(fs, *from)
+	if err != nil {
+		return h, err
+	}
+	toV, err := b.lookupSnapshot(fs, *to)
+	if err != nil {
+		return h, err
+	}
+	if toV.typ != zfs.Snapshot {
+		return h, zfsError("cannot send '%s': not a snapshot", to.ToAbsPath(fs))
+	}
+	if fromV.createtxg >= toV.createtxg {
+		return h, zfsError("cannot send '%s': incremental source must be earlier than destination", to.ToAbsPath(fs))
+	}
+	h.ToName, h.ToGUID, h.Creation = to.ToAbsPath(fs), toV.guid, toV.creation
+	h.FromGUID = fromV.guid
+	return h, nil
+}
+
+func (b *Backend) SendResume(ctx context.Context, token string) (stream io.Reader, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	h, err := b.decodeAndCheckToken(token)
+	if err != nil {
+		return nil, err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return ctxReader{ctx, b.newStream(h)}, nil
+}
+
+func (b *Backend) decodeAndCheckToken(token string) (h streamHeader, err error) {
+	if h, err = decodeToken(token); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	split := strings.SplitN(h.ToName, "@", 2)
+	ds, err := b.lookupDataset(split[0])
+	if err != nil {
+		return
+	}
+	if len(split) != 2 {
+		return h, zfsError("cannot resume send: malformed token")
+	}
+	if v := ds.lookupVersion(zfs.Snapshot, split[1]); v == nil || v.guid != h.ToGUID {
+		return h, zfsError("cannot resume send: '%s' used in the initial send no longer exists", h.ToName)
+	}
+	if h.FromGUID != 0 && ds.lookupVersionByGUID(h.FromGUID) == nil {
+		return h, zfsError("cannot resume send: incremental source 0x%x no longer exists", h.FromGUID)
+	}
+	return h, nil
+}
+
+func (b *Backend) ParseResumeToken(ctx context.Context, token string) (t *zfs.ResumeToken, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	h, err := decodeToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return &zfs.ResumeToken{
+		ToName:   h.ToName,
+		ToGUID:   h.ToGUID,
+		FromGUID: h.FromGUID,
+		Raw:      h.Flags.Raw,
+	}, nil
+}
+
+func (b *Backend) Recv(ctx context.Context, fs *zfs.DatasetPath, stream io.Reader, additionalArgs ...string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var force, resumable bool
+	override := make(map[string]string)
+	exclude := make([]string, 0)
+	for i := 0; i < len(additionalArgs); i++ {
+		arg := additionalArgs[i]
+		switch arg {
+		case "-u":
+		case "-F":
+			force = true
+		case "-s":
+			resumable = true
+		case "-o", "-x":
+			if i+1 >= len(additionalArgs) {
+				return zfsError("missing argument for '%s' option", arg)
+			}
+			i++
+			if arg == "-x" {
+				exclude = append(exclude, additionalArgs[i])
+				continue
+			}
+			kv := strings.SplitN(additionalArgs[i], "=", 2)
+			if len(kv) != 2 {
+				return zfsError("missing '=' for property=value argument")
+			}
+			override[kv[0]] = kv[1]
+		default:
+			return zfsError("unsupported option '%s'", arg)
+		}
+	}
+
+	// A broken stream is handled like a short one
+	data, _ := ioutil.ReadAll(stream)
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	headerLine, err := r.ReadBytes('\n')
+	if err != nil {
+		return zfsError("cannot receive: invalid backup stream")
+	}
+	var h streamHeader
+	if err = json.Unmarshal(headerLine, &h); err != nil {
+		return zfsError("cannot receive: invalid backup stream")
+	}
+	payload := len(data) - len(headerLine)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	name := fs.ToString()
+	ds := b.datasets[name]
+	snapName := h.ToName[strings.Index(h.ToName, "@")+1:]
+
+	switch {
+	case h.Offset > 0:
+		if ds == nil || ds.partial == nil || ds.partial.header.ToGUID != h.ToGUID || ds.partial.received != h.Offset {
+			return zfsError("cannot receive resume stream: kernel modules must be upgraded to receive this stream")
+		}
+	case ds != nil && ds.partial != nil:
+		return zfsError("cannot receive new filesystem stream: destination %s contains partially-complete state from \"zfs receive -s\"", name)
+	case h.FromGUID == 0:
+		if ds != nil {
+			if !force {
+				return zfsError("cannot receive new filesystem stream: destination '%s' exists\nmust specify -F to overwrite it", name)
+			}
+			if len(ds.versions) > 0 {
+				return zfsError("cannot receive new filesystem stream: destination has snapshots (eg. %s)\nmust destroy them to overwrite it", ds.versions[0].name)
+			}
+		} else if err = b.checkCreate(name); err != nil {
+			return err
+		}
+	default:
+		if ds == nil {
+			return zfsError("cannot receive incremental stream: destination '%s' does not exist", name)
+		}
+		from := ds.lookupVersionByGUID(h.FromGUID)
+		if from == nil || from.typ != zfs.Snapshot {
+			return zfsError("cannot receive incremental stream: most recent snapshot of %s does not\nmatch incremental source", name)
+		}
+		if latest := ds.latestSnapshot(); latest != from {
+			if !force {
+				return zfsError("cannot receive incremental stream: destination %s has been modified\nsince most recent snapshot", name)
+			}
+			if err = b.rollback(ds, from); err != nil {
+				return err
+			}
+		}
+	}
+	if ds != nil && ds.lookupVersionByGUID(h.ToGUID) != nil {
+		return zfsError("cannot receive: destination already exists")
+	}
+
+	if h.Offset+payload < h.Size {
+		if !resumable {
+			return zfsError("cannot receive: failed to read from stream")
+		}
+		if ds == nil {
+			ds = b.newDataset(name)
+			b.datasets[name] = ds
+			ds.partial = &partialRecv{header: h, createdDataset: true}
+		} else if ds.partial == nil {
+			ds.partial = &partialRecv{header: h}
+		}
+		ds.partial.received = h.Offset + payload
+		return zfsError("cannot receive: failed to read from stream\ncheckpoint saved, use receive_resume_token to resume")
+	}
+
+	if ds == nil {
+		ds = b.newDataset(name)
+		b.datasets[name] = ds
+	} else if h.FromGUID == 0 && ds.partial == nil {
+		// full receive replaces the existing filesystem
+		ds.props = make(map[string]string)
+	}
+	ds.partial = nil
+	if h.Encryption != "" && h.Encryption != "-" {
+		ds.props["encryption"] = h.Encryption
+	}
+	for k, v := range h.Props {
+		ds.props[k] = v
+	}
+	for _, k := range exclude {
+		delete(ds.props, k)
+	}
+	for k, v := range override {
+		ds.props[k] = v
+	}
+
+	b.txg++
+	ds.addVersion(&version{
+		typ:       zfs.Snapshot,
+		name:      snapName,
+		guid:      h.ToGUID,
+		createtxg: b.txg,
+		creation:  h.Creation,
+		holds:     make(map[string]bool),
+	})
+	return nil
+}
+
+// Destroy all snapshots of ds more recent than v
+func (b *Backend) rollback(ds *dataset, v *version) error {
+	keep := make([]*version, 0, len(ds.versions))
+	for _, s := range ds.versions {
+		if s.createtxg > v.createtxg && s.typ == zfs.Snapshot {
+			if len(s.holds) > 0 {
+				return zfsError("cannot rollback '%s': snapshot %s@%s is busy", ds.name, ds.name, s.name)
+			}
+			continue
+		}
+		keep = append(keep, s)
+	}
+	ds.versions = keep
+	return nil
+}
+
+func (b *Backend) RecvAbortResumable(ctx context.Context, fs *zfs.DatasetPath) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ds, err := b.lookupDataset(fs.ToString())
+	if err != nil {
+		return err
+	}
+	if ds.partial == nil {
+		return zfsError("'%s' does not have any resumable receive state to abort", ds.name)
+	}
+	if ds.partial.createdDataset {
+		delete(b.datasets, ds.name)
+		return nil
+	}
+	ds.partial = nil
+	return nil
+}
+
+func (b *Backend) Set(ctx context.Context, fs *zfs.DatasetPath, prop, val string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ds, err := b.lookupDataset(fs.ToString())
+	if err != nil {
+		return err
+	}
+	ds.props[prop] = val
+	return nil
+}
+
+func (b *Backend) Destroy(ctx context.Context, dataset string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	i := strings.IndexAny(dataset, "@#")
+	if i == -1 {
+		ds, err := b.lookupDataset(dataset)
+		if err != nil {
+			return err
+		}
+		if len(ds.versions) > 0 {
+			return zfsError("cannot destroy '%s': filesystem has children\nuse '-r' to destroy the following datasets", dataset)
+		}
+		for name := range b.datasets {
+			if strings.HasPrefix(name, dataset+"/") {
+				return zfsError("cannot destroy '%s': filesystem has children\nuse '-r' to destroy the following datasets", dataset)
+			}
+		}
+		delete(b.datasets, dataset)
+		return nil
+	}
+
+	ds, err := b.lookupDataset(dataset[:i])
+	if err != nil {
+		return err
+	}
+	t := zfs.VersionType(zfs.Snapshot)
+	if dataset[i] == '#' {
+		t = zfs.Bookmark
+	}
+	v := ds.lookupVersion(t, dataset[i+1:])
+	if v == nil {
+		return zfsError("could not find any snapshots to destroy; check snapshot names.")
+	}
+	if len(v.holds) > 0 {
+		return zfsError("cannot destroy snapshot %s: dataset is busy", dataset)
+	}
+	for j := range ds.versions {
+		if ds.versions[j] == v {
+			ds.versions = append(ds.versions[:j], ds.versions[j+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *Backend) Rollback(ctx context.Context, fs *zfs.DatasetPath, v zfs.FilesystemVersion, destroyMoreRecent bool) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	snap, err := b.lookupSnapshot(fs, v)
+	if err != nil {
+		return err
+	}
+	ds := b.datasets[fs.ToString()]
+	keep := make([]*version, 0, len(ds.versions))
+	for _, o := range ds.versions {
+		if o.createtxg <= snap.createtxg {
+			keep = append(keep, o)
+			continue
+		}
+		if !destroyMoreRecent {
+			return zfsError("cannot rollback to '%s': more recent snapshots or bookmarks exist\nuse '-r' to force deletion of the following snapshots and bookmarks:", v.ToAbsPath(fs))
+		}
+		if len(o.holds) > 0 {
+			return zfsError("cannot destroy snapshot %s%s%s: dataset is busy", ds.name, o.typ.DelimiterChar(), o.name)
+		}
+	}
+	ds.versions = keep
+	return nil
+}
+
+func (b *Backend) Rename(ctx context.Context, from, to *zfs.DatasetPath) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	fromName, toName := from.ToString(), to.ToString()
+	if _, err = b.lookupDataset(fromName); err != nil {
+		return err
+	}
+	if _, exists := b.datasets[toName]; exists {
+		return zfsError("cannot rename to '%s': dataset already exists", toName)
+	}
+	if _, exists := b.datasets[parentName(toName)]; !exists {
+		return zfsError("cannot rename to '%s': parent does not exist", toName)
+	}
+	if strings.HasPrefix(toName, fromName+"/") {
+		return zfsError("cannot rename to '%s': New dataset name cannot be a descendant of current dataset name", toName)
+	}
+	renamed := make([]*dataset, 0)
+	for name, ds := range b.datasets {
+		if name == fromName || strings.HasPrefix(name, fromName+"/") {
+			renamed = append(renamed, ds)
+			delete(b.datasets, name)
+		}
+	}
+	for _, ds := range renamed {
+		ds.name = toName + strings.TrimPrefix(ds.name, fromName)
+		b.datasets[ds.name] = ds
+	}
+	return nil
+}
+
+func (b *Backend) Snapshot(ctx context.Context, fs *zfs.DatasetPath, name string, recursive bool) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	ds, err := b.lookupDataset(fs.ToString())
+	if err != nil {
+		return err
+	}
+	targets := []*dataset{ds}
+	if recursive {
+		for n, child := range b.datasets {
+			if strings.HasPrefix(n, ds.name+"/") {
+				targets = append(targets, child)
+			}
+		}
+	}
+	for _, t := range targets {
+		if t.lookupVersion(zfs.Snapshot, name) != nil {
+			return zfsError("cannot create snapshot '%s@%s': dataset already exists", t.name, name)
+		}
+	}
+
+	b.txg++
+	for _, t := range targets {
+		b.guid++
+		t.addVersion(&version{
+			typ:       zfs.Snapshot,
+			name:      name,
+			guid:      b.guid,
+			createtxg: b.txg,
+			creation:  b.Now(),
+			holds:     make(map[string]bool),
+		})
+	}
+	return nil
+}
+
+func (b *Backend) Bookmark(ctx context.Context, fs *zfs.DatasetPath, v zfs.FilesystemVersion, bookmark string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	snap, err := b.lookupSnapshot(fs, v)
+	if err != nil {
+		return err
+	}
+	ds := b.datasets[fs.ToString()]
+	if ds.lookupVersion(zfs.Bookmark, bookmark) != nil {
+		return zfsError("cannot create bookmark '%s#%s': bookmark exists", ds.name, bookmark)
+	}
+	ds.addVersion(&version{
+		typ:       zfs.Bookmark,
+		name:      bookmark,
+		guid:      snap.guid,
+		createtxg: snap.createtxg,
+		creation:  snap.creation,
+	})
+	return nil
+}
+
+func (b *Backend) CreatePlaceholderFilesystem(ctx context.Context, p *zfs.DatasetPath) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	name := p.ToString()
+	if err = b.checkCreate(name); err != nil {
+		return
+	}
+	ds := b.newDataset(name)
+	ds.props[zfs.ZREPL_PLACEHOLDER_PROPERTY_NAME] = zfs.PlaceholderPropertyValue(p)
+	ds.props["mountpoint"] = "none"
+	b.datasets[name] = ds
+	return nil
+}
+
+func (b *Backend) Hold(ctx context.Context, fs *zfs.DatasetPath, v zfs.FilesystemVersion, tag string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	snap, err := b.lookupSnapshot(fs, v)
+	if err != nil {
+		return err
+	}
+	snap.holds[tag] = true
+	return nil
+}
+
+func (b *Backend) Release(ctx context.Context, fs *zfs.DatasetPath, v zfs.FilesystemVersion, tag string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	snap, err := b.lookupSnapshot(fs, v)
+	if err != nil {
+		return err
+	}
+	delete(snap.holds, tag)
+	return nil
+}
+
+func (b *Backend) Holds(ctx context.Context, fs *zfs.DatasetPath, v zfs.FilesystemVersion) (tags []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	snap, err := b.lookupSnapshot(fs, v)
+	if err != nil {
+		return nil, err
+	}
+	tags = make([]string, 0, len(snap.holds))
+	for t := range snap.holds {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,101 @@
+package zfstest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zrepl/zrepl/zfs"
+)
+
+var ctx = context.Background()
+
+func path(t *testing.T, s string) *zfs.DatasetPath {
+	p, err := zfs.NewDatasetPath(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func snap(name string) zfs.FilesystemVersion {
+	return zfs.FilesystemVersion{Type: zfs.Snapshot, Name: name}
+}
+
+func TestListDepthAndTypes(t *testing.T) {
+	b := NewBackend("pool")
+	assert.NoError(t, b.CreateFilesystem("pool/a"))
+	assert.NoError(t, b.CreateFilesystem("pool/a/b"))
+	assert.Error(t, b.CreateFilesystem("pool/x/y"), "parent must exist")
+	assert.NoError(t, b.Snapshot(ctx, path(t, "pool/a"), "s1", true))
+
+	res, err := b.List(ctx, []string{"name"}, "-r", "-d", "1", "-t", "snapshot", "pool/a")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pool/a@s1"}}, res)
+
+	res, err = b.List(ctx, []string{"name"}, "-r", "-t", "filesystem")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pool"}, {"pool/a"}, {"pool/a/b"}}, res)
+
+	_, err = b.List(ctx, []string{"name"}, "pool/nonexistent")
+	assert.IsType(t, zfs.ZFSError{}, err)
+}
+
+func TestDestroyHeldSnapshotIsBusy(t *testing.T) {
+	b := NewBackend("pool")
+	fs := path(t, "pool")
+	assert.NoError(t, b.Snapshot(ctx, fs, "s1", false))
+	assert.NoError(t, b.Hold(ctx, fs, snap("s1"), "keep"))
+
+	err := b.Destroy(ctx, "pool@s1")
+	assert.Error(t, err)
+	assert.Contains(t, string(err.(zfs.ZFSError).Stderr), "dataset is busy")
+
+	assert.NoError(t, b.Release(ctx, fs, snap("s1"), "keep"))
+	assert.NoError(t, b.Destroy(ctx, "pool@s1"))
+}
+
+func TestResumableRecv(t *testing.T) {
+	b := NewBackend("src", "dst")
+	src, dst := path(t, "src"), path(t, "dst/fs")
+	assert.NoError(t, b.Snapshot(ctx, src, "s1", false))
+
+	b.InterruptNextSendAfter = 1000
+	stream, err := b.Send(ctx, src, &zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "s1"}, nil, zfs.SendFlags{})
+	assert.NoError(t, err)
+	assert.Error(t, b.Recv(ctx, dst, stream, "-s"))
+
+	res, err := b.List(ctx, []string{"receive_resume_token"}, "dst/fs")
+	assert.NoError(t, err)
+	token := res[0][0]
+	assert.NotEqual(t, "-", token)
+
+	parsed, err := b.ParseResumeToken(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "src@s1", parsed.ToName)
+
+	stream, err = b.SendResume(ctx, token)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Recv(ctx, dst, stream, "-s"))
+
+	res, err = b.List(ctx, []string{"name", "guid", "receive_resume_token"}, "-r", "-t", "snapshot,filesystem", "dst/fs")
+	assert.NoError(t, err)
+	srcRes, err := b.List(ctx, []string{"guid"}, "src@s1")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"dst/fs", res[0][1], "-"}, {"dst/fs@s1", srcRes[0][0], "-"}}, res)
+}
+
+func TestRecvAbortResumableRemovesNewFilesystem(t *testing.T) {
+	b := NewBackend("src", "dst")
+	src, dst := path(t, "src"), path(t, "dst/fs")
+	assert.NoError(t, b.Snapshot(ctx, src, "s1", false))
+
+	b.InterruptNextSendAfter = 1000
+	stream, err := b.Send(ctx, src, &zfs.FilesystemVersion{Type: zfs.Snapshot, Name: "s1"}, nil, zfs.SendFlags{})
+	assert.NoError(t, err)
+	assert.Error(t, b.Recv(ctx, dst, stream, "-s"))
+
+	assert.NoError(t, b.RecvAbortResumable(ctx, dst))
+	_, err = b.List(ctx, []string{"name"}, "dst/fs")
+	assert.Error(t, err)
+}